@@ -0,0 +1,230 @@
+// Package k8smeta enriches resolved pods with metadata from the Kubernetes
+// API: labels, annotations, the node and the top-level owning workload.
+package k8smeta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Workload is a Kubernetes object that owns pods, such as a Deployment.
+type Workload struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// PodMeta is the metadata of a pod as reported by the API server.
+type PodMeta struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Node        string            `json:"node,omitempty"`
+	// Owners is the chain of owners from the pod's direct controller up to
+	// the top-level workload.
+	Owners []Workload `json:"owners,omitempty"`
+}
+
+// Workload returns the top-level owner of the pod, or the zero Workload for
+// a bare pod.
+func (m *PodMeta) Workload() Workload {
+	if len(m.Owners) == 0 {
+		return Workload{}
+	}
+	return m.Owners[len(m.Owners)-1]
+}
+
+// NewClient builds a clientset. An empty kubeconfig uses the in-cluster
+// config when running in a pod and otherwise $KUBECONFIG or ~/.kube/config.
+func NewClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := loadConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	return client, nil
+}
+
+func loadConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kubeconfig %s: %w", kubeconfig, err)
+		}
+		return config, nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+	if !errors.Is(err, rest.ErrNotInCluster) {
+		return nil, fmt.Errorf("failed to load in-cluster config: %w", err)
+	}
+
+	config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	return config, nil
+}
+
+// Enricher looks up pod metadata and caches it for a while, so resolving
+// many PIDs of the same pod costs one API call.
+type Enricher struct {
+	client kubernetes.Interface
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	pods   map[string]cached[*PodMeta]
+	owners map[string]cached[[]metav1.OwnerReference]
+}
+
+type cached[T any] struct {
+	value   T
+	expires time.Time
+}
+
+// NewEnricher returns an Enricher using client. Results are cached for ttl.
+func NewEnricher(client kubernetes.Interface, ttl time.Duration) *Enricher {
+	return &Enricher{
+		client: client,
+		ttl:    ttl,
+		now:    time.Now,
+		pods:   map[string]cached[*PodMeta]{},
+		owners: map[string]cached[[]metav1.OwnerReference]{},
+	}
+}
+
+// PodMeta returns the metadata of a pod.
+func (e *Enricher) PodMeta(ctx context.Context, namespace, name string) (*PodMeta, error) {
+	key := namespace + "/" + name
+
+	e.mu.Lock()
+	if c, ok := e.pods[key]; ok && e.now().Before(c.expires) {
+		e.mu.Unlock()
+		return c.value, nil
+	}
+	e.mu.Unlock()
+
+	pod, err := e.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %s: %w", key, err)
+	}
+
+	meta := &PodMeta{
+		Labels:      pod.Labels,
+		Annotations: pod.Annotations,
+		Node:        pod.Spec.NodeName,
+	}
+	meta.Owners, err = e.ownerChain(ctx, namespace, pod.OwnerReferences)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	e.pods[key] = cached[*PodMeta]{value: meta, expires: e.now().Add(e.ttl)}
+	e.mu.Unlock()
+
+	return meta, nil
+}
+
+// maxOwnerDepth guards against owner reference cycles.
+const maxOwnerDepth = 8
+
+// ownerChain follows controller owner references up to the top-level
+// workload, e.g. Pod → ReplicaSet → Deployment or Pod → Job → CronJob.
+func (e *Enricher) ownerChain(ctx context.Context, namespace string, refs []metav1.OwnerReference) ([]Workload, error) {
+	var chain []Workload
+	for i := 0; i < maxOwnerDepth; i++ {
+		ref := controllerOf(refs)
+		if ref == nil {
+			break
+		}
+		chain = append(chain, Workload{Kind: ref.Kind, Name: ref.Name})
+
+		next, known, err := e.ownerRefs(ctx, namespace, ref.Kind, ref.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !known {
+			break
+		}
+		refs = next
+	}
+	return chain, nil
+}
+
+// controllerOf returns the managing controller, or the first owner if none
+// is marked as controller.
+func controllerOf(refs []metav1.OwnerReference) *metav1.OwnerReference {
+	for i := range refs {
+		if refs[i].Controller != nil && *refs[i].Controller {
+			return &refs[i]
+		}
+	}
+	if len(refs) > 0 {
+		return &refs[0]
+	}
+	return nil
+}
+
+// ownerRefs returns the owner references of a workload. known is false for
+// kinds we don't know how to fetch, which end the chain.
+func (e *Enricher) ownerRefs(ctx context.Context, namespace, kind, name string) ([]metav1.OwnerReference, bool, error) {
+	key := namespace + "/" + kind + "/" + name
+
+	e.mu.Lock()
+	if c, ok := e.owners[key]; ok && e.now().Before(c.expires) {
+		e.mu.Unlock()
+		return c.value, true, nil
+	}
+	e.mu.Unlock()
+
+	var obj metav1.Object
+	var err error
+	switch kind {
+	case "ReplicaSet":
+		obj, err = e.client.AppsV1().ReplicaSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "Deployment":
+		obj, err = e.client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "StatefulSet":
+		obj, err = e.client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "DaemonSet":
+		obj, err = e.client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "Job":
+		obj, err = e.client.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "CronJob":
+		obj, err = e.client.BatchV1().CronJobs(namespace).Get(ctx, name, metav1.GetOptions{})
+	default:
+		return nil, false, nil
+	}
+	if apierrors.IsNotFound(err) {
+		// The owner is already gone; the pod is orphaned.
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get %s %s: %w", kind, key, err)
+	}
+
+	refs := obj.GetOwnerReferences()
+	e.mu.Lock()
+	e.owners[key] = cached[[]metav1.OwnerReference]{value: refs, expires: e.now().Add(e.ttl)}
+	e.mu.Unlock()
+
+	return refs, true, nil
+}
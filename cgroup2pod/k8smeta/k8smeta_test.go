@@ -0,0 +1,169 @@
+package k8smeta
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const namespace = "default"
+
+func ownedBy(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func pod(name string, owners []metav1.OwnerReference) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			Labels:          map[string]string{"app": name},
+			OwnerReferences: owners,
+		},
+		Spec: corev1.PodSpec{NodeName: "node-1"},
+	}
+}
+
+func replicaSet(name string, owners []metav1.OwnerReference) *appsv1.ReplicaSet {
+	return &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, OwnerReferences: owners}}
+}
+
+func TestPodMetaOwners(t *testing.T) {
+	deep := make([]Workload, maxOwnerDepth)
+	for i := range deep {
+		deep[i] = Workload{Kind: "ReplicaSet", Name: "loop"}
+	}
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		pod     string
+		want    []Workload
+	}{
+		{
+			name:    "bare pod",
+			objects: []runtime.Object{pod("bare", nil)},
+			pod:     "bare",
+		},
+		{
+			name: "deployment",
+			objects: []runtime.Object{
+				pod("web-abc12", ownedBy("ReplicaSet", "web-5d4f")),
+				replicaSet("web-5d4f", ownedBy("Deployment", "web")),
+				&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "web"}},
+			},
+			pod:  "web-abc12",
+			want: []Workload{{"ReplicaSet", "web-5d4f"}, {"Deployment", "web"}},
+		},
+		{
+			name: "cronjob",
+			objects: []runtime.Object{
+				pod("backup-28f3-x1", ownedBy("Job", "backup-28f3")),
+				&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "backup-28f3", OwnerReferences: ownedBy("CronJob", "backup")}},
+				&batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "backup"}},
+			},
+			pod:  "backup-28f3-x1",
+			want: []Workload{{"Job", "backup-28f3"}, {"CronJob", "backup"}},
+		},
+		{
+			name:    "orphaned",
+			objects: []runtime.Object{pod("orphan", ownedBy("ReplicaSet", "gone"))},
+			pod:     "orphan",
+			want:    []Workload{{"ReplicaSet", "gone"}},
+		},
+		{
+			name:    "unknown kind",
+			objects: []runtime.Object{pod("custom", ownedBy("Rollout", "canary"))},
+			pod:     "custom",
+			want:    []Workload{{"Rollout", "canary"}},
+		},
+		{
+			name: "controller preferred",
+			objects: []runtime.Object{
+				pod("multi", append([]metav1.OwnerReference{{Kind: "ConfigMap", Name: "cm"}}, ownedBy("DaemonSet", "agent")...)),
+				&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "agent"}},
+			},
+			pod:  "multi",
+			want: []Workload{{"DaemonSet", "agent"}},
+		},
+		{
+			name: "owner cycle",
+			objects: []runtime.Object{
+				pod("looping", ownedBy("ReplicaSet", "loop")),
+				replicaSet("loop", ownedBy("ReplicaSet", "loop")),
+			},
+			pod:  "looping",
+			want: deep,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEnricher(fake.NewSimpleClientset(tt.objects...), time.Minute)
+			meta, err := e.PodMeta(context.Background(), namespace, tt.pod)
+			if err != nil {
+				t.Fatalf("PodMeta: %v", err)
+			}
+			if !reflect.DeepEqual(meta.Owners, tt.want) {
+				t.Errorf("owners = %v, want %v", meta.Owners, tt.want)
+			}
+			if meta.Node != "node-1" || meta.Labels["app"] != tt.pod {
+				t.Errorf("node = %q, labels = %v", meta.Node, meta.Labels)
+			}
+		})
+	}
+}
+
+func TestPodMetaNotFound(t *testing.T) {
+	e := NewEnricher(fake.NewSimpleClientset(), time.Minute)
+	if _, err := e.PodMeta(context.Background(), namespace, "missing"); err == nil {
+		t.Fatal("PodMeta of a missing pod succeeded")
+	}
+}
+
+func TestPodMetaTTL(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		pod("web-abc12", ownedBy("ReplicaSet", "web-5d4f")),
+		replicaSet("web-5d4f", ownedBy("Deployment", "web")),
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "web"}},
+	)
+	now := time.Unix(1700000000, 0)
+	e := NewEnricher(client, time.Minute)
+	e.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		calls   int
+	}{
+		{"first lookup", 0, 3},
+		{"cached", 30 * time.Second, 0},
+		{"just before expiry", 29*time.Second + 999*time.Millisecond, 0},
+		{"expired", time.Millisecond, 3},
+		{"cached again", time.Second, 0},
+	}
+
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		client.ClearActions()
+		meta, err := e.PodMeta(context.Background(), namespace, "web-abc12")
+		if err != nil {
+			t.Fatalf("%s: PodMeta: %v", tt.name, err)
+		}
+		if got := len(client.Actions()); got != tt.calls {
+			t.Errorf("%s: %d API calls, want %d", tt.name, got, tt.calls)
+		}
+		if w := meta.Workload(); w != (Workload{"Deployment", "web"}) {
+			t.Errorf("%s: workload = %v", tt.name, w)
+		}
+	}
+}
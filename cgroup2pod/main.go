@@ -1,20 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
-)
+	"time"
 
-// PodInfo represents relevant information about a Kubernetes pod.
-type PodInfo struct {
-	CgroupID  string
-	Namespace string
-	Name      string
-	UID       string
-}
+	"cgroup2pod/k8smeta"
+	"podresolver"
+	"podresolver/report"
+)
 
 // ContainerStatus represents the container status from crictl inspectp.
 type ContainerStatus struct {
@@ -61,8 +62,10 @@ func getCrictlPods() ([]string, error) {
 	return podIDs, nil
 }
 
-// inspectCrictlPod retrieves detailed information about a pod using crictl inspectp.
-func inspectCrictlPod(podID string) (*PodInfo, error) {
+// inspectCrictlPod retrieves detailed information about a pod using crictl
+// inspectp, and the containers and PIDs found in its cgroup. A pod whose
+// cgroup can't be read is returned with its Error set.
+func inspectCrictlPod(podID, rootCgroupPath string) (*report.Pod, error) {
 	cmd := exec.Command("crictl", "inspectp", podID)
 	output, err := cmd.Output()
 	if err != nil {
@@ -73,53 +76,126 @@ func inspectCrictlPod(podID string) (*PodInfo, error) {
 	if err := json.Unmarshal(output, &status); err != nil {
 		return nil, fmt.Errorf("failed to parse inspectp output: %w", err)
 	}
-	fmt.Println("%v", status)
-
-	// Extract the cgroup ID from cgroupsPath
-	cgroupID := extractCgroupID(status.Info.RuntimeSpec.Linux.CgroupsPath)
 
-	return &PodInfo{
-		CgroupID:  cgroupID,
+	pod := &report.Pod{
 		Namespace: status.Info.Metadata.Namespace,
 		Name:      status.Info.Metadata.Name,
 		UID:       status.Info.Metadata.UID,
-	}, nil
+	}
+
+	// cgroupsPath is the cgroup of the sandbox (pause) container, which sits
+	// directly in the pod cgroup next to the other containers.
+	sandboxDir := podresolver.CgroupsPathDir(rootCgroupPath, status.Info.RuntimeSpec.Linux.CgroupsPath)
+	podDir := filepath.Dir(sandboxDir)
+	pod.Cgroup = report.NewCgroup(podDir)
+
+	containers, err := podresolver.WalkContainers(podDir, podresolver.WalkOptions{})
+	if err != nil {
+		pod.Error = err.Error()
+		return pod, nil
+	}
+	for _, c := range containers {
+		pod.Containers = append(pod.Containers, report.ContainerFromResolver(c))
+	}
+
+	return pod, nil
 }
 
-// extractCgroupID parses the cgroup path to extract the cgroup ID.
-func extractCgroupID(cgroupPath string) string {
-	// Split the path and extract the last component containing the pod identifier
-	parts := strings.Split(cgroupPath, "/")
-	for _, part := range parts {
-		if strings.HasPrefix(part, "kubepods") {
-			return part
+// enrichPods adds labels, annotations, node and owning workload to each pod.
+func enrichPods(pods []*report.Pod, kubeconfig string) error {
+	client, err := k8smeta.NewClient(kubeconfig)
+	if err != nil {
+		return err
+	}
+	enricher := k8smeta.NewEnricher(client, time.Minute)
+
+	for _, pod := range pods {
+		meta, err := enricher.PodMeta(context.Background(), pod.Namespace, pod.Name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error enriching pod %s/%s: %v\n", pod.Namespace, pod.Name, err)
+			// Keep an earlier error, e.g. from reading the cgroup
+			if pod.Error != "" {
+				pod.Error += "; "
+			}
+			pod.Error += "enrich: " + err.Error()
+			continue
+		}
+		pod.Labels = meta.Labels
+		pod.Annotations = meta.Annotations
+		pod.Node = meta.Node
+		if w := meta.Workload(); w.Kind != "" {
+			pod.Workload = &report.Workload{Kind: w.Kind, Name: w.Name}
 		}
 	}
-	return ""
+	return nil
 }
 
 func main() {
+	output := flag.String("o", "table", "Output format: "+strings.Join(report.Formats, ", "))
+	withK8s := flag.Bool("k8s", false, "Look up labels, node and owning workload from the Kubernetes API")
+	kubeconfig := flag.String("kubeconfig", "", "Path to kubeconfig (defaults to in-cluster config, $KUBECONFIG or ~/.kube/config)")
+	flag.Parse()
+
+	if !report.ValidFormat(*output) {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", *output)
+		os.Exit(report.ExitUsage)
+	}
+
+	rootCgroupPath, err := podresolver.GetRootCgroupPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error finding the cgroup mount: %v\n", err)
+		os.Exit(report.ExitFailure)
+	}
+
 	// Retrieve the list of pod sandbox IDs.
 	podIDs, err := getCrictlPods()
 	if err != nil {
-		fmt.Printf("Error retrieving pods: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Error retrieving pods: %v\n", err)
+		os.Exit(report.ExitFailure)
 	}
 
-	// Build a map of cgroup IDs to pod information.
-	cgroupToPodMap := make(map[string]*PodInfo)
+	// Resolve each pod's cgroup and containers. Pods that can't be inspected
+	// are left out, and make the exit status report a partial result.
+	exitCode := report.ExitOK
+	var pods []*report.Pod
 	for _, podID := range podIDs {
-		podInfo, err := inspectCrictlPod(podID)
+		pod, err := inspectCrictlPod(podID, rootCgroupPath)
 		if err != nil {
-			fmt.Printf("Error inspecting pod %s: %v\n", podID, err)
+			fmt.Fprintf(os.Stderr, "Error inspecting pod %s: %v\n", podID, err)
+			exitCode = report.ExitPartial
 			continue
 		}
-		cgroupToPodMap[podInfo.CgroupID] = podInfo
+		if pod.Error != "" {
+			fmt.Fprintf(os.Stderr, "Error reading cgroup of pod %s/%s: %s\n", pod.Namespace, pod.Name, pod.Error)
+		}
+		pods = append(pods, pod)
+	}
+
+	if *withK8s {
+		if err := enrichPods(pods, *kubeconfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Error connecting to Kubernetes: %v\n", err)
+			os.Exit(report.ExitFailure)
+		}
 	}
 
 	// Print the mapping.
-	fmt.Println("Cgroup ID to Pod Mapping:")
-	for cgroupID, pod := range cgroupToPodMap {
-		fmt.Printf("Cgroup ID: %s -> Pod: %s/%s (UID: %s)\n", cgroupID, pod.Namespace, pod.Name, pod.UID)
+	result := make([]report.Pod, 0, len(pods))
+	for _, pod := range pods {
+		result = append(result, *pod)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace != result[j].Namespace {
+			return result[i].Namespace < result[j].Namespace
+		}
+		return result[i].Name < result[j].Name
+	})
+	if err := report.Write(os.Stdout, *output, result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(report.ExitFailure)
+	}
+
+	if code := report.ExitCode(result); code != report.ExitOK {
+		exitCode = code
 	}
+	os.Exit(exitCode)
 }
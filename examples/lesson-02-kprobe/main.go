@@ -2,16 +2,14 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
-	"unsafe"
+
+	"podresolver/decode"
+	"podresolver/eventreader"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/ringbuf"
 )
 
 type Event struct {
@@ -20,6 +18,9 @@ type Event struct {
 	Filename [256]byte
 }
 
+// decoder decodes Event records without binary.Read
+var decoder = decode.MustDecoder[Event]()
+
 func main() {
 	// Load eBPF program
 	spec, err := ebpf.LoadCollectionSpec("kprobe_unlink.o")
@@ -48,38 +49,35 @@ func main() {
 	log.Println("kprobe attached. Monitoring unlink() syscalls...")
 
 	// Read from ringbuf
-	rd, err := ringbuf.NewReader(coll.Maps["events"])
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
 	if err != nil {
 		log.Fatalf("Failed to create ringbuf reader: %v", err)
 	}
 	defer rd.Close()
 
 	// Setup signal handling
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
 
 	log.Println("PID\tCOMM\tFILENAME")
 	log.Println("---\t----\t--------")
 
-	go func() {
-		for {
-			record, err := rd.Read()
-			if err != nil {
-				return
-			}
-
-			var e Event
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &e); err != nil {
-				log.Printf("Failed to parse event: %v", err)
-				continue
-			}
-
-			comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
-			filename := string(bytes.TrimRight(e.Filename[:], "\x00"))
-			log.Printf("%d\t%s\t%s\n", e.PID, comm, filename)
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var e Event
+		if err := decoder.Decode(record.RawSample, &e); err != nil {
+			log.Printf("Failed to parse event: %v", err)
+			return nil
 		}
-	}()
 
-	<-sig
+		comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
+		filename := string(bytes.TrimRight(e.Filename[:], "\x00"))
+		log.Printf("%d\t%s\t%s\n", e.PID, comm, filename)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
+
 	log.Println("\nDetaching...")
+	log.Printf("Read %s\n", rd.Stats())
 }
@@ -18,22 +18,80 @@ struct {
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-SEC("fentry/do_unlinkat")
-int BPF_PROG(fentry_unlink, int dfd, struct filename *name)
+// Unlinks in flight, by thread ID, from function entry to exit
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u32);
+    __type(value, struct event);
+} unlinks SEC(".maps");
+
+static const struct event empty_event = {};
+
+// The filename is read at entry: do_unlinkat frees it with putname()
+// before returning.
+static __always_inline int unlink_enter(struct filename *name)
 {
+    u64 id = bpf_get_current_pid_tgid();
+    u32 tid = (u32)id;
+    const char *filename = NULL;
     struct event *e;
-    e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
+
+    if (bpf_map_update_elem(&unlinks, &tid, &empty_event, BPF_ANY))
+        return 0;
+    e = bpf_map_lookup_elem(&unlinks, &tid);
     if (!e)
         return 0;
 
     e->ts = bpf_ktime_get_ns();
-    e->pid = bpf_get_current_pid_tgid() >> 32;
+    e->pid = id >> 32;
     e->uid = bpf_get_current_uid_gid() & 0xFFFFFFFF;
     bpf_get_current_comm(&e->comm, sizeof(e->comm));
-    bpf_probe_read_kernel_str(&e->filename, sizeof(e->filename), name->name);
+    bpf_probe_read_kernel(&filename, sizeof(filename), &name->name);
+    if (filename)
+        bpf_probe_read_kernel_str(&e->filename, sizeof(e->filename), filename);
+    return 0;
+}
+
+static __always_inline int unlink_exit(long ret)
+{
+    u32 tid = (u32)bpf_get_current_pid_tgid();
+    struct event *e;
+
+    e = bpf_map_lookup_elem(&unlinks, &tid);
+    if (!e)
+        return 0;
 
-    bpf_ringbuf_submit(e, 0);
+    e->ret = ret;
+    bpf_ringbuf_output(&events, e, sizeof(*e), 0);
+    bpf_map_delete_elem(&unlinks, &tid);
     return 0;
 }
 
+SEC("fentry/do_unlinkat")
+int BPF_PROG(fentry_unlink, int dfd, struct filename *name)
+{
+    return unlink_enter(name);
+}
+
+SEC("fexit/do_unlinkat")
+int BPF_PROG(fexit_unlink, int dfd, struct filename *name, int ret)
+{
+    return unlink_exit(ret);
+}
+
+// Fallback for kernels without BTF trampolines, which fentry and fexit
+// need.
+SEC("kprobe/do_unlinkat")
+int BPF_KPROBE(kprobe_unlink, int dfd, struct filename *name)
+{
+    return unlink_enter(name);
+}
+
+SEC("kretprobe/do_unlinkat")
+int BPF_KRETPROBE(kretprobe_unlink, int ret)
+{
+    return unlink_exit(ret);
+}
+
 char LICENSE[] SEC("license") = "GPL";
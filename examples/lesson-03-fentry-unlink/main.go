@@ -2,17 +2,18 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
 	"syscall"
 	"time"
 
+	"podresolver/decode"
+	"podresolver/eventreader"
+
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/link"
 )
 
 type event struct {
@@ -24,17 +25,136 @@ type event struct {
 	Ret      int64
 }
 
+// decoder decodes event records without binary.Read
+var decoder = decode.MustDecoder[event]()
+
+// probes are the programs of fentry_unlink.c for each way of attaching
+var probes = map[string][]string{
+	"fentry": {"fentry_unlink", "fexit_unlink"},
+	"kprobe": {"kprobe_unlink", "kretprobe_unlink"},
+}
+
+// attach loads the programs of one kind and attaches them to do_unlinkat.
+// The programs of the other kind are left out of the spec, so that a kernel
+// that can't load them doesn't stop the rest.
+func attach(spec *ebpf.CollectionSpec, kind string) (*ebpf.Collection, []link.Link, error) {
+	spec = spec.Copy()
+	for other, progs := range probes {
+		if other == kind {
+			continue
+		}
+		for _, name := range progs {
+			delete(spec.Programs, name)
+		}
+	}
+
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create eBPF collection: %w", err)
+	}
+
+	var links []link.Link
+	closeAll := func() {
+		for _, l := range links {
+			l.Close()
+		}
+		coll.Close()
+	}
+	for _, name := range probes[kind] {
+		prog := coll.Programs[name]
+		if prog == nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("%s program not found", name)
+		}
+
+		var l link.Link
+		switch name {
+		case "fentry_unlink", "fexit_unlink":
+			l, err = link.AttachTracing(link.TracingOptions{Program: prog})
+		case "kprobe_unlink":
+			l, err = link.Kprobe("do_unlinkat", prog, nil)
+		case "kretprobe_unlink":
+			l, err = link.Kretprobe("do_unlinkat", prog, nil)
+		}
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to attach %s: %w", name, err)
+		}
+		links = append(links, l)
+	}
+	return coll, links, nil
+}
+
+// result formats the return value of do_unlinkat
+func result(ret int64) string {
+	if ret >= 0 {
+		return "ok"
+	}
+	return fmt.Sprintf("%d (%v)", ret, syscall.Errno(-ret))
+}
+
 func main() {
-	fmt.Println("Lesson 3: fentry Probes")
-	fmt.Println("========================")
-	fmt.Println()
-	fmt.Println("This lesson demonstrates using fentry probes for fast function entry instrumentation.")
-	fmt.Println()
-	fmt.Println("Build: make build")
-	fmt.Println("Run:   make run")
-	fmt.Println()
-	fmt.Println("The eBPF program (fentry_unlink.c) attaches to the do_unlinkat kernel function")
-	fmt.Println("and captures file deletion events using a ring buffer.")
-	fmt.Println()
-	fmt.Println("TODO: Implement full example with link attachment")
+	useKprobe := flag.Bool("kprobe", false, "Use kprobe/kretprobe even if fentry/fexit are supported")
+	flag.Parse()
+
+	// Load eBPF program
+	spec, err := ebpf.LoadCollectionSpec("fentry_unlink.o")
+	if err != nil {
+		log.Fatalf("Failed to load eBPF spec: %v", err)
+	}
+
+	// Prefer fentry/fexit, which need BTF trampolines (Linux 5.5 on x86_64,
+	// 6.0 on arm64), and fall back to kprobes
+	kind := "fentry"
+	if *useKprobe {
+		kind = "kprobe"
+	}
+	coll, links, err := attach(spec, kind)
+	if err != nil && kind == "fentry" {
+		log.Printf("fentry unavailable, falling back to kprobe: %v", err)
+		kind = "kprobe"
+		coll, links, err = attach(spec, kind)
+	}
+	if err != nil {
+		log.Fatalf("Failed to attach: %v", err)
+	}
+	defer coll.Close()
+	for _, l := range links {
+		defer l.Close()
+	}
+
+	log.Printf("%s attached. Monitoring unlink() calls...", kind)
+
+	// Read from ringbuf
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
+	if err != nil {
+		log.Fatalf("Failed to create ringbuf reader: %v", err)
+	}
+	defer rd.Close()
+
+	// Setup signal handling
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
+
+	fmt.Printf("%-15s %-7s %-6s %-16s %-28s %s\n", "TIME", "PID", "UID", "COMM", "RESULT", "FILE")
+
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var e event
+		if err := decoder.Decode(record.RawSample, &e); err != nil {
+			log.Printf("Failed to parse event: %v", err)
+			return nil
+		}
+
+		ts := time.Now().Format("15:04:05.000000")
+		comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
+		filename := string(bytes.TrimRight(e.Filename[:], "\x00"))
+		fmt.Printf("%-15s %-7d %-6d %-16s %-28s %s\n", ts, e.Pid, e.Uid, comm, result(e.Ret), filename)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
+
+	log.Println("Detaching...")
+	log.Printf("Read %s\n", rd.Stats())
 }
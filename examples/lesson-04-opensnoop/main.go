@@ -2,15 +2,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"flag"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
+
+	"podresolver"
+	"podresolver/cgroupfilter"
+	"podresolver/decode"
+	"podresolver/eventreader"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/ringbuf"
 )
 
 type Event struct {
@@ -20,19 +22,50 @@ type Event struct {
 	Flags    int32
 }
 
+// decoder decodes Event records without binary.Read
+var decoder = decode.MustDecoder[Event]()
+
 func main() {
+	namespace := flag.String("n", "", "Only trace pods in this namespace")
+	labels := flag.String("l", "", "Only trace pods matching this label selector, e.g. app=api")
+	flag.Parse()
+
+	selector, err := podresolver.ParseSelector(*namespace, *labels)
+	if err != nil {
+		log.Fatalf("Invalid selector: %v", err)
+	}
+
+	// Stop on Ctrl-C or SIGTERM
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
+
 	// Load eBPF program
 	spec, err := ebpf.LoadCollectionSpec("opensnoop.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF spec: %v", err)
 	}
 
+	if !selector.Empty() {
+		if err := cgroupfilter.Enable(spec); err != nil {
+			log.Fatalf("Failed to enable pod filter: %v", err)
+		}
+	}
+
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
 		log.Fatalf("Failed to create eBPF collection: %v", err)
 	}
 	defer coll.Close()
 
+	// Only trace the selected pods
+	if !selector.Empty() {
+		filter, err := cgroupfilter.Start(ctx, coll.Maps[cgroupfilter.MapName], selector)
+		if err != nil {
+			log.Fatalf("Failed to start pod filter: %v", err)
+		}
+		log.Printf("Tracing %d pods matching %s\n", len(filter.Pods()), selector)
+	}
+
 	// Attach to tracepoint
 	prog := coll.Programs["trace_openat"]
 	if prog == nil {
@@ -48,37 +81,30 @@ func main() {
 	log.Println("opensnoop attached. Monitoring open() syscalls...")
 
 	// Read from ringbuf
-	rd, err := ringbuf.NewReader(coll.Maps["events"])
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
 	if err != nil {
 		log.Fatalf("Failed to create ringbuf reader: %v", err)
 	}
 	defer rd.Close()
 
-	// Setup signal handling
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-
 	log.Println("PID\tCOMM\t\tFILENAME")
 	log.Println("---\t----\t\t--------")
 
-	go func() {
-		for {
-			record, err := rd.Read()
-			if err != nil {
-				return
-			}
-
-			var e Event
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &e); err != nil {
-				continue
-			}
-
-			comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
-			filename := string(bytes.TrimRight(e.Filename[:], "\x00"))
-			log.Printf("%d\t%-16s\t%s\n", e.PID, comm, filename)
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var e Event
+		if err := decoder.Decode(record.RawSample, &e); err != nil {
+			return nil
 		}
-	}()
 
-	<-sig
+		comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
+		filename := string(bytes.TrimRight(e.Filename[:], "\x00"))
+		log.Printf("%d\t%-16s\t%s\n", e.PID, comm, filename)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
+
 	log.Println("\nDetaching...")
+	log.Printf("Read %s\n", rd.Stats())
 }
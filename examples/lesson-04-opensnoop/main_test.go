@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Offsets of the fields of struct event in opensnoop.c
+const (
+	offPID      = 0
+	offComm     = 4
+	offFilename = 20
+	offFlags    = 276
+	eventSize   = 280
+)
+
+func TestDecodeEvent(t *testing.T) {
+	if decoder.Size() != eventSize {
+		t.Fatalf("Event is %d bytes, struct event is %d", decoder.Size(), eventSize)
+	}
+
+	raw := make([]byte, eventSize)
+	binary.NativeEndian.PutUint32(raw[offPID:], 4242)
+	copy(raw[offComm:], "cat")
+	copy(raw[offFilename:], "/etc/ld.so.cache")
+	binary.NativeEndian.PutUint32(raw[offFlags:], 0x80000)
+
+	var e Event
+	if err := decoder.Decode(raw, &e); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if e.PID != 4242 || e.Flags != 0x80000 {
+		t.Errorf("PID = %d, Flags = %#x", e.PID, e.Flags)
+	}
+	if comm := string(bytes.TrimRight(e.Comm[:], "\x00")); comm != "cat" {
+		t.Errorf("Comm = %q", comm)
+	}
+	if filename := string(bytes.TrimRight(e.Filename[:], "\x00")); filename != "/etc/ld.so.cache" {
+		t.Errorf("Filename = %q", filename)
+	}
+
+	if err := decoder.Decode(raw[:offFlags], &e); err == nil {
+		t.Error("Decode of a short record succeeded")
+	}
+}
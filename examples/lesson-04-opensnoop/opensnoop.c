@@ -1,5 +1,8 @@
+//go:build ignore
+
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
+#include "cgroup_filter.h"
 
 struct event {
 	u32 pid;
@@ -16,6 +19,10 @@ struct {
 SEC("tp/syscalls/sys_enter_openat")
 int trace_openat(struct trace_event_raw_sys_enter *ctx) {
 	struct event *e;
+
+	if (!cgroup_allowed())
+		return 0;
+
 	e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
 	if (!e)
 		return 0;
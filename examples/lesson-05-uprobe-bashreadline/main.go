@@ -1,29 +1,117 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"podresolver/decode"
+	"podresolver/eventreader"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
 )
 
 type event struct {
-	Ts    uint64
-	Pid   uint32
-	Uid   uint32
-	Comm  [16]byte
-	Input uint64
+	Ts   uint64
+	Pid  uint32
+	Uid  uint32
+	Comm [16]byte
+	Line [256]byte
+}
+
+// decoder decodes event records without binary.Read
+var decoder = decode.MustDecoder[event]()
+
+// resolveTarget returns the path of a binary given by path or by name on
+// $PATH
+func resolveTarget(target string) (string, error) {
+	if strings.Contains(target, "/") {
+		return target, nil
+	}
+	return exec.LookPath(target)
 }
 
 func main() {
-	fmt.Println("Lesson 5: Userspace Probes (Uprobe)")
-	fmt.Println("====================================")
-	fmt.Println()
-	fmt.Println("This lesson demonstrates attaching eBPF programs to userspace function calls.")
-	fmt.Println("Using uprobes, we can intercept library function calls like readline().")
-	fmt.Println()
-	fmt.Println("Build: make build")
-	fmt.Println("Run:   make run")
-	fmt.Println()
-	fmt.Println("The eBPF program (uprobe_readline.c) attaches to the readline function")
-	fmt.Println("in the bash shell and captures keystrokes/input patterns.")
-	fmt.Println()
-	fmt.Println("TODO: Implement full example with uprobe attachment")
+	target := flag.String("target", "/bin/bash", "Binary or shared library to trace, by path or by name on $PATH")
+	symbol := flag.String("symbol", "readline", "Function that returns the line read")
+	pid := flag.Int("pid", 0, "Only trace this process")
+	flag.Parse()
+
+	path, err := resolveTarget(*target)
+	if err != nil {
+		log.Fatalf("Failed to find %s: %v", *target, err)
+	}
+
+	// Load eBPF program
+	spec, err := ebpf.LoadCollectionSpec("uprobe_readline.o")
+	if err != nil {
+		log.Fatalf("Failed to load eBPF spec: %v", err)
+	}
+
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		log.Fatalf("Failed to create eBPF collection: %v", err)
+	}
+	defer coll.Close()
+
+	prog := coll.Programs["trace_readline"]
+	if prog == nil {
+		log.Fatal("trace_readline program not found")
+	}
+
+	// Attach to the return of readline, when the line is known
+	ex, err := link.OpenExecutable(path)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", path, err)
+	}
+	up, err := ex.Uretprobe(*symbol, prog, &link.UprobeOptions{PID: *pid})
+	if errors.Is(err, link.ErrNoSymbol) {
+		log.Fatalf("%s has no %s symbol; if it links readline dynamically, use -target with the path of libreadline.so", path, *symbol)
+	}
+	if err != nil {
+		log.Fatalf("Failed to attach uretprobe: %v", err)
+	}
+	defer up.Close()
+
+	log.Printf("uretprobe attached to %s in %s. Monitoring commands...", *symbol, path)
+
+	// Read from ringbuf
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
+	if err != nil {
+		log.Fatalf("Failed to create ringbuf reader: %v", err)
+	}
+	defer rd.Close()
+
+	// Setup signal handling
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
+
+	fmt.Printf("%-9s %-7s %-6s %-16s %s\n", "TIME", "PID", "UID", "COMM", "COMMAND")
+
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var e event
+		if err := decoder.Decode(record.RawSample, &e); err != nil {
+			log.Printf("Failed to parse event: %v", err)
+			return nil
+		}
+
+		ts := time.Now().Format("15:04:05")
+		comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
+		line := string(bytes.TrimRight(e.Line[:], "\x00"))
+		fmt.Printf("%-9s %-7d %-6d %-16s %s\n", ts, e.Pid, e.Uid, comm, line)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
+
+	log.Println("Detaching...")
+	log.Printf("Read %s\n", rd.Stats())
 }
@@ -0,0 +1,35 @@
+// A stand-in for bash to test the tracer with: it prompts, reads lines with
+// its own readline() and echoes them.
+//
+//	cc -O0 -o fake-readline testdata/fake_readline.c
+//	sudo ./readline-trace -target ./fake-readline
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+// noinline keeps the symbol, and the call, that the uretprobe attaches to
+__attribute__((noinline)) char *readline(const char *prompt)
+{
+    char *line = NULL;
+    size_t size = 0;
+
+    fputs(prompt, stdout);
+    fflush(stdout);
+    if (getline(&line, &size, stdin) < 0) {
+        free(line);
+        return NULL;
+    }
+    line[strcspn(line, "\n")] = '\0';
+    return line;
+}
+
+int main(void)
+{
+    char *line;
+
+    while ((line = readline("fake$ ")) != NULL) {
+        printf("%s\n", line);
+        free(line);
+    }
+    return 0;
+}
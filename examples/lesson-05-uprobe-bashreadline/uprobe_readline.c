@@ -4,12 +4,14 @@
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
 
+#define MAX_LINE_SIZE 256
+
 struct event {
     u64 ts;
     u32 pid;
     u32 uid;
     char comm[16];
-    u64 input;
+    char line[MAX_LINE_SIZE];
 };
 
 struct {
@@ -17,10 +19,18 @@ struct {
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-SEC("uprobe")
-int trace_readline(struct pt_regs *ctx)
+// char *readline(const char *prompt) returns the line the user entered. The
+// argument is only the prompt, so the line is read on return, from the
+// return value register of the architecture set with __TARGET_ARCH_*.
+SEC("uretprobe")
+int BPF_KRETPROBE(trace_readline, const char *ret)
 {
     struct event *e;
+
+    // NULL on end of file, e.g. Ctrl-D
+    if (!ret)
+        return 0;
+
     e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
     if (!e)
         return 0;
@@ -29,13 +39,8 @@ int trace_readline(struct pt_regs *ctx)
     e->pid = bpf_get_current_pid_tgid() >> 32;
     e->uid = bpf_get_current_uid_gid() & 0xFFFFFFFF;
     bpf_get_current_comm(&e->comm, sizeof(e->comm));
-    
-    // Capture register state (architecture-dependent)
-    #ifdef __x86_64__
-    e->input = ctx->rdi;
-    #else
-    e->input = 0;
-    #endif
+    if (bpf_probe_read_user_str(&e->line, sizeof(e->line), ret) < 0)
+        e->line[0] = '\0';
 
     bpf_ringbuf_submit(e, 0);
     return 0;
@@ -2,86 +2,220 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"flag"
+	"fmt"
 	"log"
-	"os"
-	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"podresolver"
+	"podresolver/decode"
+	"podresolver/eventreader"
+
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/ringbuf"
+	"golang.org/x/sys/unix"
+)
+
+// Event kinds, as in enum event_kind of sigsnoop.c
+const (
+	eventGenerate = 0
+	eventDeliver  = 1
 )
 
+// SignalData matches struct signal_data in sigsnoop.c
 type SignalData struct {
 	Ts       uint64
 	SrcPID   uint32
 	DstPID   uint32
 	Sig      int32
+	SrcNsPID uint32
 	SrcComm  [16]byte
 	DstComm  [16]byte
+	Code     int32
+	Result   int32
+	Kind     uint32
+	DstNsPID uint32
+}
+
+// decoder decodes SignalData records without binary.Read
+var decoder = decode.MustDecoder[SignalData]()
+
+// results names the TRACE_SIGNAL_* results of signal_generate
+var results = map[int32]string{
+	0: "delivered",
+	1: "ignored",
+	2: "already_pending",
+	3: "overflow_fail",
+	4: "lose_info",
+}
+
+// codes names the si_code values that tell who raised a signal
+var codes = map[int32]string{
+	0:    "SI_USER",
+	0x80: "SI_KERNEL",
+	-1:   "SI_QUEUE",
+	-2:   "SI_TIMER",
+	-3:   "SI_MESGQ",
+	-4:   "SI_ASYNCIO",
+	-5:   "SI_SIGIO",
+	-6:   "SI_TKILL",
+}
+
+// signalName returns the name of a signal, e.g. SIGKILL or SIGRTMIN+3
+func signalName(sig int32) string {
+	if name := unix.SignalName(syscall.Signal(sig)); name != "" {
+		return name
+	}
+	// glibc reserves the first two real-time signals, so SIGRTMIN is 34
+	// for programs
+	if sig >= 34 && sig <= 64 {
+		return fmt.Sprintf("SIGRTMIN+%d", sig-34)
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// parseSignal parses a signal given by number or by name, with or without
+// the SIG prefix
+func parseSignal(s string) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", n)
+		}
+		return n, nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return int(sig), nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// lookupName returns the name of v in names, or v itself
+func lookupName(names map[int32]string, v int32) string {
+	if name, ok := names[v]; ok {
+		return name
+	}
+	return strconv.Itoa(int(v))
 }
 
 func main() {
+	cpid := flag.Int("cpid", 0, "Only show signals sent by or to processes with this PID inside their container")
+	pid := flag.Int("pid", 0, "Only show signals sent to this thread ID (the PID for single-threaded processes)")
+	sigFlag := flag.String("sig", "", "Only show this signal, by number or name (e.g. 9, KILL or SIGKILL)")
+	failed := flag.Bool("failed", false, "Only show signals that were not delivered")
+	deliver := flag.Bool("deliver", false, "Also show when signals are delivered to their target")
+	flag.Parse()
+
+	sig := 0
+	if *sigFlag != "" {
+		var err error
+		if sig, err = parseSignal(*sigFlag); err != nil {
+			log.Fatalf("Invalid -sig: %v", err)
+		}
+	}
+
 	// Load eBPF program
 	spec, err := ebpf.LoadCollectionSpec("sigsnoop.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF spec: %v", err)
 	}
 
+	consts := map[string]interface{}{
+		"targ_pid":    int32(*pid),
+		"targ_sig":    int32(sig),
+		"failed_only": *failed,
+	}
+	if err := spec.RewriteConstants(consts); err != nil {
+		log.Fatalf("Failed to set constants: %v", err)
+	}
+
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
 		log.Fatalf("Failed to create eBPF collection: %v", err)
 	}
 	defer coll.Close()
 
-	// Attach to tracepoint
-	prog := coll.Programs["trace_signal"]
-	if prog == nil {
-		log.Fatal("trace_signal program not found")
+	// Attach to tracepoints
+	tracepoints := map[string]string{"signal_generate": "trace_signal"}
+	if *deliver {
+		tracepoints["signal_deliver"] = "trace_deliver"
 	}
-
-	tp, err := link.Tracepoint("signal", "signal_generate", prog, nil)
-	if err != nil {
-		log.Fatalf("Failed to attach tracepoint: %v", err)
+	for event, name := range tracepoints {
+		prog := coll.Programs[name]
+		if prog == nil {
+			log.Fatalf("%s program not found", name)
+		}
+		tp, err := link.Tracepoint("signal", event, prog, nil)
+		if err != nil {
+			log.Fatalf("Failed to attach tracepoint %s: %v", event, err)
+		}
+		defer tp.Close()
 	}
-	defer tp.Close()
 
-	log.Println("sigsnoop attached. Monitoring signal generation...")
+	log.Println("sigsnoop attached. Monitoring signals...")
 
 	// Read from ringbuf
-	rd, err := ringbuf.NewReader(coll.Maps["events"])
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
 	if err != nil {
 		log.Fatalf("Failed to create ringbuf reader: %v", err)
 	}
 	defer rd.Close()
 
 	// Setup signal handling
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
 
-	log.Println("TIME\t\tSRC_PID\tDST_PID\tSIGNAL\tSRC_COMM")
-	log.Println("----\t\t-------\t-------\t------\t--------")
+	fmt.Printf("%-9s %-8s %-7s %-8s %-16s %-7s %-8s %-16s %-11s %-10s %s\n",
+		"TIME", "EVENT", "SRC_PID", "SRC_CPID", "SRC_COMM", "DST_PID", "DST_CPID", "DST_COMM", "SIGNAL", "CODE", "RESULT")
 
-	go func() {
-		for {
-			record, err := rd.Read()
-			if err != nil {
-				return
-			}
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var data SignalData
+		if err := decoder.Decode(record.RawSample, &data); err != nil {
+			log.Printf("Failed to parse event: %v", err)
+			return nil
+		}
 
-			var data SignalData
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &data); err != nil {
-				continue
+		// The sender isn't known when the signal is delivered
+		kind, srcPID, srcNsPID, srcComm := "deliver", "-", "-", "-"
+		dstNsPID := int(data.DstNsPID)
+		if data.Kind == eventGenerate {
+			kind = "generate"
+			srcPID = strconv.Itoa(int(data.SrcPID))
+			srcNsPID = strconv.Itoa(int(data.SrcNsPID))
+			srcComm = string(bytes.TrimRight(data.SrcComm[:], "\x00"))
+			// The target is usually still alive, so its PID inside its
+			// container can be read from /proc.
+			if n, err := podresolver.ContainerPID("/proc", int(data.DstPID)); err == nil {
+				dstNsPID = n
 			}
+		}
+		fromCPID := data.Kind == eventGenerate && int(data.SrcNsPID) == *cpid
+		if *cpid != 0 && !fromCPID && dstNsPID != *cpid {
+			return nil
+		}
 
-			t := time.Unix(0, int64(data.Ts)).Format("15:04:05")
-			comm := string(bytes.TrimRight(data.SrcComm[:], "\x00"))
-			log.Printf("%s\t%d\t%d\t%d\t%s\n", t, data.SrcPID, data.DstPID, data.Sig, comm)
+		dstNs := "-"
+		if dstNsPID != 0 {
+			dstNs = strconv.Itoa(dstNsPID)
 		}
-	}()
+		ts := time.Now().Format("15:04:05")
+		dstComm := string(bytes.TrimRight(data.DstComm[:], "\x00"))
+		fmt.Printf("%-9s %-8s %-7s %-8s %-16s %-7d %-8s %-16s %-11s %-10s %s\n",
+			ts, kind, srcPID, srcNsPID, srcComm, data.DstPID, dstNs, dstComm,
+			signalName(data.Sig), lookupName(codes, data.Code), lookupName(results, data.Result))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
 
-	<-sig
 	log.Println("\nDetaching...")
+	log.Printf("Read %s\n", rd.Stats())
 }
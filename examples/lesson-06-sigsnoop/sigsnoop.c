@@ -1,13 +1,36 @@
+//go:build ignore
+
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
+#include "nspid.h"
+
+// TRACE_SIGNAL_DELIVERED in include/trace/events/signal.h: the signal was
+// queued for the target. Other results mean it was dropped.
+#define TRACE_SIGNAL_DELIVERED 0
+
+enum event_kind {
+	// A process sent a signal, or the kernel raised one
+	EVENT_GENERATE = 0,
+	// A signal reached the target, which is about to handle it
+	EVENT_DELIVER = 1,
+};
 
 struct signal_data {
 	u64 ts;
 	u32 src_pid;
 	u32 dst_pid;
 	int sig;
+	u32 src_ns_pid;
 	char src_comm[16];
 	char dst_comm[16];
+	// si_code, e.g. SI_USER for kill() and SI_KERNEL for the OOM killer
+	int code;
+	// TRACE_SIGNAL_* result of signal_generate; 0 for signal_deliver
+	int result;
+	u32 kind;
+	// Set for signal_deliver, where the target is the current task. User
+	// space reads it from /proc for signal_generate.
+	u32 dst_ns_pid;
 };
 
 struct {
@@ -15,20 +38,78 @@ struct {
 	__uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
+// Filters, set by user space before loading. 0 and false match everything.
+const volatile pid_t targ_pid = 0;
+const volatile int targ_sig = 0;
+const volatile bool failed_only = false;
+
 SEC("tp/signal/signal_generate")
 int trace_signal(struct trace_event_raw_signal_generate *ctx) {
 	struct signal_data *data;
+	pid_t pid = ctx->pid;
+	int sig = ctx->sig;
+	int result = ctx->result;
+
+	if (targ_pid && pid != targ_pid)
+		return 0;
+	if (targ_sig && sig != targ_sig)
+		return 0;
+	if (failed_only && result == TRACE_SIGNAL_DELIVERED)
+		return 0;
 
 	data = bpf_ringbuf_reserve(&events, sizeof(*data), 0);
 	if (!data)
 		return 0;
 
 	data->ts = bpf_ktime_get_ns();
-	data->src_pid = ctx->pid >> 32;
-	data->dst_pid = ctx->sig;
-	data->sig = ctx->errno;
+	data->kind = EVENT_GENERATE;
+	data->sig = sig;
+	data->code = ctx->code;
+	data->result = result;
 
+	// The sender is the current task; the target comes with the tracepoint
+	data->src_pid = bpf_get_current_pid_tgid() >> 32;
+	data->src_ns_pid = task_ns_tgid((struct task_struct *)bpf_get_current_task());
 	bpf_get_current_comm(&data->src_comm, sizeof(data->src_comm));
+	data->dst_pid = pid;
+	data->dst_ns_pid = 0;
+	bpf_probe_read_kernel_str(&data->dst_comm, sizeof(data->dst_comm), ctx->comm);
+
+	bpf_ringbuf_submit(data, 0);
+	return 0;
+}
+
+// Only attached with -deliver. The sender is no longer known here.
+SEC("tp/signal/signal_deliver")
+int trace_deliver(struct trace_event_raw_signal_deliver *ctx) {
+	struct signal_data *data;
+	pid_t pid = (u32)bpf_get_current_pid_tgid();
+	int sig = ctx->sig;
+
+	// A delivered signal hasn't failed
+	if (failed_only)
+		return 0;
+	if (targ_pid && pid != targ_pid)
+		return 0;
+	if (targ_sig && sig != targ_sig)
+		return 0;
+
+	data = bpf_ringbuf_reserve(&events, sizeof(*data), 0);
+	if (!data)
+		return 0;
+
+	data->ts = bpf_ktime_get_ns();
+	data->kind = EVENT_DELIVER;
+	data->sig = sig;
+	data->code = ctx->code;
+	data->result = TRACE_SIGNAL_DELIVERED;
+
+	data->src_pid = 0;
+	data->src_ns_pid = 0;
+	__builtin_memset(&data->src_comm, 0, sizeof(data->src_comm));
+	data->dst_pid = pid;
+	data->dst_ns_pid = task_ns_tgid((struct task_struct *)bpf_get_current_task());
+	bpf_get_current_comm(&data->dst_comm, sizeof(data->dst_comm));
 
 	bpf_ringbuf_submit(data, 0);
 	return 0;
@@ -1,32 +1,185 @@
+//go:build ignore
+
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
+#include "cgroup_filter.h"
+#include "nspid.h"
+#include "proctree.h"
+
+#define ARGSIZE_MAX 256
+#define TOTAL_MAX_ARGS 60
+#define DEFAULT_MAXARGS 20
+#define DEFAULT_ARGSIZE 128
+#define FULL_MAX_ARGS_ARR (TOTAL_MAX_ARGS * ARGSIZE_MAX)
+#define LAST_ARG (FULL_MAX_ARGS_ARR - ARGSIZE_MAX)
 
 struct event {
 	u32 pid;
 	u32 ppid;
+	u32 ns_pid;
+	u32 ns_ppid;
+	// Time spent in execve(), in ns. Holds the start time until the syscall
+	// returns.
+	u64 duration_ns;
+	s32 retval;
+	// Number of arguments, including the filename. One more than were read
+	// when argv was cut at max_args.
+	u32 args_count;
+	u32 args_size;
 	char comm[16];
-	char filename[256];
+	// The filename followed by argv[1..], each NUL-terminated
+	char args[FULL_MAX_ARGS_ARR];
 };
 
+// Only the used part of args is sent to userspace
+#define BASE_EVENT_SIZE ((size_t)&((struct event *)0)->args)
+#define EVENT_SIZE(e) (BASE_EVENT_SIZE + (e)->args_size)
+
 struct {
 	__uint(type, BPF_MAP_TYPE_RINGBUF);
 	__uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-SEC("tp/sched/sched_process_exec")
-int trace_exec(struct trace_event_raw_sched_process_exec *ctx) {
+// Execs in flight, by TGID, from syscall entry to exit. A thread that execs
+// successfully takes over the TGID as its thread ID, so only the TGID is the
+// same at both ends. Failed execs racing in two threads of one process share
+// an entry, and the later one wins.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 10240);
+	__uint(map_flags, BPF_F_NO_PREALLOC);
+	__type(key, u32);
+	__type(value, struct event);
+} execs SEC(".maps");
+
+static const struct event empty_event = {};
+
+// Only trace the processes with this PID in their own PID namespace.
+const volatile u32 targ_ns_pid = 0;
+// How many arguments to read, at most TOTAL_MAX_ARGS
+const volatile int max_args = DEFAULT_MAXARGS;
+// How many bytes of each argument to read, at most ARGSIZE_MAX
+const volatile u32 arg_size = DEFAULT_ARGSIZE;
+// Drop execs that fail, unless userspace asked for them
+const volatile bool ignore_failed = true;
+
+static __always_inline int exec_enter(const char *filename, const char *const *argv)
+{
+	u64 id = bpf_get_current_pid_tgid();
+	u32 pid = id >> 32;
+	struct task_struct *task, *parent = NULL;
+	struct event *e;
+	const char *argp;
+	u32 size, ns_pid;
+	int ret, i;
+
+	if (!cgroup_allowed())
+		return 0;
+
+	task = (struct task_struct *)bpf_get_current_task();
+	ns_pid = task_ns_tgid(task);
+	if (targ_ns_pid && ns_pid != targ_ns_pid)
+		return 0;
+
+	// BPF_ANY, so an entry left behind by an exec whose exit was missed
+	// can't keep this one out
+	if (bpf_map_update_elem(&execs, &pid, &empty_event, BPF_ANY))
+		return 0;
+	e = bpf_map_lookup_elem(&execs, &pid);
+	if (!e)
+		return 0;
+
+	e->pid = pid;
+	bpf_probe_read_kernel(&parent, sizeof(parent), &task->real_parent);
+	e->ppid = parent ? task_ns_tgid_at(parent, 0) : 0;
+	e->ns_pid = ns_pid;
+	e->ns_ppid = task_ns_ppid(task);
+	e->duration_ns = bpf_ktime_get_ns();
+
+	size = arg_size < ARGSIZE_MAX ? arg_size : ARGSIZE_MAX;
+
+	ret = bpf_probe_read_user_str(e->args, size, filename);
+	if (ret < 0)
+		return 0;
+	e->args_size += ret;
+	e->args_count++;
+
+	#pragma unroll
+	for (i = 1; i < TOTAL_MAX_ARGS && i < max_args; i++) {
+		argp = NULL;
+		bpf_probe_read_user(&argp, sizeof(argp), &argv[i]);
+		if (!argp)
+			return 0;
+
+		if (e->args_size > LAST_ARG)
+			return 0;
+
+		ret = bpf_probe_read_user_str(&e->args[e->args_size], size, argp);
+		if (ret < 0)
+			return 0;
+
+		e->args_count++;
+		e->args_size += ret;
+	}
+
+	// Count one more if argv goes on, so userspace can mark it cut
+	argp = NULL;
+	bpf_probe_read_user(&argp, sizeof(argp), &argv[max_args]);
+	if (argp)
+		e->args_count++;
+
+	return 0;
+}
+
+static __always_inline int exec_exit(long ret)
+{
+	u32 pid = bpf_get_current_pid_tgid() >> 32;
 	struct event *e;
-	e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
+	size_t len;
+
+	e = bpf_map_lookup_elem(&execs, &pid);
 	if (!e)
 		return 0;
 
-	e->pid = ctx->pid;
-	e->ppid = ctx->ppid;
-	__builtin_memcpy(&e->comm, ctx->comm, sizeof(e->comm));
-	__builtin_memcpy(&e->filename, ctx->filename, sizeof(e->filename));
+	if (ignore_failed && ret < 0)
+		goto cleanup;
 
-	bpf_ringbuf_submit(e, 0);
+	e->retval = ret;
+	e->duration_ns = bpf_ktime_get_ns() - e->duration_ns;
+	// After a successful exec this is the new program's name
+	bpf_get_current_comm(&e->comm, sizeof(e->comm));
+
+	len = EVENT_SIZE(e);
+	if (len <= sizeof(*e))
+		bpf_ringbuf_output(&events, e, len, 0);
+
+cleanup:
+	bpf_map_delete_elem(&execs, &pid);
 	return 0;
 }
 
+SEC("tracepoint/syscalls/sys_enter_execve")
+int trace_enter_execve(struct trace_event_raw_sys_enter *ctx)
+{
+	return exec_enter((const char *)ctx->args[0], (const char *const *)ctx->args[1]);
+}
+
+SEC("tracepoint/syscalls/sys_enter_execveat")
+int trace_enter_execveat(struct trace_event_raw_sys_enter *ctx)
+{
+	return exec_enter((const char *)ctx->args[1], (const char *const *)ctx->args[2]);
+}
+
+SEC("tracepoint/syscalls/sys_exit_execve")
+int trace_exit_execve(struct trace_event_raw_sys_exit *ctx)
+{
+	return exec_exit(ctx->ret);
+}
+
+SEC("tracepoint/syscalls/sys_exit_execveat")
+int trace_exit_execveat(struct trace_event_raw_sys_exit *ctx)
+{
+	return exec_exit(ctx->ret);
+}
+
 char LICENSE[] SEC("license") = "Dual BSD/GPL";
@@ -2,83 +2,186 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"flag"
+	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
+	"strings"
+
+	"podresolver"
+	"podresolver/cgroupfilter"
+	"podresolver/decode"
+	"podresolver/eventreader"
+	"podresolver/proctree"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/ringbuf"
 )
 
+// Limits of the argument buffer in execsnoop.c
+const (
+	totalMaxArgs = 60
+	argSizeMax   = 256
+)
+
+// Event is the fixed part of struct event in execsnoop.c. The record
+// continues with ArgsSize bytes of NUL-terminated arguments.
 type Event struct {
-	PID      uint32
-	PPID     uint32
-	Comm     [16]byte
-	Filename [256]byte
+	PID        uint32
+	PPID       uint32
+	NsPID      uint32
+	NsPPID     uint32
+	DurationNs uint64
+	Retval     int32
+	ArgsCount  uint32
+	ArgsSize   uint32
+	Comm       [16]byte
+}
+
+// decoder decodes the fixed part of the records without binary.Read
+var decoder = decode.MustDecoder[Event]()
+
+// formatArgs joins the arguments of an event. An argument list cut at
+// max-args ends with "...".
+func formatArgs(e *Event, raw []byte) string {
+	if len(raw) > int(e.ArgsSize) {
+		raw = raw[:e.ArgsSize]
+	}
+	args := strings.Split(strings.TrimRight(string(raw), "\x00"), "\x00")
+	if int(e.ArgsCount) > len(args) {
+		args = append(args, "...")
+	}
+	return strings.Join(args, " ")
 }
 
 func main() {
+	namespace := flag.String("n", "", "Only trace pods in this namespace")
+	labels := flag.String("l", "", "Only trace pods matching this label selector, e.g. app=api")
+	cpid := flag.Uint("cpid", 0, "Only trace processes with this PID inside their container")
+	maxArgs := flag.Int("max-args", 20, fmt.Sprintf("Maximum number of arguments to capture, up to %d", totalMaxArgs))
+	argSize := flag.Int("arg-size", 128, fmt.Sprintf("Maximum length of each argument, up to %d", argSizeMax))
+	fails := flag.Bool("fails", false, "Include failed execs, like execsnoop -x")
+	tree := flag.Bool("tree", false, "Print the parent chain of each process")
+	flag.Parse()
+
+	if *maxArgs < 1 || *maxArgs > totalMaxArgs {
+		log.Fatalf("-max-args must be between 1 and %d", totalMaxArgs)
+	}
+	if *argSize < 1 || *argSize > argSizeMax {
+		log.Fatalf("-arg-size must be between 1 and %d", argSizeMax)
+	}
+
+	selector, err := podresolver.ParseSelector(*namespace, *labels)
+	if err != nil {
+		log.Fatalf("Invalid selector: %v", err)
+	}
+
+	// Stop on Ctrl-C or SIGTERM
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
+
 	// Load eBPF program
 	spec, err := ebpf.LoadCollectionSpec("execsnoop.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF spec: %v", err)
 	}
 
+	if !selector.Empty() {
+		if err := cgroupfilter.Enable(spec); err != nil {
+			log.Fatalf("Failed to enable pod filter: %v", err)
+		}
+	}
+
+	consts := map[string]interface{}{
+		"max_args":      int32(*maxArgs),
+		"arg_size":      uint32(*argSize),
+		"ignore_failed": !*fails,
+	}
+	if *cpid != 0 {
+		consts["targ_ns_pid"] = uint32(*cpid)
+	}
+	if err := spec.RewriteConstants(consts); err != nil {
+		log.Fatalf("Failed to set constants: %v", err)
+	}
+
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
 		log.Fatalf("Failed to create eBPF collection: %v", err)
 	}
 	defer coll.Close()
 
-	// Attach to tracepoint
-	prog := coll.Programs["trace_exec"]
-	if prog == nil {
-		log.Fatal("trace_exec program not found")
+	// Only trace the selected pods
+	if !selector.Empty() {
+		filter, err := cgroupfilter.Start(ctx, coll.Maps[cgroupfilter.MapName], selector)
+		if err != nil {
+			log.Fatalf("Failed to start pod filter: %v", err)
+		}
+		log.Printf("Tracing %d pods matching %s\n", len(filter.Pods()), selector)
 	}
 
-	tp, err := link.Tracepoint("sched", "sched_process_exec", prog, nil)
-	if err != nil {
-		log.Fatalf("Failed to attach tracepoint: %v", err)
+	// Track the process tree to show who spawned each process
+	var procs *proctree.Tracker
+	if *tree {
+		procs, err = proctree.Start(ctx, coll)
+		if err != nil {
+			log.Fatalf("Failed to start process tree: %v", err)
+		}
+		defer procs.Close()
+	}
+
+	// Attach to the execve and execveat syscalls, on entry for the arguments
+	// and on exit for the return value
+	for _, tp := range []struct {
+		prog, name string
+	}{
+		{"trace_enter_execve", "sys_enter_execve"},
+		{"trace_exit_execve", "sys_exit_execve"},
+		{"trace_enter_execveat", "sys_enter_execveat"},
+		{"trace_exit_execveat", "sys_exit_execveat"},
+	} {
+		prog := coll.Programs[tp.prog]
+		if prog == nil {
+			log.Fatalf("%s program not found", tp.prog)
+		}
+
+		l, err := link.Tracepoint("syscalls", tp.name, prog, nil)
+		if err != nil {
+			log.Fatalf("Failed to attach %s: %v", tp.name, err)
+		}
+		defer l.Close()
 	}
-	defer tp.Close()
 
 	log.Println("execsnoop attached. Monitoring process execution...")
 
 	// Read from ringbuf
-	rd, err := ringbuf.NewReader(coll.Maps["events"])
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
 	if err != nil {
 		log.Fatalf("Failed to create ringbuf reader: %v", err)
 	}
 	defer rd.Close()
 
-	// Setup signal handling
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-
-	log.Println("PID\tPPID\tCOMM\t\tFILENAME")
-	log.Println("---\t----\t----\t\t--------")
+	log.Println("PID\tPPID\tCPID\tCPPID\tRET\tTIME(ms)\tCOMM\t\tARGS")
+	log.Println("---\t----\t----\t-----\t---\t--------\t----\t\t----")
 
-	go func() {
-		for {
-			record, err := rd.Read()
-			if err != nil {
-				return
-			}
-
-			var e Event
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &e); err != nil {
-				continue
-			}
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var e Event
+		if err := decoder.Decode(record.RawSample, &e); err != nil {
+			return nil
+		}
 
-			comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
-			filename := string(bytes.TrimRight(e.Filename[:], "\x00"))
-			log.Printf("%d\t%d\t%-16s\t%s\n", e.PID, e.PPID, comm, filename)
+		comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
+		args := formatArgs(&e, record.RawSample[decoder.Size():])
+		log.Printf("%d\t%d\t%d\t%d\t%d\t%.3f\t\t%-16s\t%s\n", e.PID, e.PPID, e.NsPID, e.NsPPID,
+			e.Retval, float64(e.DurationNs)/1e6, comm, args)
+		if procs != nil {
+			log.Printf("\t%s\n", procs.Chain(int(e.PID)))
 		}
-	}()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
 
-	<-sig
 	log.Println("\nDetaching...")
+	log.Printf("Read %s\n", rd.Stats())
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Offsets of the fields of struct event in execsnoop.c. The arguments start
+// at BASE_EVENT_SIZE.
+const (
+	offPID        = 0
+	offPPID       = 4
+	offNsPID      = 8
+	offNsPPID     = 12
+	offDurationNs = 16
+	offRetval     = 24
+	offArgsCount  = 28
+	offArgsSize   = 32
+	offComm       = 36
+	baseEventSize = 52
+)
+
+func TestFormatArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		count uint32
+		args  string
+		want  string
+	}{
+		{"all args", 3, "/usr/bin/ls\x00-la\x00/tmp\x00", "/usr/bin/ls -la /tmp"},
+		{"cut at max-args", 4, "/usr/bin/ls\x00-la\x00/tmp\x00", "/usr/bin/ls -la /tmp ..."},
+		// Bytes past ArgsSize belong to no argument
+		{"trailing garbage", 2, "/bin/sh\x00-c\x00junk", "/bin/sh -c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := uint32(len(tt.args))
+			if i := bytes.LastIndexByte([]byte(tt.args), 0); i >= 0 {
+				size = uint32(i + 1)
+			}
+			e := Event{ArgsCount: tt.count, ArgsSize: size}
+			if got := formatArgs(&e, []byte(tt.args)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	if decoder.Size() != baseEventSize {
+		t.Fatalf("Event is %d bytes, BASE_EVENT_SIZE is %d", decoder.Size(), baseEventSize)
+	}
+
+	args := "/usr/bin/ls\x00-la\x00/tmp\x00"
+	raw := make([]byte, baseEventSize, baseEventSize+len(args))
+	binary.NativeEndian.PutUint32(raw[offPID:], 4242)
+	binary.NativeEndian.PutUint32(raw[offPPID:], 4200)
+	binary.NativeEndian.PutUint32(raw[offNsPID:], 7)
+	binary.NativeEndian.PutUint32(raw[offNsPPID:], 1)
+	binary.NativeEndian.PutUint64(raw[offDurationNs:], 350000)
+	binary.NativeEndian.PutUint32(raw[offRetval:], 0xfffffffe) // -ENOENT
+	binary.NativeEndian.PutUint32(raw[offArgsCount:], 3)
+	binary.NativeEndian.PutUint32(raw[offArgsSize:], uint32(len(args)))
+	copy(raw[offComm:], "ls")
+	raw = append(raw, args...)
+
+	var e Event
+	if err := decoder.Decode(raw, &e); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	want := Event{PID: 4242, PPID: 4200, NsPID: 7, NsPPID: 1, DurationNs: 350000, Retval: -2, ArgsCount: 3, ArgsSize: uint32(len(args))}
+	copy(want.Comm[:], "ls")
+	if e != want {
+		t.Errorf("got %+v, want %+v", e, want)
+	}
+	if got := formatArgs(&e, raw[decoder.Size():]); got != "/usr/bin/ls -la /tmp" {
+		t.Errorf("got args %q", got)
+	}
+}
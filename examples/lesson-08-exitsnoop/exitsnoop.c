@@ -6,11 +6,17 @@
 
 struct event {
     u64 ts;
+    // Time since the task started, in ns
+    u64 age_ns;
+    // TGID, and thread ID of the task exiting
     u32 pid;
+    u32 tid;
     u32 ppid;
     u32 uid;
+    // Wait status as waitpid() reports it: the exit code in bits 8-15, or
+    // the terminating signal in bits 0-6 and a core dump in bit 7
+    int exit_code;
     char comm[16];
-    int exitcode;
 };
 
 struct {
@@ -18,12 +24,23 @@ struct {
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-SEC("tracepoint/sched/sched_process_template")
+// Only report tasks that exited with a non-zero code or were killed by a
+// signal
+const volatile bool failed_only = false;
+
+SEC("tracepoint/sched/sched_process_exit")
 int trace_exit(struct trace_event_raw_sched_process_template *ctx)
 {
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    struct task_struct *parent = NULL;
+    u64 id = bpf_get_current_pid_tgid();
+    u64 start_time = 0;
+    int exit_code = 0;
     struct event *e;
-    
-    if (ctx->pid == 0)  // Skip kernel threads
+
+    // The tracepoint fires in the context of the task exiting
+    bpf_probe_read_kernel(&exit_code, sizeof(exit_code), &task->exit_code);
+    if (failed_only && exit_code == 0)
         return 0;
 
     e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
@@ -31,11 +48,18 @@ int trace_exit(struct trace_event_raw_sched_process_template *ctx)
         return 0;
 
     e->ts = bpf_ktime_get_ns();
-    e->pid = ctx->pid;
-    e->ppid = ctx->ppid;
+    // start_time is on the same monotonic clock as bpf_ktime_get_ns()
+    bpf_probe_read_kernel(&start_time, sizeof(start_time), &task->start_time);
+    e->age_ns = start_time ? e->ts - start_time : 0;
+    e->pid = id >> 32;
+    e->tid = (u32)id;
+    e->ppid = 0;
+    bpf_probe_read_kernel(&parent, sizeof(parent), &task->real_parent);
+    if (parent)
+        bpf_probe_read_kernel(&e->ppid, sizeof(e->ppid), &parent->tgid);
     e->uid = bpf_get_current_uid_gid() & 0xFFFFFFFF;
-    __builtin_memcpy(&e->comm, ctx->comm, sizeof(e->comm));
-    e->exitcode = 0;
+    e->exit_code = exit_code;
+    bpf_get_current_comm(&e->comm, sizeof(e->comm));
 
     bpf_ringbuf_submit(e, 0);
     return 0;
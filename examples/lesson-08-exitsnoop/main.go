@@ -2,69 +2,115 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
 	"syscall"
 	"time"
 
+	"podresolver/decode"
+	"podresolver/eventreader"
+
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
 )
 
 type event struct {
 	Ts       uint64
+	AgeNs    uint64
 	Pid      uint32
+	Tid      uint32
 	PPid     uint32
 	Uid      uint32
+	ExitCode int32
 	Comm     [16]byte
-	Exitcode int32
+}
+
+// decoder decodes event records without binary.Read
+var decoder = decode.MustDecoder[event]()
+
+// status formats a wait status the way a shell reports it
+func status(code int32) string {
+	ws := syscall.WaitStatus(code)
+	if ws.Signaled() {
+		s := "signal " + unix.SignalName(ws.Signal())
+		if ws.CoreDump() {
+			s += " (core dumped)"
+		}
+		return s
+	}
+	return fmt.Sprintf("code %d", ws.ExitStatus())
 }
 
 func main() {
-	spec, err := ebpf.NewCollectionSpec()
+	failed := flag.Bool("failed", false, "Only show tasks that exited with a non-zero code or were killed by a signal")
+	flag.Parse()
+
+	// Load eBPF program
+	spec, err := ebpf.LoadCollectionSpec("exitsnoop.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF spec: %v", err)
 	}
 
+	if err := spec.RewriteConstants(map[string]interface{}{"failed_only": *failed}); err != nil {
+		log.Fatalf("Failed to set constants: %v", err)
+	}
+
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
 		log.Fatalf("Failed to create eBPF collection: %v", err)
 	}
 	defer coll.Close()
 
-	rd, err := ringbuf.NewReader(coll.Maps["events"])
+	// Attach to tracepoint
+	prog := coll.Programs["trace_exit"]
+	if prog == nil {
+		log.Fatal("trace_exit program not found")
+	}
+
+	tp, err := link.Tracepoint("sched", "sched_process_exit", prog, nil)
+	if err != nil {
+		log.Fatalf("Failed to attach tracepoint: %v", err)
+	}
+	defer tp.Close()
+
+	log.Println("exitsnoop attached. Monitoring exits...")
+
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
 	if err != nil {
 		log.Fatalf("Failed to create ringbuf reader: %v", err)
 	}
 	defer rd.Close()
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
 
-	fmt.Printf("%-18s %-6s %-6s %-6s %-16s\n", "TIME", "PID", "PPID", "UID", "COMM")
+	fmt.Printf("%-15s %-7s %-7s %-7s %-6s %-16s %-7s %-10s %s\n", "TIME", "PID", "TID", "PPID", "UID", "COMM", "TYPE", "AGE(s)", "EXIT")
 
-	go func() {
-		for {
-			record, err := rd.Read()
-			if err != nil {
-				log.Fatalf("Failed to read ringbuf: %v", err)
-			}
-
-			var e event
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &e); err != nil {
-				log.Printf("Failed to parse event: %v", err)
-				continue
-			}
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var e event
+		if err := decoder.Decode(record.RawSample, &e); err != nil {
+			log.Printf("Failed to parse event: %v", err)
+			return nil
+		}
 
-			ts := time.Unix(0, int64(e.Ts)).Format("15:04:05.000000")
-			comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
-			fmt.Printf("%-18s %-6d %-6d %-6d %-16s\n", ts, e.Pid, e.PPid, e.Uid, comm)
+		// A thread other than the main one has a TID of its own
+		kind := "process"
+		if e.Tid != e.Pid {
+			kind = "thread"
 		}
-	}()
+		ts := time.Now().Format("15:04:05.000000")
+		comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
+		age := time.Duration(e.AgeNs).Seconds()
+		fmt.Printf("%-15s %-7d %-7d %-7d %-6d %-16s %-7s %-10.2f %s\n", ts, e.Pid, e.Tid, e.PPid, e.Uid, comm, kind, age, status(e.ExitCode))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
 
-	<-sig
 	fmt.Println("Exiting...")
+	fmt.Printf("Read %s\n", rd.Stats())
 }
@@ -2,16 +2,18 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 	"time"
 
+	"podresolver/decode"
+	"podresolver/eventreader"
+
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/link"
 )
 
 type event struct {
@@ -22,48 +24,127 @@ type event struct {
 	Comm  [16]byte
 }
 
+// decoder decodes event records without binary.Read
+var decoder = decode.MustDecoder[event]()
+
+// readHistogram sums the per-CPU buckets of the hist map
+func readHistogram(m *ebpf.Map) ([]uint64, error) {
+	counts := make([]uint64, m.MaxEntries())
+	for slot := range counts {
+		var perCPU []uint64
+		if err := m.Lookup(uint32(slot), &perCPU); err != nil {
+			return nil, fmt.Errorf("failed to read bucket %d: %w", slot, err)
+		}
+		for _, n := range perCPU {
+			counts[slot] += n
+		}
+	}
+	return counts, nil
+}
+
+// printHistogram prints log2 buckets of latency in us with a bar for each,
+// the way the BCC tools do
+func printHistogram(counts []uint64) {
+	const width = 40
+
+	last, max := -1, uint64(0)
+	for slot, n := range counts {
+		if n > 0 {
+			last = slot
+		}
+		if n > max {
+			max = n
+		}
+	}
+	if last < 0 {
+		fmt.Println("No latencies recorded")
+		return
+	}
+
+	fmt.Printf("%24s : %-10s %s\n", "usecs", "count", "distribution")
+	for slot := 0; slot <= last; slot++ {
+		low, high := uint64(1)<<slot, uint64(1)<<(slot+1)-1
+		if slot == 0 {
+			low = 0
+		}
+		stars := int(counts[slot] * width / max)
+		fmt.Printf("%10d -> %-10d : %-10d |%-*s|\n", low, high, counts[slot], width, strings.Repeat("*", stars))
+	}
+}
+
 func main() {
-	spec, err := ebpf.NewCollectionSpec()
+	minLatency := flag.Duration("min-latency", time.Millisecond, "Print each wait on the run queue at least this long")
+	flag.Parse()
+
+	// Load eBPF program
+	spec, err := ebpf.LoadCollectionSpec("runqlat.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF spec: %v", err)
 	}
 
+	if err := spec.RewriteConstants(map[string]interface{}{"min_latency_ns": uint64(*minLatency)}); err != nil {
+		log.Fatalf("Failed to set constants: %v", err)
+	}
+
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
 		log.Fatalf("Failed to create eBPF collection: %v", err)
 	}
 	defer coll.Close()
 
-	rd, err := ringbuf.NewReader(coll.Maps["events"])
+	// Attach to tracepoints
+	tracepoints := map[string]string{
+		"sched_wakeup":     "trace_wakeup",
+		"sched_wakeup_new": "trace_wakeup_new",
+		"sched_switch":     "trace_switch",
+	}
+	for event, name := range tracepoints {
+		prog := coll.Programs[name]
+		if prog == nil {
+			log.Fatalf("%s program not found", name)
+		}
+		tp, err := link.Tracepoint("sched", event, prog, nil)
+		if err != nil {
+			log.Fatalf("Failed to attach tracepoint %s: %v", event, err)
+		}
+		defer tp.Close()
+	}
+
+	log.Printf("runqlat attached. Printing run queue latencies of at least %v, Ctrl-C for the histogram...", *minLatency)
+
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
 	if err != nil {
 		log.Fatalf("Failed to create ringbuf reader: %v", err)
 	}
 	defer rd.Close()
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
 
-	fmt.Printf("%-18s %-6s %-6s %-8s %-16s\n", "TIME", "PID", "CPU", "LATENCY_US", "COMM")
+	fmt.Printf("%-15s %-7s %-4s %-10s %-16s\n", "TIME", "PID", "CPU", "LATENCY_US", "COMM")
 
-	go func() {
-		for {
-			record, err := rd.Read()
-			if err != nil {
-				log.Fatalf("Failed to read ringbuf: %v", err)
-			}
-
-			var e event
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &e); err != nil {
-				log.Printf("Failed to parse event: %v", err)
-				continue
-			}
-
-			ts := time.Unix(0, int64(e.Ts)).Format("15:04:05.000000")
-			comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
-			fmt.Printf("%-18s %-6d %-6d %-8d %-16s\n", ts, e.Pid, e.Cpu, e.Delta, comm)
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var e event
+		if err := decoder.Decode(record.RawSample, &e); err != nil {
+			log.Printf("Failed to parse event: %v", err)
+			return nil
 		}
-	}()
 
-	<-sig
+		ts := time.Now().Format("15:04:05.000000")
+		comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
+		fmt.Printf("%-15s %-7d %-4d %-10d %-16s\n", ts, e.Pid, e.Cpu, e.Delta, comm)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
+
 	fmt.Println("Exiting...")
+	fmt.Printf("Read %s\n\n", rd.Stats())
+
+	counts, err := readHistogram(coll.Maps["hist"])
+	if err != nil {
+		log.Fatalf("Failed to read histogram: %v", err)
+	}
+	printHistogram(counts)
 }
@@ -4,6 +4,13 @@
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
 
+#define TASK_RUNNING 0
+// What the sched_switch tracepoint reports as prev_state for a preempted
+// task since Linux 4.14: TASK_REPORT_IDLE << 1 in include/linux/sched.h
+#define TASK_REPORT_MAX 0x100
+// Log2 buckets of latency in us, up to about 2^26 us (67 s)
+#define MAX_SLOTS 27
+
 struct event {
     u64 ts;
     u32 pid;
@@ -17,6 +24,7 @@ struct {
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
+// When each runnable thread was enqueued, by thread ID
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __type(key, u32);
@@ -24,41 +32,97 @@ struct {
     __uint(max_entries, 10240);
 } start SEC(".maps");
 
-SEC("tp/sched/sched_wakeup")
-int trace_wakeup(struct trace_event_raw_sched_wakeup *ctx)
+// Histogram of all latencies, not just the ones over min_latency_ns.
+// Bucket i counts latencies of [2^i, 2^(i+1)) us.
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __type(key, u32);
+    __type(value, u64);
+    __uint(max_entries, MAX_SLOTS);
+} hist SEC(".maps");
+
+// Latencies below this are only counted in hist, not sent as events. Set
+// by user space before loading.
+const volatile u64 min_latency_ns = 1000000;
+
+// log2l returns floor(log2(v)) without a loop, for older verifiers
+static __always_inline u32 log2l(u64 v)
+{
+    u32 r = 0, shift;
+
+    shift = (v > 0xFFFFFFFF) << 5; v >>= shift; r |= shift;
+    shift = (v > 0xFFFF) << 4; v >>= shift; r |= shift;
+    shift = (v > 0xFF) << 3; v >>= shift; r |= shift;
+    shift = (v > 0xF) << 2; v >>= shift; r |= shift;
+    shift = (v > 0x3) << 1; v >>= shift; r |= shift;
+    r |= (v >> 1);
+    return r;
+}
+
+static __always_inline int trace_enqueue(u32 pid)
 {
-    u32 pid = ctx->pid;
-    u64 ts = bpf_ktime_get_ns();
-    bpf_map_update_elem(&start, &pid, &ts, 0);
+    u64 ts;
+
+    // PID 0 is the idle task of each CPU
+    if (!pid)
+        return 0;
+    ts = bpf_ktime_get_ns();
+    bpf_map_update_elem(&start, &pid, &ts, BPF_ANY);
     return 0;
 }
 
+SEC("tp/sched/sched_wakeup")
+int trace_wakeup(struct trace_event_raw_sched_wakeup_template *ctx)
+{
+    return trace_enqueue(ctx->pid);
+}
+
+SEC("tp/sched/sched_wakeup_new")
+int trace_wakeup_new(struct trace_event_raw_sched_wakeup_template *ctx)
+{
+    return trace_enqueue(ctx->pid);
+}
+
 SEC("tp/sched/sched_switch")
 int trace_switch(struct trace_event_raw_sched_switch *ctx)
 {
     struct event *e;
     u32 pid = ctx->next_pid;
-    u64 *tsp, delta;
+    u64 *tsp, *count, delta, now;
+    u32 slot;
+
+    // A preempted task goes straight back on the run queue, as does one
+    // that gave up the CPU while still runnable, e.g. with sched_yield()
+    if (ctx->prev_state == TASK_RUNNING || (ctx->prev_state & TASK_REPORT_MAX))
+        trace_enqueue(ctx->prev_pid);
 
     tsp = bpf_map_lookup_elem(&start, &pid);
     if (!tsp)
         return 0;
 
-    delta = bpf_ktime_get_ns() - *tsp;
+    now = bpf_ktime_get_ns();
+    delta = now - *tsp;
     bpf_map_delete_elem(&start, &pid);
 
-    if (delta < 1000000)  // Less than 1ms
+    slot = log2l(delta / 1000);
+    if (slot >= MAX_SLOTS)
+        slot = MAX_SLOTS - 1;
+    count = bpf_map_lookup_elem(&hist, &slot);
+    if (count)
+        (*count)++;
+
+    if (delta < min_latency_ns)
         return 0;
 
     e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
     if (!e)
         return 0;
 
-    e->ts = bpf_ktime_get_ns();
+    e->ts = now;
     e->pid = pid;
     e->cpu = bpf_get_smp_processor_id();
     e->delta = delta / 1000;  // Convert to us
-    bpf_probe_read_kernel_str(&e->comm, sizeof(e->comm), (void *)ctx + ctx->__data_loc_next_comm);
+    __builtin_memcpy(&e->comm, ctx->next_comm, sizeof(e->comm));
 
     bpf_ringbuf_submit(e, 0);
     return 0;
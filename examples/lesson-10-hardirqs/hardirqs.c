@@ -20,7 +20,7 @@ SEC("tracepoint/irq/irq_handler_entry")
 int trace_irq_entry(struct trace_event_raw_irq_handler_entry *ctx)
 {
     struct event *e;
-    
+
     e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
     if (!e)
         return 0;
@@ -28,7 +28,9 @@ int trace_irq_entry(struct trace_event_raw_irq_handler_entry *ctx)
     e->ts = bpf_ktime_get_ns();
     e->irq = ctx->irq;
     e->cpu = bpf_get_smp_processor_id();
-    bpf_probe_read_kernel_str(&e->name, sizeof(e->name), ctx->name);
+    // name is a __data_loc string: its offset in the record is in the low
+    // 16 bits
+    bpf_probe_read_kernel_str(&e->name, sizeof(e->name), (void *)ctx + (ctx->__data_loc_name & 0xFFFF));
 
     bpf_ringbuf_submit(e, 0);
     return 0;
@@ -2,16 +2,16 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
+	"podresolver/decode"
+	"podresolver/eventreader"
+
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/link"
 )
 
 type event struct {
@@ -21,8 +21,12 @@ type event struct {
 	Name [32]byte
 }
 
+// decoder decodes event records without binary.Read
+var decoder = decode.MustDecoder[event]()
+
 func main() {
-	spec, err := ebpf.NewCollectionSpec()
+	// Load eBPF program
+	spec, err := ebpf.LoadCollectionSpec("hardirqs.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF spec: %v", err)
 	}
@@ -33,36 +37,47 @@ func main() {
 	}
 	defer coll.Close()
 
-	rd, err := ringbuf.NewReader(coll.Maps["events"])
+	// Attach to tracepoint
+	prog := coll.Programs["trace_irq_entry"]
+	if prog == nil {
+		log.Fatal("trace_irq_entry program not found")
+	}
+
+	tp, err := link.Tracepoint("irq", "irq_handler_entry", prog, nil)
 	if err != nil {
-		log.Fatalf("Failed to create ringbuf reader: %v", err)
+		log.Fatalf("Failed to attach tracepoint: %v", err)
 	}
-	defer rd.Close()
+	defer tp.Close()
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("hardirqs attached. Monitoring hardware interrupts...")
 
-	fmt.Printf("%-18s %-6s %-6s %-32s\n", "TIME", "IRQ", "CPU", "NAME")
+	rd, err := eventreader.New(coll.Maps["events"], eventreader.Options{})
+	if err != nil {
+		log.Fatalf("Failed to create ringbuf reader: %v", err)
+	}
+	defer rd.Close()
 
-	go func() {
-		for {
-			record, err := rd.Read()
-			if err != nil {
-				log.Fatalf("Failed to read ringbuf: %v", err)
-			}
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
 
-			var e event
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &e); err != nil {
-				log.Printf("Failed to parse event: %v", err)
-				continue
-			}
+	fmt.Printf("%-15s %-6s %-6s %-32s\n", "TIME", "IRQ", "CPU", "NAME")
 
-			ts := time.Unix(0, int64(e.Ts)).Format("15:04:05.000000")
-			name := string(bytes.TrimRight(e.Name[:], "\x00"))
-			fmt.Printf("%-18s %-6d %-6d %-32s\n", ts, e.Irq, e.Cpu, name)
+	err = rd.Run(ctx, func(record eventreader.Record) error {
+		var e event
+		if err := decoder.Decode(record.RawSample, &e); err != nil {
+			log.Printf("Failed to parse event: %v", err)
+			return nil
 		}
-	}()
 
-	<-sig
+		ts := time.Now().Format("15:04:05.000000")
+		name := string(bytes.TrimRight(e.Name[:], "\x00"))
+		fmt.Printf("%-15s %-6d %-6d %-32s\n", ts, e.Irq, e.Cpu, name)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
+
 	fmt.Println("Exiting...")
+	fmt.Printf("Read %s\n", rd.Stats())
 }
@@ -0,0 +1,61 @@
+// Shared pod filter for the tracing programs. Userspace resolves a pod
+// selector to cgroup IDs (the inode numbers of the cgroup v2 directories) and
+// keeps them in cgroup_filter; programs call cgroup_allowed() or
+// task_cgroup_allowed() before doing any other work.
+//
+// Include after vmlinux.h and bpf_helpers.h.
+
+#pragma once
+
+#define CGROUP_FILTER_MAX_ENTRIES 10240
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, CGROUP_FILTER_MAX_ENTRIES);
+	__type(key, __u64);
+	__type(value, __u8);
+} cgroup_filter SEC(".maps");
+
+// Set to 1 by userspace before loading to enable the filter. While 0 every
+// task is traced and the map is never looked at.
+const volatile __u8 filter_cgroup = 0;
+
+// task_cgroup_id returns the ID of the cgroup v2 a task belongs to, which is
+// what bpf_get_current_cgroup_id() returns for the current task.
+static __always_inline __u64 task_cgroup_id(struct task_struct *task)
+{
+	struct css_set *cgroups = NULL;
+	struct cgroup *cgrp = NULL;
+	struct kernfs_node *kn = NULL;
+	__u64 id = 0;
+
+	bpf_probe_read_kernel(&cgroups, sizeof(cgroups), &task->cgroups);
+	bpf_probe_read_kernel(&cgrp, sizeof(cgrp), &cgroups->dfl_cgrp);
+	bpf_probe_read_kernel(&kn, sizeof(kn), &cgrp->kn);
+	bpf_probe_read_kernel(&id, sizeof(id), &kn->id);
+	return id;
+}
+
+static __always_inline int cgroup_id_allowed(__u64 id)
+{
+	if (!filter_cgroup)
+		return 1;
+	return bpf_map_lookup_elem(&cgroup_filter, &id) != NULL;
+}
+
+// cgroup_allowed reports whether the current task should be traced.
+static __always_inline int cgroup_allowed(void)
+{
+	if (!filter_cgroup)
+		return 1;
+	return cgroup_id_allowed(bpf_get_current_cgroup_id());
+}
+
+// task_cgroup_allowed reports whether task should be traced. Use it where the
+// task of interest isn't the current one, such as in sched_wakeup.
+static __always_inline int task_cgroup_allowed(struct task_struct *task)
+{
+	if (!filter_cgroup)
+		return 1;
+	return cgroup_id_allowed(task_cgroup_id(task));
+}
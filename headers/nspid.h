@@ -0,0 +1,68 @@
+// PID namespace translation for the tracing programs. The kernel hands out
+// host PIDs; these helpers return the PIDs a process sees from inside its
+// container, the same ones listed last in NSpid of /proc/<pid>/status.
+//
+// Include after vmlinux.h and bpf_helpers.h.
+
+#pragma once
+
+// pid_nr_at returns the number of pid in the PID namespace at level, or 0 if
+// pid isn't visible there.
+static __always_inline __u32 pid_nr_at(struct pid *pid, unsigned int level)
+{
+	unsigned int pid_level = 0;
+	struct upid upid = {};
+
+	if (!pid)
+		return 0;
+	bpf_probe_read_kernel(&pid_level, sizeof(pid_level), &pid->level);
+	if (level > pid_level)
+		return 0;
+	bpf_probe_read_kernel(&upid, sizeof(upid), &pid->numbers[level]);
+	return upid.nr;
+}
+
+// task_pid_level returns the depth of the task's own PID namespace; 0 is the
+// host.
+static __always_inline unsigned int task_pid_level(struct task_struct *task)
+{
+	struct pid *pid = NULL;
+	unsigned int level = 0;
+
+	bpf_probe_read_kernel(&pid, sizeof(pid), &task->thread_pid);
+	if (pid)
+		bpf_probe_read_kernel(&level, sizeof(level), &pid->level);
+	return level;
+}
+
+// task_ns_tgid_at returns the TGID of task in the PID namespace at level.
+static __always_inline __u32 task_ns_tgid_at(struct task_struct *task, unsigned int level)
+{
+	struct task_struct *leader = NULL;
+	struct pid *pid = NULL;
+
+	bpf_probe_read_kernel(&leader, sizeof(leader), &task->group_leader);
+	if (!leader)
+		return 0;
+	bpf_probe_read_kernel(&pid, sizeof(pid), &leader->thread_pid);
+	return pid_nr_at(pid, level);
+}
+
+// task_ns_tgid returns the TGID task sees for itself with getpid().
+static __always_inline __u32 task_ns_tgid(struct task_struct *task)
+{
+	return task_ns_tgid_at(task, task_pid_level(task));
+}
+
+// task_ns_ppid returns the parent TGID as task sees it with getppid(), which
+// is 0 when the parent is outside the task's PID namespace, as it is for a
+// container's init process.
+static __always_inline __u32 task_ns_ppid(struct task_struct *task)
+{
+	struct task_struct *parent = NULL;
+
+	bpf_probe_read_kernel(&parent, sizeof(parent), &task->real_parent);
+	if (!parent)
+		return 0;
+	return task_ns_tgid_at(parent, task_pid_level(task));
+}
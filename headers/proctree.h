@@ -0,0 +1,134 @@
+// Process lifecycle events for the shared process tree. Including this header
+// adds three raw tracepoint programs that report every fork, exec and exit
+// of a process (not of a thread) to the proctree_events ring buffer. The
+// proctree Go package attaches them, seeds the tree from /proc and keeps it
+// up to date, so a tool can print the parent chain of any PID it traces.
+//
+// Include after vmlinux.h and bpf_helpers.h.
+
+#pragma once
+
+#define PROCTREE_COMM_LEN 16
+#define PROCTREE_FILENAME_LEN 256
+
+enum proctree_event_type {
+	PROCTREE_FORK = 1,
+	PROCTREE_EXEC = 2,
+	PROCTREE_EXIT = 3,
+};
+
+struct proctree_event {
+	__u32 type;
+	__u32 pid;
+	// Parent TGID, only set for PROCTREE_FORK
+	__u32 ppid;
+	__u32 exit_code;
+	// Time since boot in ns, the clock of the start time in /proc/<pid>/stat
+	__u64 ts;
+	char comm[PROCTREE_COMM_LEN];
+	// Only set for PROCTREE_EXEC
+	char filename[PROCTREE_FILENAME_LEN];
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, 256 * 1024);
+} proctree_events SEC(".maps");
+
+// sched_process_fork(struct task_struct *parent, struct task_struct *child)
+SEC("raw_tp/sched_process_fork")
+int proctree_fork(struct bpf_raw_tracepoint_args *ctx)
+{
+	struct task_struct *child = (struct task_struct *)ctx->args[1];
+	struct task_struct *parent = NULL;
+	struct proctree_event *e;
+	__u32 pid = 0, tgid = 0, ppid = 0;
+
+	bpf_probe_read_kernel(&pid, sizeof(pid), &child->pid);
+	bpf_probe_read_kernel(&tgid, sizeof(tgid), &child->tgid);
+	// A new thread, not a new process
+	if (pid != tgid)
+		return 0;
+
+	bpf_probe_read_kernel(&parent, sizeof(parent), &child->real_parent);
+	if (parent)
+		bpf_probe_read_kernel(&ppid, sizeof(ppid), &parent->tgid);
+
+	e = bpf_ringbuf_reserve(&proctree_events, sizeof(*e), 0);
+	if (!e)
+		return 0;
+
+	e->type = PROCTREE_FORK;
+	e->pid = tgid;
+	e->ppid = ppid;
+	e->exit_code = 0;
+	e->ts = bpf_ktime_get_boot_ns();
+	bpf_probe_read_kernel_str(&e->comm, sizeof(e->comm), &child->comm);
+	e->filename[0] = '\0';
+
+	bpf_ringbuf_submit(e, 0);
+	return 0;
+}
+
+// sched_process_exec(struct task_struct *p, pid_t old_pid, struct linux_binprm *bprm)
+SEC("raw_tp/sched_process_exec")
+int proctree_exec(struct bpf_raw_tracepoint_args *ctx)
+{
+	struct linux_binprm *bprm = (struct linux_binprm *)ctx->args[2];
+	const char *filename = NULL;
+	struct proctree_event *e;
+
+	e = bpf_ringbuf_reserve(&proctree_events, sizeof(*e), 0);
+	if (!e)
+		return 0;
+
+	e->type = PROCTREE_EXEC;
+	e->pid = bpf_get_current_pid_tgid() >> 32;
+	e->ppid = 0;
+	e->exit_code = 0;
+	e->ts = bpf_ktime_get_boot_ns();
+	bpf_get_current_comm(&e->comm, sizeof(e->comm));
+	bpf_probe_read_kernel(&filename, sizeof(filename), &bprm->filename);
+	if (!filename || bpf_probe_read_kernel_str(&e->filename, sizeof(e->filename), filename) < 0)
+		e->filename[0] = '\0';
+
+	bpf_ringbuf_submit(e, 0);
+	return 0;
+}
+
+// sched_process_exit(struct task_struct *p)
+SEC("raw_tp/sched_process_exit")
+int proctree_exit(struct bpf_raw_tracepoint_args *ctx)
+{
+	struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+	__u64 id = bpf_get_current_pid_tgid();
+	struct signal_struct *signal = NULL;
+	struct proctree_event *e;
+	int exit_code = 0, live = 1;
+
+	// The process ends with its last thread, which need not be the thread
+	// group leader: the leader may call pthread_exit() and leave the others
+	// running. do_exit() has already counted this thread out of live.
+	bpf_probe_read_kernel(&signal, sizeof(signal), &task->signal);
+	if (signal)
+		bpf_probe_read_kernel(&live, sizeof(live), &signal->live.counter);
+	if (live)
+		return 0;
+
+	e = bpf_ringbuf_reserve(&proctree_events, sizeof(*e), 0);
+	if (!e)
+		return 0;
+
+	bpf_probe_read_kernel(&exit_code, sizeof(exit_code), &task->exit_code);
+
+	e->type = PROCTREE_EXIT;
+	e->pid = id >> 32;
+	e->ppid = 0;
+	e->exit_code = exit_code;
+	e->ts = bpf_ktime_get_boot_ns();
+	bpf_get_current_comm(&e->comm, sizeof(e->comm));
+	e->filename[0] = '\0';
+
+	bpf_ringbuf_submit(e, 0);
+	return 0;
+}
@@ -0,0 +1,7 @@
+module pid2pod
+
+go 1.22.2
+
+require podresolver v0.0.0
+
+replace podresolver => ../podresolver
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"podresolver"
+)
+
+func main() {
+	procRoot := flag.String("proc", "/proc", "Path to the host's proc filesystem")
+	noMeta := flag.Bool("no-metadata", false, "Don't look up pod and container names")
+	runtime := flag.String("runtime", "crictl", "Where to look up names: crictl, docker or podman")
+	socket := flag.String("socket", "", "Path to the docker or podman API socket")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] PID...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Metadata is optional; without it we still report the pod UID and container ID.
+	var meta podresolver.MetadataSource
+	if !*noMeta {
+		switch *runtime {
+		case "crictl":
+			if path, err := exec.LookPath("crictl"); err == nil {
+				meta = podresolver.Crictl{Path: path}
+			}
+		case "docker":
+			meta = podresolver.NewDocker(*socket)
+		case "podman":
+			meta = podresolver.NewPodman(*socket)
+		default:
+			fmt.Fprintf(os.Stderr, "unknown runtime %q\n", *runtime)
+			os.Exit(2)
+		}
+	}
+
+	failed := false
+	for _, arg := range flag.Args() {
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Printf("%s: invalid PID\n", arg)
+			failed = true
+			continue
+		}
+
+		info, err := podresolver.ResolvePIDIn(*procRoot, pid, meta)
+		if errors.Is(err, podresolver.ErrProcessNotFound) {
+			fmt.Printf("PID %d: exited\n", pid)
+			failed = true
+			continue
+		}
+		if err != nil {
+			fmt.Printf("PID %d: %v\n", pid, err)
+			failed = true
+			continue
+		}
+
+		printInfo(info)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printInfo(info *podresolver.ProcessInfo) {
+	m := info.Metadata
+	switch info.Kind {
+	case podresolver.KindPod:
+		if m.PodName != "" {
+			fmt.Printf("PID %d: pod %s/%s (UID: %s) container %s (%s) image %s\n",
+				info.PID, m.PodNamespace, m.PodName, info.PodUID, m.ContainerName, podresolver.ShortID(info.ContainerID), m.Image)
+		} else {
+			fmt.Printf("PID %d: pod UID %s container %s\n", info.PID, info.PodUID, podresolver.ShortID(info.ContainerID))
+		}
+	case podresolver.KindContainer:
+		switch {
+		case m.PodName != "":
+			fmt.Printf("PID %d: %s pod %s container %s (%s) image %s\n",
+				info.PID, info.Runtime, m.PodName, m.ContainerName, podresolver.ShortID(info.ContainerID), m.Image)
+		case m.ContainerName != "":
+			fmt.Printf("PID %d: %s container %s (%s) image %s\n",
+				info.PID, info.Runtime, m.ContainerName, podresolver.ShortID(info.ContainerID), m.Image)
+		default:
+			fmt.Printf("PID %d: %s container %s\n", info.PID, info.Runtime, podresolver.ShortID(info.ContainerID))
+		}
+	case podresolver.KindService:
+		fmt.Printf("PID %d: host service %s\n", info.PID, info.Unit)
+	default:
+		fmt.Printf("PID %d: host process (cgroup %s)\n", info.PID, info.Cgroup)
+	}
+}
@@ -5,75 +5,185 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"containerd-pod-pid/podwatch"
+	"podresolver"
+	"podresolver/report"
 
 	"github.com/containerd/containerd"
-	"github.com/containerd/containerd/namespaces"
 )
 
-// GetAllPodsPIDs retrieves all pod PIDs from containerd
-func GetAllPodsPIDs(socketPath string) (map[string][]int, error) {
-	// Connect to containerd
-	client, err := containerd.New(socketPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to containerd: %w", err)
+// newBackend connects to a container runtime. close releases the connection.
+func newBackend(runtime, socketPath, namespace string) (backend podwatch.Backend, close func() error, err error) {
+	switch runtime {
+	case "containerd":
+		if socketPath == "" {
+			socketPath = "/run/containerd/containerd.sock"
+		}
+		client, err := containerd.New(socketPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to containerd: %w", err)
+		}
+		return podwatch.NewContainerd(client, namespace), client.Close, nil
+	case "docker":
+		return podwatch.NewEngine(podresolver.NewDocker(socketPath)), func() error { return nil }, nil
+	case "podman":
+		return podwatch.NewEngine(podresolver.NewPodman(socketPath)), func() error { return nil }, nil
 	}
-	defer client.Close()
-
-	ctx := namespaces.WithNamespace(context.Background(), "k8s.io")
+	return nil, nil, fmt.Errorf("unknown runtime %q", runtime)
+}
 
-	// List all containers in containerd
-	containers, err := client.Containers(ctx)
+// GetAllPodsPIDs retrieves all pod PIDs from a container runtime
+func GetAllPodsPIDs(backend podwatch.Backend, runtime string) (map[string]*report.Pod, error) {
+	// List all containers with every process in their tasks
+	containers, err := backend.List(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("failed to list containers: %w", err)
+		return nil, err
 	}
 
-	// Map to store Pod UID → PIDs
-	podPIDs := make(map[string][]int)
+	return groupByPod(containers, runtime), nil
+}
 
-	for _, container := range containers {
-		// Get container metadata
-		info, err := container.Info(ctx)
-		if err != nil {
-			log.Printf("Skipping container %s: %v\n", container.ID(), err)
+// groupByPod turns a list of containers into Pod UID → pod and its containers.
+// Containers outside any pod are keyed by container ID instead. A container
+// whose processes couldn't be read marks its pod with an error.
+func groupByPod(containers []podwatch.Container, runtime string) map[string]*report.Pod {
+	pods := make(map[string]*report.Pod)
+
+	for _, c := range containers {
+		// Containers without a task have no processes to report
+		if len(c.PIDs) == 0 && c.Error == "" {
 			continue
 		}
 
-		// Extract Pod UID
-		podUID, hasUID := info.Labels["io.kubernetes.pod.uid"]
-		if !hasUID {
-			continue // Skip if not a Kubernetes pod
+		// A container outside any pod on a Docker or Podman host is
+		// reported on its own, named after the container
+		key, name := c.Pod.UID, c.Pod.Name
+		if key == "" {
+			key, name = c.ID, c.Name
+			if name == "" {
+				name = podresolver.ShortID(c.ID)
+			}
 		}
 
-		// Get container's main process PID
-		task, err := container.Task(ctx, nil)
-		if err != nil {
-			log.Printf("Skipping container %s: %v\n", container.ID(), err)
-			continue
+		pod, ok := pods[key]
+		if !ok {
+			pod = &report.Pod{
+				UID:       c.Pod.UID,
+				Namespace: c.Pod.Namespace,
+				Name:      name,
+			}
+			pods[key] = pod
+		}
+
+		pod.Containers = append(pod.Containers, report.Container{
+			ID:      c.ID,
+			Name:    c.Name,
+			Image:   c.Image,
+			Runtime: runtime,
+			PIDs:    c.PIDs,
+		})
+		if c.Error != "" {
+			// Keep the errors of the other containers of the pod
+			if pod.Error != "" {
+				pod.Error += "; "
+			}
+			pod.Error += fmt.Sprintf("container %s: %s", podresolver.ShortID(c.ID), c.Error)
 		}
+	}
 
-		// Store PIDs for each Pod UID
-		podPIDs[podUID] = append(podPIDs[podUID], int(task.Pid()))
+	for _, pod := range pods {
+		sort.Slice(pod.Containers, func(i, j int) bool {
+			return pod.Containers[i].Name < pod.Containers[j].Name
+		})
 	}
 
-	if len(podPIDs) == 0 {
-		return nil, fmt.Errorf("no running pods found")
+	return pods
+}
+
+// watchPods streams runtime events and prints each PID as it joins or leaves a pod
+func watchPods(backend podwatch.Backend) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tracker := podwatch.NewTracker(backend)
+	tracker.Notify = func(u podwatch.Update) {
+		action := "removed"
+		if u.Added {
+			action = "added"
+		}
+		if u.Pod.UID == "" {
+			// A container outside any pod on a Docker or Podman host
+			fmt.Printf("container %s: PID %d %s\n", podresolver.ShortID(u.ContainerID), u.PID, action)
+			return
+		}
+		fmt.Printf("%s/%s (%s): PID %d %s\n", u.Pod.Namespace, u.Pod.Name, u.Pod.UID, u.PID, action)
 	}
 
-	return podPIDs, nil
+	return tracker.Run(ctx)
+}
+
+// sortedPods returns the pods ordered by namespace and name
+func sortedPods(pods map[string]*report.Pod) []report.Pod {
+	sorted := make([]report.Pod, 0, len(pods))
+	for _, pod := range pods {
+		sorted = append(sorted, *pod)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Namespace != sorted[j].Namespace {
+			return sorted[i].Namespace < sorted[j].Namespace
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
 }
 
 func main() {
-	// Define CLI argument for containerd socket path
-	socketPath := flag.String("socket", "/run/containerd/containerd.sock", "Path to containerd socket")
+	// Define CLI arguments for the runtime and its socket path
+	runtime := flag.String("runtime", "containerd", "Container runtime: containerd, docker or podman")
+	socketPath := flag.String("socket", "", "Path to the runtime socket (default: the runtime's standard socket)")
+	namespace := flag.String("namespace", "k8s.io", "containerd namespace to list containers from")
+	output := flag.String("o", "table", "Output format: "+strings.Join(report.Formats, ", "))
+	watch := flag.Bool("watch", false, "Keep running and print PIDs as the runtime reports them")
 	flag.Parse()
 
-	podPIDs, err := GetAllPodsPIDs(*socketPath)
+	if !report.ValidFormat(*output) {
+		log.Printf("Unknown output format %q", *output)
+		os.Exit(report.ExitUsage)
+	}
+
+	backend, closeBackend, err := newBackend(*runtime, *socketPath, *namespace)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		os.Exit(report.ExitFailure)
+	}
+	defer closeBackend()
+
+	if *watch {
+		if err := watchPods(backend); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	pods, err := GetAllPodsPIDs(backend, *runtime)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 
-	fmt.Println("Pod UID -> PIDs:")
-	for uid, pids := range podPIDs {
-		fmt.Printf("%s -> %v\n", uid, pids)
+	// An empty list is a valid answer, not an error, so scripts can tell
+	// "no pods" from "runtime unreachable".
+	result := sortedPods(pods)
+	if err := report.Write(os.Stdout, *output, result); err != nil {
+		log.Fatalf("Error: %v", err)
 	}
+
+	// os.Exit skips deferred calls
+	closeBackend()
+	os.Exit(report.ExitCode(result))
 }
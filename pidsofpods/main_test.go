@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"containerd-pod-pid/podwatch"
+	"podresolver/report"
+)
+
+func TestGroupByPod(t *testing.T) {
+	web := podwatch.Pod{UID: "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81", Namespace: "default", Name: "web-7d4b9c-x2x9q"}
+
+	tests := []struct {
+		name       string
+		containers []podwatch.Container
+		want       map[string]*report.Pod
+	}{
+		{
+			name: "pod containers",
+			containers: []podwatch.Container{
+				{ID: "c2", Name: "sidecar", Image: "envoy", Pod: web, PIDs: []int{20}},
+				{ID: "c1", Name: "app", Image: "nginx", Pod: web, PIDs: []int{10, 11}},
+				// Not running
+				{ID: "c3", Name: "init", Image: "busybox", Pod: web},
+			},
+			want: map[string]*report.Pod{
+				web.UID: {
+					UID:       web.UID,
+					Namespace: web.Namespace,
+					Name:      web.Name,
+					Containers: []report.Container{
+						{ID: "c1", Name: "app", Image: "nginx", Runtime: "docker", PIDs: []int{10, 11}},
+						{ID: "c2", Name: "sidecar", Image: "envoy", Runtime: "docker", PIDs: []int{20}},
+					},
+				},
+			},
+		},
+		{
+			name: "containers outside pods",
+			containers: []podwatch.Container{
+				{ID: "4a3b2c1d0e9f8a7b", Name: "cache", Image: "redis", PIDs: []int{30}},
+				{ID: "9e8d7c6b5a4f3e2d", Image: "postgres", PIDs: []int{40, 41}},
+				{ID: "c1", Name: "app", Image: "nginx", Pod: web, PIDs: []int{10}},
+			},
+			want: map[string]*report.Pod{
+				"4a3b2c1d0e9f8a7b": {
+					Name:       "cache",
+					Containers: []report.Container{{ID: "4a3b2c1d0e9f8a7b", Name: "cache", Image: "redis", Runtime: "docker", PIDs: []int{30}}},
+				},
+				"9e8d7c6b5a4f3e2d": {
+					Name:       "9e8d7c6b5a4f3",
+					Containers: []report.Container{{ID: "9e8d7c6b5a4f3e2d", Image: "postgres", Runtime: "docker", PIDs: []int{40, 41}}},
+				},
+				web.UID: {
+					UID:        web.UID,
+					Namespace:  web.Namespace,
+					Name:       web.Name,
+					Containers: []report.Container{{ID: "c1", Name: "app", Image: "nginx", Runtime: "docker", PIDs: []int{10}}},
+				},
+			},
+		},
+		{
+			name: "failed containers",
+			containers: []podwatch.Container{
+				{ID: "4a3b2c1d0e9f8a7b6c5d", Name: "app", Pod: web, PIDs: []int{10}, Error: "no such process"},
+				{ID: "9e8d7c6b5a4f3e2d1c0b", Name: "sidecar", Pod: web, Error: "permission denied"},
+			},
+			want: map[string]*report.Pod{
+				web.UID: {
+					UID:       web.UID,
+					Namespace: web.Namespace,
+					Name:      web.Name,
+					Containers: []report.Container{
+						{ID: "4a3b2c1d0e9f8a7b6c5d", Name: "app", Runtime: "docker", PIDs: []int{10}},
+						{ID: "9e8d7c6b5a4f3e2d1c0b", Name: "sidecar", Runtime: "docker"},
+					},
+					Error: "container 4a3b2c1d0e9f8: no such process; container 9e8d7c6b5a4f3: permission denied",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := groupByPod(tt.containers, "docker")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groupByPod:")
+				for key, pod := range got {
+					t.Errorf("got  %s: %+v", key, *pod)
+				}
+				for key, pod := range tt.want {
+					t.Errorf("want %s: %+v", key, *pod)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package podwatch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl/v2"
+)
+
+// Containerd is a Backend for containerd's CRI plugin.
+type Containerd struct {
+	client    *containerd.Client
+	namespace string
+}
+
+// NewContainerd returns a Backend using client. namespace is the
+// containerd namespace the CRI plugin uses, normally "k8s.io".
+func NewContainerd(client *containerd.Client, namespace string) *Containerd {
+	return &Containerd{client: client, namespace: namespace}
+}
+
+// List implements Backend.
+func (c *Containerd) List(ctx context.Context) ([]Container, error) {
+	ctx = namespaces.WithNamespace(ctx, c.namespace)
+
+	list, err := c.client.Containers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var result []Container
+	for _, container := range list {
+		info, err := container.Info(ctx)
+		if err != nil {
+			log.Printf("Skipping container %s: %v\n", container.ID(), err)
+			continue
+		}
+
+		ctr, ok := containerFromInfo(info)
+		if !ok {
+			continue // Skip if not a Kubernetes pod
+		}
+
+		task, err := container.Task(ctx, nil)
+		if err != nil {
+			if !errdefs.IsNotFound(err) {
+				log.Printf("Skipping container %s: %v\n", container.ID(), err)
+				ctr.Error = err.Error()
+			}
+			result = append(result, ctr)
+			continue
+		}
+
+		processes, err := task.Pids(ctx)
+		if err != nil {
+			log.Printf("Skipping processes of container %s: %v\n", container.ID(), err)
+			ctr.Error = err.Error()
+		}
+		for _, p := range processes {
+			ctr.PIDs = append(ctr.PIDs, int(p.Pid))
+		}
+		sort.Ints(ctr.PIDs)
+
+		result = append(result, ctr)
+	}
+
+	return result, nil
+}
+
+// Container implements Backend.
+func (c *Containerd) Container(ctx context.Context, id string) (Container, bool, error) {
+	ctx = namespaces.WithNamespace(ctx, c.namespace)
+
+	container, err := c.client.LoadContainer(ctx, id)
+	if err != nil {
+		return Container{}, false, fmt.Errorf("failed to load container %s: %w", id, err)
+	}
+	info, err := container.Info(ctx)
+	if err != nil {
+		return Container{}, false, fmt.Errorf("failed to get info of container %s: %w", id, err)
+	}
+
+	ctr, ok := containerFromInfo(info)
+	return ctr, ok, nil
+}
+
+// Subscribe implements Backend.
+func (c *Containerd) Subscribe(ctx context.Context) (<-chan Event, <-chan error) {
+	envelopes, errs := c.client.Subscribe(ctx,
+		fmt.Sprintf(`namespace==%q,topic~="^/tasks/"`, c.namespace),
+		fmt.Sprintf(`namespace==%q,topic~="^/containers/"`, c.namespace),
+	)
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for envelope := range envelopes {
+			decoded, err := typeurl.UnmarshalAny(envelope.Event)
+			if err != nil {
+				log.Printf("Skipping event %s: %v\n", envelope.Topic, err)
+				continue
+			}
+
+			e, ok := convertEvent(decoded)
+			if !ok {
+				continue
+			}
+
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, errs
+}
+
+func convertEvent(v interface{}) (Event, bool) {
+	switch e := v.(type) {
+	case *apievents.ContainerCreate:
+		return Event{Kind: ContainerCreate, ContainerID: e.ID}, true
+	case *apievents.ContainerDelete:
+		return Event{Kind: ContainerDelete, ContainerID: e.ID}, true
+	case *apievents.TaskStart:
+		return Event{Kind: TaskStart, ContainerID: e.ContainerID, PID: int(e.Pid)}, true
+	case *apievents.TaskExecStarted:
+		return Event{Kind: TaskExecStart, ContainerID: e.ContainerID, ExecID: e.ExecID, PID: int(e.Pid)}, true
+	case *apievents.TaskExit:
+		return Event{Kind: TaskExit, ContainerID: e.ContainerID, ExecID: e.ID, PID: int(e.Pid)}, true
+	case *apievents.TaskDelete:
+		return Event{Kind: TaskDelete, ContainerID: e.ContainerID, ExecID: e.ID, PID: int(e.Pid)}, true
+	}
+	return Event{}, false
+}
+
+// containerFromInfo reads the pod a container belongs to from the labels
+// the CRI plugin sets.
+func containerFromInfo(info containers.Container) (Container, bool) {
+	uid, ok := info.Labels["io.kubernetes.pod.uid"]
+	if !ok {
+		return Container{}, false
+	}
+
+	name := info.Labels["io.kubernetes.container.name"]
+	if name == "" && info.Labels["io.cri-containerd.kind"] == "sandbox" {
+		name = "POD"
+	}
+
+	return Container{
+		ID:    info.ID,
+		Name:  name,
+		Image: info.Image,
+		Pod: Pod{
+			UID:       uid,
+			Namespace: info.Labels["io.kubernetes.pod.namespace"],
+			Name:      info.Labels["io.kubernetes.pod.name"],
+		},
+	}, true
+}
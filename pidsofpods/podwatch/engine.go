@@ -0,0 +1,114 @@
+package podwatch
+
+import (
+	"context"
+	"log"
+
+	"podresolver"
+)
+
+// Engine is a Backend for Docker and Podman hosts. Containers outside a
+// Kubernetes or Podman pod are reported with an empty Pod.
+type Engine struct {
+	// ProcRoot and CgroupRoot are where the processes of a container are
+	// looked up. They default to /proc and the cgroup mount point.
+	ProcRoot   string
+	CgroupRoot string
+
+	engine podresolver.Engine
+}
+
+// NewEngine returns a Backend using engine.
+func NewEngine(engine podresolver.Engine) *Engine {
+	root, err := podresolver.GetRootCgroupPath()
+	if err != nil {
+		root = "/sys/fs/cgroup"
+	}
+	return &Engine{ProcRoot: "/proc", CgroupRoot: root, engine: engine}
+}
+
+// List implements Backend.
+func (e *Engine) List(ctx context.Context) ([]Container, error) {
+	list, err := e.engine.ListContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Container
+	for _, ec := range list {
+		c := containerFromEngine(ec)
+		if ec.PID != 0 {
+			// Every process of the container is in the init process's cgroup.
+			cgroup, err := podresolver.ContainerOfPID(e.ProcRoot, e.CgroupRoot, ec.PID)
+			if err != nil {
+				log.Printf("Skipping processes of container %s: %v\n", ec.ID, err)
+				c.Error = err.Error()
+			}
+			c.PIDs = cgroup.PIDs
+		}
+		result = append(result, c)
+	}
+
+	return result, nil
+}
+
+// Container implements Backend.
+func (e *Engine) Container(ctx context.Context, id string) (Container, bool, error) {
+	ec, err := e.engine.InspectContainer(ctx, id)
+	if err != nil {
+		return Container{}, false, err
+	}
+	return containerFromEngine(ec), true, nil
+}
+
+// Subscribe implements Backend. Engines don't report the PID of a started
+// container, so it is looked up when the start event arrives.
+func (e *Engine) Subscribe(ctx context.Context) (<-chan Event, <-chan error) {
+	engineEvents, errs := e.engine.Events(ctx)
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for ee := range engineEvents {
+			var ev Event
+			switch ee.Type {
+			case podresolver.ContainerCreated:
+				ev = Event{Kind: ContainerCreate, ContainerID: ee.ContainerID}
+			case podresolver.ContainerStarted:
+				ec, err := e.engine.InspectContainer(ctx, ee.ContainerID)
+				if err != nil || ec.PID == 0 {
+					continue
+				}
+				ev = Event{Kind: TaskStart, ContainerID: ee.ContainerID, PID: ec.PID}
+			case podresolver.ContainerDied:
+				ev = Event{Kind: TaskExit, ContainerID: ee.ContainerID}
+			case podresolver.ContainerRemoved:
+				ev = Event{Kind: ContainerDelete, ContainerID: ee.ContainerID}
+			default:
+				continue
+			}
+
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, errs
+}
+
+func containerFromEngine(ec podresolver.EngineContainer) Container {
+	m := ec.Metadata()
+	return Container{
+		ID:    ec.ID,
+		Name:  m.ContainerName,
+		Image: ec.Image,
+		Pod: Pod{
+			UID:       m.PodUID,
+			Namespace: m.PodNamespace,
+			Name:      m.PodName,
+		},
+	}
+}
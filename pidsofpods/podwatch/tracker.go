@@ -0,0 +1,372 @@
+// Package podwatch keeps a pod UID → PID mapping up to date from container
+// runtime events, so long-running collectors can label BPF events with the
+// pod that produced them without polling the runtime.
+package podwatch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"podresolver"
+)
+
+// Pod identifies a Kubernetes pod.
+type Pod struct {
+	UID       string `json:"uid"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Container is a pod container and the processes known to run in it.
+type Container struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	Pod   Pod    `json:"pod"`
+	PIDs  []int  `json:"pids"`
+	// Error is set by List when the processes of the container couldn't be
+	// read, so PIDs may be incomplete.
+	Error string `json:"error,omitempty"`
+}
+
+// EventKind is the kind of runtime event a Backend delivers.
+type EventKind int
+
+const (
+	ContainerCreate EventKind = iota
+	ContainerDelete
+	TaskStart
+	TaskExecStart
+	TaskExit
+	TaskDelete
+)
+
+// Event is a runtime event reduced to what the Tracker needs. ExecID is
+// empty for the init process of a task.
+type Event struct {
+	Kind        EventKind
+	ContainerID string
+	ExecID      string
+	PID         int
+}
+
+// Backend is a container runtime that can list containers and stream events.
+type Backend interface {
+	// List returns the Kubernetes containers that exist now with their PIDs.
+	List(ctx context.Context) ([]Container, error)
+	// Container returns a single container. ok is false for containers that
+	// don't belong to a pod.
+	Container(ctx context.Context, id string) (c Container, ok bool, err error)
+	// Subscribe streams runtime events until ctx is done.
+	Subscribe(ctx context.Context) (<-chan Event, <-chan error)
+}
+
+// Update is a change to the mapping, passed to Tracker.Notify.
+type Update struct {
+	Added       bool
+	Pod         Pod
+	ContainerID string
+	PID         int
+}
+
+// Tracker maintains the pod UID → PID mapping from a Backend.
+type Tracker struct {
+	// Notify, if set, is called for every PID added to or removed from the
+	// mapping. It is called from Run and must not block.
+	Notify func(Update)
+	// ProcRoot is where PIDs unknown to the runtime, such as processes
+	// forked inside a container, are looked up. Defaults to /proc.
+	ProcRoot string
+
+	backend Backend
+	synced  chan struct{}
+
+	mu         sync.RWMutex
+	containers map[string]*Container
+	pids       map[int]string
+	// forked holds the start times of the PIDs PodForPID found through
+	// ProcRoot. No event reports when they exit, so their start time is
+	// checked before they are trusted again.
+	forked map[int]uint64
+}
+
+// NewTracker returns a Tracker fed by backend. Call Run to start it.
+func NewTracker(backend Backend) *Tracker {
+	return &Tracker{
+		ProcRoot:   "/proc",
+		backend:    backend,
+		synced:     make(chan struct{}),
+		containers: map[string]*Container{},
+		pids:       map[int]string{},
+		forked:     map[int]uint64{},
+	}
+}
+
+// Synced is closed once the initial container list has been loaded.
+func (t *Tracker) Synced() <-chan struct{} {
+	return t.synced
+}
+
+// Run subscribes to runtime events, loads the existing containers and then
+// applies events until ctx is done or the event stream fails.
+func (t *Tracker) Run(ctx context.Context) error {
+	// Subscribe before listing so nothing that happens in between is lost.
+	events, errs := t.backend.Subscribe(ctx)
+
+	containers, err := t.backend.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+	for i := range containers {
+		t.addContainer(containers[i])
+	}
+	close(t.synced)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if err != nil && ctx.Err() == nil {
+				return fmt.Errorf("event stream failed: %w", err)
+			}
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			t.apply(ctx, e)
+		}
+	}
+}
+
+func (t *Tracker) apply(ctx context.Context, e Event) {
+	switch e.Kind {
+	case ContainerCreate:
+		t.ensureContainer(ctx, e.ContainerID)
+	case TaskStart, TaskExecStart:
+		if t.ensureContainer(ctx, e.ContainerID) {
+			t.addPID(e.ContainerID, e.PID)
+		}
+	case TaskExit:
+		if e.ExecID == "" || e.ExecID == e.ContainerID {
+			// Every process in the container dies with its init process.
+			t.clearPIDs(e.ContainerID)
+		} else {
+			t.removePID(e.ContainerID, e.PID)
+		}
+	case TaskDelete:
+		t.clearPIDs(e.ContainerID)
+	case ContainerDelete:
+		t.clearPIDs(e.ContainerID)
+		t.mu.Lock()
+		delete(t.containers, e.ContainerID)
+		t.mu.Unlock()
+	}
+}
+
+// ensureContainer makes sure a container is known, fetching it from the
+// backend if needed, and reports whether it belongs to a pod.
+func (t *Tracker) ensureContainer(ctx context.Context, id string) bool {
+	t.mu.RLock()
+	_, ok := t.containers[id]
+	t.mu.RUnlock()
+	if ok {
+		return true
+	}
+
+	c, ok, err := t.backend.Container(ctx, id)
+	if err != nil || !ok {
+		return false
+	}
+	t.addContainer(c)
+	return true
+}
+
+func (t *Tracker) addContainer(c Container) {
+	pids := c.PIDs
+	c.PIDs = nil
+
+	t.mu.Lock()
+	if _, ok := t.containers[c.ID]; !ok {
+		t.containers[c.ID] = &c
+	}
+	t.mu.Unlock()
+
+	for _, pid := range pids {
+		t.addPID(c.ID, pid)
+	}
+}
+
+func (t *Tracker) addPID(containerID string, pid int) {
+	t.mu.Lock()
+	c, ok := t.containers[containerID]
+	if !ok || t.pids[pid] == containerID {
+		t.mu.Unlock()
+		return
+	}
+	// The PID was reused, or its exit was missed: it no longer runs in the
+	// container it was mapped to
+	var moved *Update
+	if oldID, ok := t.pids[pid]; ok {
+		if old, ok := t.containers[oldID]; ok && deletePID(old, pid) {
+			moved = &Update{Pod: old.Pod, ContainerID: oldID, PID: pid}
+		}
+	}
+	c.PIDs = append(c.PIDs, pid)
+	sort.Ints(c.PIDs)
+	t.pids[pid] = containerID
+	delete(t.forked, pid)
+	pod := c.Pod
+	t.mu.Unlock()
+
+	if moved != nil {
+		t.notify(*moved)
+	}
+	t.notify(Update{Added: true, Pod: pod, ContainerID: containerID, PID: pid})
+}
+
+// deletePID removes pid from the PIDs of c and reports whether it was there.
+func deletePID(c *Container, pid int) bool {
+	for i, p := range c.PIDs {
+		if p == pid {
+			c.PIDs = append(c.PIDs[:i], c.PIDs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tracker) removePID(containerID string, pid int) {
+	t.mu.Lock()
+	c, ok := t.containers[containerID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	found := deletePID(c, pid)
+	if t.pids[pid] == containerID {
+		delete(t.pids, pid)
+		delete(t.forked, pid)
+	}
+	pod := c.Pod
+	t.mu.Unlock()
+
+	if found {
+		t.notify(Update{Pod: pod, ContainerID: containerID, PID: pid})
+	}
+}
+
+func (t *Tracker) clearPIDs(containerID string) {
+	t.mu.Lock()
+	c, ok := t.containers[containerID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	pids := c.PIDs
+	c.PIDs = nil
+	for _, pid := range pids {
+		if t.pids[pid] == containerID {
+			delete(t.pids, pid)
+			delete(t.forked, pid)
+		}
+	}
+	pod := c.Pod
+	t.mu.Unlock()
+
+	for _, pid := range pids {
+		t.notify(Update{Pod: pod, ContainerID: containerID, PID: pid})
+	}
+}
+
+func (t *Tracker) notify(u Update) {
+	if t.Notify != nil {
+		t.Notify(u)
+	}
+}
+
+// PodForPID returns the pod a process runs in. Runtime events only carry
+// init and exec PIDs, so processes forked inside a container are resolved
+// through their cgroup and remembered with their start time, which tells
+// whether the PID has been reused since.
+func (t *Tracker) PodForPID(pid int) (Pod, bool) {
+	t.mu.RLock()
+	id, ok := t.pids[pid]
+	start, forked := t.forked[pid]
+	var pod Pod
+	if ok {
+		pod = t.containers[id].Pod
+	}
+	t.mu.RUnlock()
+	if ok && forked {
+		if now, err := podresolver.StartTime(t.ProcRoot, pid); err != nil || now != start {
+			t.removePID(id, pid)
+			ok = false
+		}
+	}
+	if ok {
+		return pod, true
+	}
+
+	// Read before the cgroup, so a PID reused in between fails the check
+	// above next time rather than keeping the wrong pod
+	start, err := podresolver.StartTime(t.ProcRoot, pid)
+	if err != nil {
+		return Pod{}, false
+	}
+	info, err := podresolver.ResolvePIDIn(t.ProcRoot, pid, nil)
+	if err != nil || info.ContainerID == "" {
+		return Pod{}, false
+	}
+
+	t.mu.RLock()
+	c, ok := t.containers[info.ContainerID]
+	if ok {
+		pod = c.Pod
+	}
+	t.mu.RUnlock()
+	if !ok {
+		return Pod{}, false
+	}
+
+	t.addPID(info.ContainerID, pid)
+	t.mu.Lock()
+	if t.pids[pid] == info.ContainerID {
+		t.forked[pid] = start
+	}
+	t.mu.Unlock()
+	return pod, true
+}
+
+// PodPIDs returns the current pod UID → PIDs mapping.
+func (t *Tracker) PodPIDs() map[string][]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	podPIDs := make(map[string][]int)
+	for _, c := range t.containers {
+		podPIDs[c.Pod.UID] = append(podPIDs[c.Pod.UID], c.PIDs...)
+	}
+	for _, pids := range podPIDs {
+		sort.Ints(pids)
+	}
+	return podPIDs
+}
+
+// Containers returns a copy of every tracked container.
+func (t *Tracker) Containers() []Container {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	containers := make([]Container, 0, len(t.containers))
+	for _, c := range t.containers {
+		cp := *c
+		cp.PIDs = append([]int(nil), c.PIDs...)
+		containers = append(containers, cp)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].ID < containers[j].ID })
+	return containers
+}
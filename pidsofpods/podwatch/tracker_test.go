@@ -0,0 +1,498 @@
+package podwatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"podresolver"
+)
+
+var (
+	web = Pod{UID: "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81", Namespace: "default", Name: "web-7d4b9c-x2x9q"}
+	db  = Pod{UID: "3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d", Namespace: "default", Name: "db-0"}
+)
+
+const (
+	appID = "4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b"
+	dbID  = "9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d"
+)
+
+// fakeBackend is a Backend fed by the test. List blocks until release is
+// closed, if set.
+type fakeBackend struct {
+	list       []Container
+	containers map[string]Container
+	events     chan Event
+	errs       chan error
+	release    chan struct{}
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func newFakeBackend(list []Container, containers ...Container) *fakeBackend {
+	b := &fakeBackend{
+		list:       list,
+		containers: map[string]Container{},
+		events:     make(chan Event),
+		errs:       make(chan error, 1),
+	}
+	for _, c := range containers {
+		b.containers[c.ID] = c
+	}
+	return b
+}
+
+func (b *fakeBackend) call(name string) {
+	b.mu.Lock()
+	b.calls = append(b.calls, name)
+	b.mu.Unlock()
+}
+
+func (b *fakeBackend) List(ctx context.Context) ([]Container, error) {
+	b.call("list")
+	if b.release != nil {
+		<-b.release
+	}
+	if b.list == nil {
+		return nil, errors.New("runtime unavailable")
+	}
+	return b.list, nil
+}
+
+func (b *fakeBackend) Container(ctx context.Context, id string) (Container, bool, error) {
+	c, ok := b.containers[id]
+	if !ok {
+		return Container{}, false, fmt.Errorf("container %s not found", id)
+	}
+	return c, c.Pod.UID != "", nil
+}
+
+func (b *fakeBackend) Subscribe(ctx context.Context) (<-chan Event, <-chan error) {
+	b.call("subscribe")
+	return b.events, b.errs
+}
+
+// recorder collects the updates of a Tracker.
+type recorder struct {
+	mu      sync.Mutex
+	updates []Update
+}
+
+func (r *recorder) notify(u Update) {
+	r.mu.Lock()
+	r.updates = append(r.updates, u)
+	r.mu.Unlock()
+}
+
+// take returns the updates since the last call.
+func (r *recorder) take() []Update {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := r.updates
+	r.updates = nil
+	return u
+}
+
+// startTracker runs a Tracker on backend until the test ends and waits for
+// it to sync.
+func startTracker(t *testing.T, backend Backend) (*Tracker, *recorder) {
+	t.Helper()
+	rec := &recorder{}
+	tracker := NewTracker(backend)
+	tracker.Notify = rec.notify
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- tracker.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+
+	select {
+	case <-tracker.Synced():
+	case err := <-done:
+		t.Fatalf("Run returned before syncing: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sync")
+	}
+	return tracker, rec
+}
+
+// send delivers events to the Tracker and waits until they are applied: Run
+// only takes the next event once it is done with the previous one.
+func send(t *testing.T, events chan<- Event, evs ...Event) {
+	t.Helper()
+	// An exit of an unknown container changes nothing
+	flush := Event{Kind: TaskExit, ContainerID: "flush"}
+	for _, e := range append(evs, flush) {
+		select {
+		case events <- e:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out sending %+v", e)
+		}
+	}
+}
+
+func containerPIDs(tracker *Tracker) map[string][]int {
+	pids := map[string][]int{}
+	for _, c := range tracker.Containers() {
+		pids[c.ID] = c.PIDs
+	}
+	return pids
+}
+
+func TestTrackerLifecycle(t *testing.T) {
+	app := Container{ID: appID, Name: "app", Image: "nginx", Pod: web}
+	host := Container{ID: "standalone", Name: "cache", Image: "redis"}
+	backend := newFakeBackend([]Container{}, app, host)
+	tracker, rec := startTracker(t, backend)
+
+	steps := []struct {
+		name    string
+		events  []Event
+		updates []Update
+		pids    map[string][]int
+	}{
+		{
+			name:   "create",
+			events: []Event{{Kind: ContainerCreate, ContainerID: appID}},
+			pids:   map[string][]int{appID: nil},
+		},
+		{
+			name:    "start",
+			events:  []Event{{Kind: TaskStart, ContainerID: appID, PID: 100}},
+			updates: []Update{{Added: true, Pod: web, ContainerID: appID, PID: 100}},
+			pids:    map[string][]int{appID: {100}},
+		},
+		{
+			name: "exec",
+			events: []Event{
+				{Kind: TaskExecStart, ContainerID: appID, ExecID: "probe", PID: 200},
+				{Kind: TaskExecStart, ContainerID: appID, ExecID: "shell", PID: 150},
+			},
+			updates: []Update{
+				{Added: true, Pod: web, ContainerID: appID, PID: 200},
+				{Added: true, Pod: web, ContainerID: appID, PID: 150},
+			},
+			pids: map[string][]int{appID: {100, 150, 200}},
+		},
+		{
+			name:    "exec exit",
+			events:  []Event{{Kind: TaskExit, ContainerID: appID, ExecID: "probe", PID: 200}},
+			updates: []Update{{Pod: web, ContainerID: appID, PID: 200}},
+			pids:    map[string][]int{appID: {100, 150}},
+		},
+		{
+			name:    "containers outside pods are ignored",
+			events:  []Event{{Kind: TaskStart, ContainerID: "standalone", PID: 300}},
+			updates: nil,
+			pids:    map[string][]int{appID: {100, 150}},
+		},
+		{
+			name:   "init exit",
+			events: []Event{{Kind: TaskExit, ContainerID: appID, PID: 100}},
+			updates: []Update{
+				{Pod: web, ContainerID: appID, PID: 100},
+				{Pod: web, ContainerID: appID, PID: 150},
+			},
+			pids: map[string][]int{appID: nil},
+		},
+		{
+			name:   "task delete",
+			events: []Event{{Kind: TaskDelete, ContainerID: appID, PID: 100}},
+			pids:   map[string][]int{appID: nil},
+		},
+		{
+			name:   "container delete",
+			events: []Event{{Kind: ContainerDelete, ContainerID: appID}},
+			pids:   map[string][]int{},
+		},
+	}
+
+	for _, step := range steps {
+		send(t, backend.events, step.events...)
+		if got := rec.take(); !reflect.DeepEqual(got, step.updates) {
+			t.Errorf("%s: updates = %+v, want %+v", step.name, got, step.updates)
+		}
+		if got := containerPIDs(tracker); !reflect.DeepEqual(got, step.pids) {
+			t.Errorf("%s: PIDs = %v, want %v", step.name, got, step.pids)
+		}
+	}
+}
+
+func TestTrackerSubscribesBeforeListing(t *testing.T) {
+	backend := newFakeBackend([]Container{{ID: appID, Name: "app", Pod: web, PIDs: []int{100, 101}}})
+	backend.release = make(chan struct{})
+	rec := &recorder{}
+	tracker := NewTracker(backend)
+	tracker.Notify = rec.notify
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- tracker.Run(ctx) }()
+
+	// Synced isn't closed while the list is loading
+	for {
+		backend.mu.Lock()
+		n := len(backend.calls)
+		backend.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-tracker.Synced():
+		t.Fatal("synced before the list was loaded")
+	default:
+	}
+	if want := []string{"subscribe", "list"}; !reflect.DeepEqual(backend.calls, want) {
+		t.Errorf("calls = %v, want %v", backend.calls, want)
+	}
+
+	close(backend.release)
+	select {
+	case <-tracker.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sync")
+	}
+	want := []Update{
+		{Added: true, Pod: web, ContainerID: appID, PID: 100},
+		{Added: true, Pod: web, ContainerID: appID, PID: 101},
+	}
+	if got := rec.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("updates = %+v, want %+v", got, want)
+	}
+	if got := tracker.PodPIDs(); !reflect.DeepEqual(got, map[string][]int{web.UID: {100, 101}}) {
+		t.Errorf("PodPIDs = %v", got)
+	}
+
+	// A failed event stream ends Run with an error
+	backend.errs <- errors.New("connection reset")
+	if err := <-done; err == nil {
+		t.Error("Run returned no error after the event stream failed")
+	}
+}
+
+func TestTrackerListError(t *testing.T) {
+	tracker := NewTracker(newFakeBackend(nil))
+	if err := tracker.Run(context.Background()); err == nil {
+		t.Fatal("Run succeeded although List failed")
+	}
+	select {
+	case <-tracker.Synced():
+		t.Error("synced although List failed")
+	default:
+	}
+}
+
+func TestTrackerMovesReassignedPID(t *testing.T) {
+	backend := newFakeBackend([]Container{
+		{ID: appID, Name: "app", Pod: web, PIDs: []int{100}},
+		{ID: dbID, Name: "postgres", Pod: db},
+	})
+	tracker, rec := startTracker(t, backend)
+	rec.take()
+
+	// The exit of 100 was missed and the PID reused in another container
+	send(t, backend.events, Event{Kind: TaskStart, ContainerID: dbID, PID: 100})
+
+	want := []Update{
+		{Pod: web, ContainerID: appID, PID: 100},
+		{Added: true, Pod: db, ContainerID: dbID, PID: 100},
+	}
+	if got := rec.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("updates = %+v, want %+v", got, want)
+	}
+	if got := tracker.PodPIDs(); !reflect.DeepEqual(got, map[string][]int{web.UID: nil, db.UID: {100}}) {
+		t.Errorf("PodPIDs = %v", got)
+	}
+}
+
+// fakeProc writes the stat and cgroup files of pid below procRoot.
+func fakeProc(t *testing.T, procRoot string, pid int, start uint64, cgroup string) {
+	t.Helper()
+	dir := filepath.Join(procRoot, fmt.Sprint(pid))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stat := fmt.Sprintf("%d (sh) S 1 %d %d 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0 %d 2048000 200\n", pid, pid, pid, start)
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup"), []byte("0::"+cgroup+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func containerCgroup(pod Pod, id string) string {
+	return "/kubepods.slice/kubepods-pod" + pod.UID + ".slice/cri-containerd-" + id + ".scope"
+}
+
+func TestTrackerPodForPID(t *testing.T) {
+	backend := newFakeBackend([]Container{
+		{ID: appID, Name: "app", Pod: web, PIDs: []int{100}},
+		{ID: dbID, Name: "postgres", Pod: db},
+	})
+	tracker, rec := startTracker(t, backend)
+	procRoot := t.TempDir()
+	tracker.ProcRoot = procRoot
+	rec.take()
+
+	steps := []struct {
+		name    string
+		start   uint64
+		cgroup  string // empty if the process is gone
+		pod     Pod
+		ok      bool
+		updates []Update
+	}{
+		{
+			name:    "forked in a container",
+			start:   1000,
+			cgroup:  containerCgroup(web, appID),
+			pod:     web,
+			ok:      true,
+			updates: []Update{{Added: true, Pod: web, ContainerID: appID, PID: 500}},
+		},
+		{
+			// Served from the mapping: the cgroup isn't read again
+			name:   "same process",
+			start:  1000,
+			cgroup: containerCgroup(db, dbID),
+			pod:    web,
+			ok:     true,
+		},
+		{
+			name:   "PID reused in another pod",
+			start:  2000,
+			cgroup: containerCgroup(db, dbID),
+			pod:    db,
+			ok:     true,
+			updates: []Update{
+				{Pod: web, ContainerID: appID, PID: 500},
+				{Added: true, Pod: db, ContainerID: dbID, PID: 500},
+			},
+		},
+		{
+			name:    "PID reused on the host",
+			start:   3000,
+			cgroup:  "/system.slice/sshd.service",
+			updates: []Update{{Pod: db, ContainerID: dbID, PID: 500}},
+		},
+		{
+			name: "exited",
+		},
+	}
+
+	for _, step := range steps {
+		if step.cgroup != "" {
+			fakeProc(t, procRoot, 500, step.start, step.cgroup)
+		} else if err := os.RemoveAll(filepath.Join(procRoot, "500")); err != nil {
+			t.Fatal(err)
+		}
+
+		pod, ok := tracker.PodForPID(500)
+		if ok != step.ok || pod != step.pod {
+			t.Errorf("%s: PodForPID = %+v, %v, want %+v, %v", step.name, pod, ok, step.pod, step.ok)
+		}
+		if got := rec.take(); !reflect.DeepEqual(got, step.updates) {
+			t.Errorf("%s: updates = %+v, want %+v", step.name, got, step.updates)
+		}
+	}
+
+	// PIDs reported by the runtime aren't checked against /proc
+	if pod, ok := tracker.PodForPID(100); !ok || pod != web {
+		t.Errorf("PodForPID(100) = %+v, %v", pod, ok)
+	}
+}
+
+// fakeEngine is a podresolver.Engine fed by the test.
+type fakeEngine struct {
+	containers map[string]podresolver.EngineContainer
+	events     chan podresolver.EngineEvent
+}
+
+func (e *fakeEngine) ListContainers(ctx context.Context) ([]podresolver.EngineContainer, error) {
+	return nil, nil
+}
+
+func (e *fakeEngine) InspectContainer(ctx context.Context, id string) (podresolver.EngineContainer, error) {
+	c, ok := e.containers[id]
+	if !ok {
+		return podresolver.EngineContainer{}, fmt.Errorf("no such container: %s", id)
+	}
+	return c, nil
+}
+
+func (e *fakeEngine) Events(ctx context.Context) (<-chan podresolver.EngineEvent, <-chan error) {
+	return e.events, make(chan error)
+}
+
+func TestTrackerEngineContainerDied(t *testing.T) {
+	engine := &fakeEngine{
+		containers: map[string]podresolver.EngineContainer{
+			appID: {
+				ID:    appID,
+				Name:  "k8s_app_web-7d4b9c-x2x9q_default_" + web.UID + "_0",
+				Image: "nginx",
+				Labels: map[string]string{
+					"io.kubernetes.pod.uid":        web.UID,
+					"io.kubernetes.pod.name":       web.Name,
+					"io.kubernetes.pod.namespace":  web.Namespace,
+					"io.kubernetes.container.name": "app",
+				},
+				PID: 100,
+			},
+		},
+		events: make(chan podresolver.EngineEvent),
+	}
+	tracker, rec := startTracker(t, NewEngine(engine))
+
+	// Engine forwards each event from its own goroutine, so a second flush
+	// event is needed to know the Tracker applied the first.
+	flush := podresolver.EngineEvent{Type: podresolver.ContainerDied, ContainerID: "flush"}
+	sendEngine := func(events ...podresolver.EngineEvent) {
+		t.Helper()
+		for _, e := range append(events, flush, flush) {
+			select {
+			case engine.events <- e:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out sending %+v", e)
+			}
+		}
+	}
+
+	sendEngine(
+		podresolver.EngineEvent{Type: podresolver.ContainerCreated, ContainerID: appID},
+		podresolver.EngineEvent{Type: podresolver.ContainerStarted, ContainerID: appID},
+	)
+	if got, want := rec.take(), []Update{{Added: true, Pod: web, ContainerID: appID, PID: 100}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("updates after start = %+v, want %+v", got, want)
+	}
+
+	sendEngine(podresolver.EngineEvent{Type: podresolver.ContainerDied, ContainerID: appID})
+	if got, want := rec.take(), []Update{{Pod: web, ContainerID: appID, PID: 100}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("updates after died = %+v, want %+v", got, want)
+	}
+	if got := containerPIDs(tracker); !reflect.DeepEqual(got, map[string][]int{appID: nil}) {
+		t.Errorf("PIDs after died = %v", got)
+	}
+
+	sendEngine(podresolver.EngineEvent{Type: podresolver.ContainerRemoved, ContainerID: appID})
+	if got := containerPIDs(tracker); len(got) != 0 {
+		t.Errorf("PIDs after removed = %v", got)
+	}
+}
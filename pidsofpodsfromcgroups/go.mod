@@ -0,0 +1,9 @@
+module pidsofpodsfromcgroups
+
+go 1.22.2
+
+require podresolver v0.0.0
+
+require sigs.k8s.io/yaml v1.4.0 // indirect
+
+replace podresolver => ../podresolver
@@ -1,20 +1,27 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"regexp"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	"podresolver"
+	"podresolver/report"
 )
 
 // Struct for parsing crictl pods output
 type PodSandbox struct {
-	ID     string `json:"id"`
+	ID       string `json:"id"`
+	Metadata struct {
+		UID string `json:"uid"`
+	} `json:"metadata"`
 	Labels struct {
 		PodName      string `json:"io.kubernetes.pod.name"`
 		PodNamespace string `json:"io.kubernetes.pod.namespace"`
@@ -55,147 +62,234 @@ func getAllPodSandboxes() ([]PodSandbox, error) {
 	return result.Items, nil
 }
 
-// listMatchingFolders lists all folders that start with "cri-containerd" in the given directory
-func listMatchingFolders(rootDir string) ([]string, error) {
-	var matchingFolders []string
-
-	// Compile regex to match folders starting with "cri-containerd"
-	regex := regexp.MustCompile(`^cri-containerd.*`)
-
-	// Read directory entries
-	entries, err := os.ReadDir(rootDir)
+// Get the full cgroup path for the pod from crictl inspectp
+func getCgroupPathForPod(podID string) (string, error) {
+	cmd := exec.Command("crictl", "inspectp", podID)
+	output, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read directory: %v", err)
+		return "", fmt.Errorf("Failed to run crictl inspectp: %v", err)
 	}
 
-	// Iterate over entries and filter matching directories
-	for _, entry := range entries {
-		if entry.IsDir() && regex.MatchString(entry.Name()) {
-			matchingFolders = append(matchingFolders, filepath.Join(rootDir, entry.Name()))
-		}
+	var result PodInspectResponse
+	if err := json.Unmarshal(output, &result); err != nil {
+		return "", fmt.Errorf("Failed to parse crictl inspectp output: %v", err)
 	}
 
-	return matchingFolders, nil
+	return result.Info.SandboxMetadata.Metadata.Config.Linux.CgroupParent, nil
 }
 
-// GetRootCgroupPath finds the root cgroup mount point (supports both v1 and v2)
-func GetRootCgroupPath() (string, error) {
-	// Open /proc/mounts to find the cgroup mount point
-	file, err := os.Open("/proc/mounts")
+// Get the containers and their PIDs (and optionally resource stats) from the pod's cgroup directory
+func getPIDsFromCgroup(cgroupDir string, opts podresolver.WalkOptions) ([]podresolver.Container, error) {
+	containers, err := podresolver.WalkContainers(cgroupDir, opts)
 	if err != nil {
-		return "", fmt.Errorf("failed to open /proc/mounts: %v", err)
+		return nil, fmt.Errorf("Failed to list all the container cgroup paths: %v", err)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-		if len(fields) < 3 {
-			continue
-		}
-
-		mountPoint := fields[1]
-		fsType := fields[2]
+	return containers, nil
+}
 
-		// Check for cgroup v2 (unified hierarchy)
-		if fsType == "cgroup2" {
-			return mountPoint, nil
-		}
+// A pod to report on and how to find its cgroup directory
+type podEntry struct {
+	ID        string
+	UID       string
+	Namespace string
+	Name      string
+	cgroupDir func() (string, error)
+}
 
-		// Check for cgroup v1 (separate controllers)
-		if fsType == "cgroup" {
-			return mountPoint, nil
-		}
+// List pods with crictl, locating each pod's cgroup with crictl inspectp
+func listPodsFromCrictl() ([]podEntry, error) {
+	podSandboxes, err := getAllPodSandboxes()
+	if err != nil {
+		return nil, err
 	}
 
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("error reading /proc/mounts: %v", err)
+	var pods []podEntry
+	for _, sandbox := range podSandboxes {
+		podID := sandbox.ID
+		pods = append(pods, podEntry{
+			ID:        podID,
+			UID:       sandbox.Metadata.UID,
+			Namespace: sandbox.Labels.PodNamespace,
+			Name:      sandbox.Labels.PodName,
+			cgroupDir: func() (string, error) {
+				cgroupPath, err := getCgroupPathForPod(podID)
+				if err != nil {
+					return "", err
+				}
+				rootCgroupPath, err := podresolver.GetRootCgroupPath()
+				if err != nil {
+					return "", fmt.Errorf("Failed to get cgroup path: %v", err)
+				}
+				return podresolver.PodCgroupDir(rootCgroupPath, cgroupPath), nil
+			},
+		})
 	}
 
-	return "", fmt.Errorf("cgroup root not found")
+	return pods, nil
 }
 
-// Get the full cgroup path for the pod from crictl inspectp
-func getCgroupPathForPod(podID string) (string, error) {
-	cmd := exec.Command("crictl", "inspectp", podID)
-	output, err := cmd.Output()
+// List pods known to the kubelet, locating each pod's cgroup by its UID
+func listPodsFromKubelet(lister podresolver.PodLister) ([]podEntry, error) {
+	kubePods, err := lister.ListPods(context.Background())
 	if err != nil {
-		return "", fmt.Errorf("Failed to run crictl inspectp: %v", err)
+		return nil, fmt.Errorf("Failed to list pods from kubelet: %v", err)
 	}
 
-	var result PodInspectResponse
-	if err := json.Unmarshal(output, &result); err != nil {
-		return "", fmt.Errorf("Failed to parse crictl inspectp output: %v", err)
+	rootCgroupPath, err := podresolver.GetRootCgroupPath()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get cgroup path: %v", err)
+	}
+	kubepods, err := podresolver.KubepodsCgroupDir(rootCgroupPath)
+	if err != nil {
+		return nil, err
 	}
 
-	return result.Info.SandboxMetadata.Metadata.Config.Linux.CgroupParent, nil
+	var pods []podEntry
+	for _, kp := range kubePods {
+		uid := kp.UID
+		pods = append(pods, podEntry{
+			ID:        uid,
+			UID:       uid,
+			Namespace: kp.Namespace,
+			Name:      kp.Name,
+			cgroupDir: func() (string, error) {
+				return podresolver.FindPodCgroup(kubepods, uid)
+			},
+		})
+	}
+
+	return pods, nil
 }
 
-// Get PIDs from the pod's cgroup path
-func getPIDsFromCgroup(cgroupPath string) ([]int, error) {
-	rootCgroupPath, err := GetRootCgroupPath()
+// watchPods prints pod and PID changes in the kubepods cgroup tree until interrupted
+func watchPods(resync time.Duration) error {
+	rootCgroupPath, err := podresolver.GetRootCgroupPath()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get cgroup path: %v", err)
+		return fmt.Errorf("Failed to get cgroup path: %v", err)
+	}
+	kubepods, err := podresolver.KubepodsCgroupDir(rootCgroupPath)
+	if err != nil {
+		return err
 	}
 
-	paths, err := listMatchingFolders(rootCgroupPath + "/" + cgroupPath)
+	watcher, err := podresolver.NewWatcher(kubepods, podresolver.WatchOptions{Resync: resync})
 	if err != nil {
-		return nil, fmt.Errorf("Failed to list all the container cgroup paths: %v", err)
+		return fmt.Errorf("Failed to watch %s: %v", kubepods, err)
 	}
 
-	var pids []int
-	for _, path := range paths {
-		data, err := os.ReadFile(path + "/cgroup.procs")
-		if err != nil {
-			return nil, fmt.Errorf("Failed to read cgroup.procs: %v", err)
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		lines := strings.Split(string(data), "\n")
-
-		for _, line := range lines {
-			if line == "" {
-				continue
-			}
-			pid, err := strconv.Atoi(line)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to convert PID: %v", err)
-			}
-			pids = append(pids, pid)
+	errc := make(chan error, 1)
+	go func() { errc <- watcher.Run(ctx) }()
+
+	fmt.Printf("Watching %s...\n", kubepods)
+	for event := range watcher.Events() {
+		switch event.Type {
+		case podresolver.PodAdded, podresolver.PodRemoved:
+			fmt.Printf("%s: pod %s\n", event.Type, event.PodUID)
+		default:
+			fmt.Printf("%s: pod %s container %s PID %d\n", event.Type, event.PodUID, podresolver.ShortID(event.ContainerID), event.PID)
 		}
 	}
 
-	return pids, nil
+	return <-errc
 }
 
-func main() {
-	// Step 1: Get all running pod sandboxes
-	podSandboxes, err := getAllPodSandboxes()
+// resolvePod finds the containers, PIDs and optionally stats of a pod. A pod
+// that can't be fully resolved is returned with its Error set.
+func resolvePod(pod podEntry, opts podresolver.WalkOptions) report.Pod {
+	result := report.Pod{Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID}
+
+	// Step 3: Get the pod's cgroup directory
+	cgroupDir, err := pod.cgroupDir()
 	if err != nil {
-		fmt.Printf("Error retrieving pod sandboxes: %v\n", err)
-		return
+		result.Error = fmt.Sprintf("Failed to get cgroup path: %v", err)
+		return result
 	}
+	result.Cgroup = report.NewCgroup(cgroupDir)
 
-	// Step 2: Iterate over each pod sandbox and find PIDs
-	for _, sandbox := range podSandboxes {
-		podID := sandbox.ID
-		namespace := sandbox.Labels.PodNamespace
-		podName := sandbox.Labels.PodName
+	// Step 4: Get PIDs (and stats) from the cgroup path
+	containers, err := getPIDsFromCgroup(cgroupDir, opts)
+	if err != nil {
+		result.Error = fmt.Sprintf("Failed to get PIDs: %v", err)
+		return result
+	}
+	for _, c := range containers {
+		result.Containers = append(result.Containers, report.ContainerFromResolver(c))
+	}
 
-		// Step 3: Get the full cgroup path using crictl inspectp
-		cgroupPath, err := getCgroupPathForPod(podID)
+	if opts.Stats {
+		result.Stats, err = podresolver.ReadCgroupStats(cgroupDir)
 		if err != nil {
-			fmt.Printf("Pod %s/%s (ID: %s): Failed to get cgroup path: %v\n", namespace, podName, podID, err)
-			continue
+			result.Error = fmt.Sprintf("Failed to read stats: %v", err)
 		}
+	}
 
-		// Step 4: Get PIDs from the cgroup path
-		pids, err := getPIDsFromCgroup(cgroupPath)
-		if err != nil {
-			fmt.Printf("Pod %s/%s (ID: %s): Failed to get PIDs: %v\n", namespace, podName, podID, err)
-			continue
+	return result
+}
+
+func main() {
+	output := flag.String("o", "table", "Output format: "+strings.Join(report.Formats, ", "))
+	threads := flag.Bool("threads", false, "Also list thread IDs from cgroup.threads")
+	stats := flag.Bool("stats", false, "Also report CPU, memory, IO and pressure stats of each pod and container (cgroup v2)")
+	watch := flag.Bool("watch", false, "Keep running and print pod and PID changes as they happen")
+	resync := flag.Duration("resync", 2*time.Second, "How often to rescan cgroups in -watch mode")
+	source := flag.String("source", "crictl", "Where to list pods from: crictl, kubelet-api or kubelet-dir")
+	kubeletURL := flag.String("kubelet-url", "http://127.0.0.1:10255", "Kubelet URL for -source kubelet-api")
+	kubeletToken := flag.String("kubelet-token", "", "Bearer token file for the kubelet's authenticated port")
+	kubeletInsecure := flag.Bool("kubelet-insecure", false, "Skip verifying the kubelet's serving certificate")
+	kubeletPodsDir := flag.String("kubelet-pods-dir", "/var/lib/kubelet/pods", "Kubelet pods directory for -source kubelet-dir")
+	flag.Parse()
+
+	if !report.ValidFormat(*output) {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", *output)
+		os.Exit(report.ExitUsage)
+	}
+
+	if *watch {
+		if err := watchPods(*resync); err != nil {
+			fmt.Fprintf(os.Stderr, "Error watching pods: %v\n", err)
+			os.Exit(report.ExitFailure)
 		}
+		return
+	}
+
+	// Step 1: Get all running pods
+	var pods []podEntry
+	var err error
+	switch *source {
+	case "crictl":
+		pods, err = listPodsFromCrictl()
+	case "kubelet-api":
+		pods, err = listPodsFromKubelet(podresolver.KubeletAPI{URL: *kubeletURL, TokenFile: *kubeletToken, Insecure: *kubeletInsecure})
+	case "kubelet-dir":
+		pods, err = listPodsFromKubelet(podresolver.KubeletDir{PodsDir: *kubeletPodsDir})
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown pod source %q\n", *source)
+		os.Exit(report.ExitUsage)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error retrieving pods: %v\n", err)
+		os.Exit(report.ExitFailure)
+	}
+
+	// Step 2: Iterate over each pod and find PIDs
+	opts := podresolver.WalkOptions{Threads: *threads, Stats: *stats}
+	var results []report.Pod
+	for _, pod := range pods {
+		result := resolvePod(pod, opts)
+		if result.Error != "" {
+			fmt.Fprintf(os.Stderr, "Pod %s/%s (ID: %s): %s\n", pod.Namespace, pod.Name, pod.ID, result.Error)
+		}
+		results = append(results, result)
+	}
 
-		// Step 5: Print the results
-		fmt.Printf("Pod %s/%s (ID: %s) has PIDs: %v\n", namespace, podName, podID, pids)
+	// Step 5: Print the results
+	if err := report.Write(os.Stdout, *output, results); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(report.ExitFailure)
 	}
+	os.Exit(report.ExitCode(results))
 }
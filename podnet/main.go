@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"podresolver"
+	"podresolver/cgroupattach"
+	"podresolver/report"
+
+	"github.com/cilium/ebpf"
+)
+
+// PodNetStats matches struct pod_net_stats in podnet.c
+type PodNetStats struct {
+	RxBytes     uint64
+	RxPackets   uint64
+	TxBytes     uint64
+	TxPackets   uint64
+	SockCreates uint64
+}
+
+func (s *PodNetStats) add(o PodNetStats) {
+	s.RxBytes += o.RxBytes
+	s.RxPackets += o.RxPackets
+	s.TxBytes += o.TxBytes
+	s.TxPackets += o.TxPackets
+	s.SockCreates += o.SockCreates
+}
+
+// podRow is a pod and its counters for one table refresh
+type podRow struct {
+	namespace string
+	name      string
+	stats     PodNetStats
+	rxRate    float64
+	txRate    float64
+}
+
+func main() {
+	interval := flag.Duration("interval", 5*time.Second, "How often to print the counters")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Step 1: Load the cgroup programs
+	spec, err := ebpf.LoadCollectionSpec("podnet.o")
+	if err != nil {
+		log.Fatalf("Failed to load eBPF spec: %v", err)
+	}
+
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		log.Fatalf("Failed to create eBPF collection: %v", err)
+	}
+	defer coll.Close()
+
+	podStats := coll.Maps["pod_stats"]
+	if podStats == nil {
+		log.Fatalf("Failed to find the pod_stats map")
+	}
+
+	// Step 2: Attach them to every pod cgroup, now and as pods start
+	attacher, err := cgroupattach.Start(ctx, cgroupattach.Programs(spec, coll))
+	if err != nil {
+		log.Fatalf("Failed to attach to pods: %v", err)
+	}
+	defer attacher.Close()
+
+	fmt.Printf("Counting traffic of %d pods... Press Ctrl+C to stop.\n", len(attacher.Pods()))
+
+	// Step 3: Print the counters of every pod on each tick
+	previous := map[string]PodNetStats{}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("Detaching from pods...")
+			return
+		case <-ticker.C:
+		}
+
+		names := podNames(ctx)
+		current := map[string]PodNetStats{}
+		var rows []podRow
+		for _, pod := range attacher.Pods() {
+			stats, err := readStats(podStats, pod.CgroupID)
+			if err != nil {
+				// The pod went away since it was listed
+				if !errors.Is(err, ebpf.ErrKeyNotExist) {
+					log.Printf("Failed to read counters of pod %s: %v", pod.UID, err)
+				}
+				continue
+			}
+			current[pod.UID] = stats
+
+			row := podRow{namespace: "-", name: pod.UID, stats: stats}
+			if kp, ok := names[pod.UID]; ok {
+				row.namespace, row.name = kp.Namespace, kp.Name
+			}
+			if prev, ok := previous[pod.UID]; ok && stats.RxBytes >= prev.RxBytes && stats.TxBytes >= prev.TxBytes {
+				row.rxRate = float64(stats.RxBytes-prev.RxBytes) / interval.Seconds()
+				row.txRate = float64(stats.TxBytes-prev.TxBytes) / interval.Seconds()
+			}
+			rows = append(rows, row)
+		}
+		previous = current
+
+		printTable(rows)
+	}
+}
+
+// readStats sums the per-CPU counters of the pod with the given cgroup ID
+func readStats(m *ebpf.Map, cgroupID uint64) (PodNetStats, error) {
+	var perCPU []PodNetStats
+	if err := m.Lookup(cgroupID, &perCPU); err != nil {
+		return PodNetStats{}, err
+	}
+
+	var total PodNetStats
+	for _, s := range perCPU {
+		total.add(s)
+	}
+	return total, nil
+}
+
+// podNames maps pod UIDs to their namespace and name. Pods crictl can't
+// report are printed by UID.
+func podNames(ctx context.Context) map[string]podresolver.KubePod {
+	names := map[string]podresolver.KubePod{}
+	pods, err := podresolver.Crictl{}.ListPods(ctx)
+	if err != nil {
+		return names
+	}
+	for _, pod := range pods {
+		names[pod.UID] = pod
+	}
+	return names
+}
+
+func printTable(rows []podRow) {
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].namespace != rows[j].namespace {
+			return rows[i].namespace < rows[j].namespace
+		}
+		return rows[i].name < rows[j].name
+	})
+
+	fmt.Printf("\n%s\n", time.Now().Format("15:04:05"))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tRX\tRX PKTS\tRX/S\tTX\tTX PKTS\tTX/S\tSOCKETS")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%d\t%s\t%d\n",
+			r.namespace, r.name,
+			report.HumanBytes(r.stats.RxBytes), r.stats.RxPackets, report.HumanBytes(uint64(r.rxRate)),
+			report.HumanBytes(r.stats.TxBytes), r.stats.TxPackets, report.HumanBytes(uint64(r.txRate)),
+			r.stats.SockCreates)
+	}
+	w.Flush()
+}
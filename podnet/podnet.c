@@ -0,0 +1,57 @@
+//go:build ignore
+
+#include <linux/bpf.h>
+#include "bpf_helpers.h"
+
+char LICENSE[] SEC("license") = "GPL";
+
+// Network counters of one pod
+struct pod_net_stats {
+    __u64 rx_bytes;
+    __u64 rx_packets;
+    __u64 tx_bytes;
+    __u64 tx_packets;
+    __u64 sock_creates;
+};
+
+// Storage of the cgroup each program is attached to. With a __u64 key
+// (Linux 5.9+) it is shared by all programs on that cgroup, so every pod
+// gets one entry keyed by the ID of its cgroup, created on attach and freed
+// on detach. Being per-CPU, it is updated without atomics.
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_CGROUP_STORAGE);
+    __type(key, __u64);
+    __type(value, struct pod_net_stats);
+} pod_stats SEC(".maps");
+
+SEC("cgroup_skb/ingress")
+int count_ingress(struct __sk_buff *skb)
+{
+    struct pod_net_stats *stats = bpf_get_local_storage(&pod_stats, 0);
+
+    stats->rx_bytes += skb->len;
+    stats->rx_packets++;
+
+    return 1; // Allow the packet
+}
+
+SEC("cgroup_skb/egress")
+int count_egress(struct __sk_buff *skb)
+{
+    struct pod_net_stats *stats = bpf_get_local_storage(&pod_stats, 0);
+
+    stats->tx_bytes += skb->len;
+    stats->tx_packets++;
+
+    return 1; // Allow the packet
+}
+
+SEC("cgroup/sock_create")
+int count_sock_create(struct bpf_sock *sk)
+{
+    struct pod_net_stats *stats = bpf_get_local_storage(&pod_stats, 0);
+
+    stats->sock_creates++;
+
+    return 1; // Allow the socket
+}
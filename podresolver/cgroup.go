@@ -0,0 +1,321 @@
+// Package podresolver maps Kubernetes pods and containers to the cgroups and
+// processes that back them on the local node.
+package podresolver
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Container is the set of processes found under one container cgroup.
+// Runtime is empty when the runtime can't be told from the cgroup name, as
+// with the cgroupfs driver.
+type Container struct {
+	ID      string
+	Runtime string
+	Cgroup  string
+	PIDs    []int
+	TIDs    []int
+	// Stats is the resource usage of the container cgroup, including its
+	// descendants. It is only read when WalkOptions.Stats is set.
+	Stats *CgroupStats
+}
+
+// WalkOptions controls what WalkContainers collects.
+type WalkOptions struct {
+	// Threads also collects thread IDs from cgroup.threads (or tasks on v1).
+	Threads bool
+	// Stats also reads the resource usage of each container cgroup.
+	Stats bool
+}
+
+// runtimePrefixes maps container cgroup directory prefixes to the runtime
+// that creates them when the systemd cgroup driver is used.
+var runtimePrefixes = []struct {
+	prefix  string
+	runtime string
+}{
+	{"cri-containerd-", "containerd"},
+	{"crio-", "cri-o"},
+	{"docker-", "docker"},
+	{"libpod-", "podman"},
+}
+
+// containerIDRegex matches a bare container ID as used by the cgroupfs driver.
+var containerIDRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// podDirRegex matches a pod cgroup directory for both the cgroupfs driver
+// ("pod<uid>") and the systemd driver ("kubepods-burstable-pod<uid>.slice",
+// where the dashes of the UID are replaced with underscores).
+var podDirRegex = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(\.slice)?$`)
+
+// ParsePodDir reports whether a cgroup directory name belongs to a pod, and
+// if so returns the pod UID.
+func ParsePodDir(name string) (uid string, ok bool) {
+	m := podDirRegex.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	return strings.ReplaceAll(m[1], "_", "-"), true
+}
+
+// ParseContainerDir reports whether a cgroup directory name belongs to a
+// container, and if so which runtime created it and the container ID.
+func ParseContainerDir(name string) (runtime, id string, ok bool) {
+	base := strings.TrimSuffix(name, ".scope")
+	for _, rp := range runtimePrefixes {
+		if !strings.HasPrefix(base, rp.prefix) {
+			continue
+		}
+		id = strings.TrimPrefix(base, rp.prefix)
+		// CRI-O runs a conmon monitor next to each container in crio-conmon-<id>.
+		if !containerIDRegex.MatchString(id) {
+			return "", "", false
+		}
+		return rp.runtime, id, true
+	}
+	if containerIDRegex.MatchString(base) {
+		return "", base, true
+	}
+	return "", "", false
+}
+
+// ShortID truncates a container ID the way crictl and docker print it.
+func ShortID(id string) string {
+	if len(id) > 13 {
+		return id[:13]
+	}
+	return id
+}
+
+// WalkContainers recursively walks rootDir and returns every container cgroup
+// below it. Processes in cgroups nested under a container are attributed to
+// that container.
+func WalkContainers(rootDir string, opts WalkOptions) ([]Container, error) {
+	var containers []Container
+
+	err := filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The cgroup can disappear while we walk it.
+			if os.IsNotExist(err) && path != rootDir {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		runtime, id, ok := ParseContainerDir(d.Name())
+		if !ok {
+			return nil
+		}
+
+		c, err := readContainer(path, opts)
+		if err != nil {
+			return err
+		}
+		c.ID = id
+		c.Runtime = runtime
+		containers = append(containers, c)
+
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %w", rootDir, err)
+	}
+
+	return containers, nil
+}
+
+// readContainer collects the PIDs (and optionally TIDs) of a container cgroup
+// and all of its descendants.
+func readContainer(dir string, opts WalkOptions) (Container, error) {
+	c := Container{Cgroup: dir}
+	pids := map[int]bool{}
+	tids := map[int]bool{}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		if err := readIDsInto(filepath.Join(path, "cgroup.procs"), pids); err != nil {
+			return err
+		}
+		if opts.Threads {
+			threads := filepath.Join(path, "cgroup.threads")
+			if _, err := os.Stat(threads); err != nil {
+				// cgroup v1 lists threads in "tasks".
+				threads = filepath.Join(path, "tasks")
+			}
+			if err := readIDsInto(threads, tids); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c, err
+	}
+
+	c.PIDs = sortedKeys(pids)
+	if opts.Threads {
+		c.TIDs = sortedKeys(tids)
+	}
+	if opts.Stats {
+		// Stats of a cgroup already include its descendants.
+		c.Stats, err = ReadCgroupStats(dir)
+		if err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// ReadIDs reads a newline separated list of PIDs or TIDs such as cgroup.procs.
+func ReadIDs(path string) ([]int, error) {
+	ids := map[int]bool{}
+	if err := readIDsInto(path, ids); err != nil {
+		return nil, err
+	}
+	return sortedKeys(ids), nil
+}
+
+func readIDsInto(path string, ids map[int]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		id, err := strconv.Atoi(line)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		ids[id] = true
+	}
+	return nil
+}
+
+func sortedKeys(m map[int]bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// GetRootCgroupPath finds the root cgroup mount point (supports both v1 and v2)
+func GetRootCgroupPath() (string, error) {
+	// Open /proc/mounts to find the cgroup mount point
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", fmt.Errorf("failed to open /proc/mounts: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+
+		mountPoint := fields[1]
+		fsType := fields[2]
+
+		// Check for cgroup v2 (unified hierarchy)
+		if fsType == "cgroup2" {
+			return mountPoint, nil
+		}
+
+		// Check for cgroup v1 (separate controllers)
+		if fsType == "cgroup" {
+			return mountPoint, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("error reading /proc/mounts: %v", err)
+	}
+
+	return "", fmt.Errorf("cgroup root not found")
+}
+
+// PodCgroupDir returns the directory of a pod cgroup given the cgroup parent
+// reported by the runtime. The systemd driver reports a bare slice name such
+// as "kubepods-burstable-pod<uid>.slice", which is expanded to its nested
+// location under the cgroup root.
+func PodCgroupDir(rootCgroupPath, cgroupParent string) string {
+	if strings.Contains(cgroupParent, "/") || !strings.HasSuffix(cgroupParent, ".slice") {
+		return filepath.Join(rootCgroupPath, cgroupParent)
+	}
+
+	name := strings.TrimSuffix(cgroupParent, ".slice")
+	parts := strings.Split(name, "-")
+	dir := rootCgroupPath
+	for i := range parts {
+		dir = filepath.Join(dir, strings.Join(parts[:i+1], "-")+".slice")
+	}
+	return dir
+}
+
+// KubepodsCgroupDir returns the cgroup kubelet places all pods under, for
+// either the systemd ("kubepods.slice") or the cgroupfs ("kubepods") driver.
+func KubepodsCgroupDir(rootCgroupPath string) (string, error) {
+	for _, name := range []string{"kubepods.slice", "kubepods"} {
+		dir := filepath.Join(rootCgroupPath, name)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("no kubepods cgroup found under %s", rootCgroupPath)
+}
+
+// CgroupID returns the ID of a cgroup v2 directory: its inode number, which
+// is what bpf_get_current_cgroup_id() reports for the tasks in it.
+func CgroupID(dir string) (uint64, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no inode number for %s", dir)
+	}
+	return st.Ino, nil
+}
+
+// CgroupsPathDir returns the directory of a container's cgroup given the
+// cgroupsPath of its OCI runtime spec. With the systemd driver the path has
+// the form "<parent slice>:<prefix>:<name>" for the <prefix>-<name>.scope
+// unit in that slice.
+func CgroupsPathDir(rootCgroupPath, cgroupsPath string) string {
+	parts := strings.Split(cgroupsPath, ":")
+	if len(parts) == 3 && strings.HasSuffix(parts[0], ".slice") {
+		return filepath.Join(PodCgroupDir(rootCgroupPath, parts[0]), parts[1]+"-"+parts[2]+".scope")
+	}
+	return filepath.Join(rootCgroupPath, cgroupsPath)
+}
@@ -0,0 +1,265 @@
+// Package cgroupattach attaches cgroup BPF programs, such as cgroup_skb and
+// cgroup/sock, to the cgroup of every pod below the kubepods cgroup. Programs
+// are attached to pods as they start and detached when they go away, so
+// their effect is scoped to pods without touching iptables.
+package cgroupattach
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"podresolver"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// Program is a cgroup program and the hook it attaches to.
+type Program struct {
+	Name    string
+	Program *ebpf.Program
+	Attach  ebpf.AttachType
+}
+
+// Programs returns the cgroup programs of coll, with the attach type spec
+// declares for each through its ELF section.
+func Programs(spec *ebpf.CollectionSpec, coll *ebpf.Collection) []Program {
+	var programs []Program
+	for name, ps := range spec.Programs {
+		switch ps.Type {
+		case ebpf.CGroupSKB, ebpf.CGroupSock, ebpf.CGroupSockAddr, ebpf.CGroupSockopt,
+			ebpf.CGroupSysctl, ebpf.CGroupDevice:
+		default:
+			continue
+		}
+		if prog := coll.Programs[name]; prog != nil {
+			programs = append(programs, Program{Name: name, Program: prog, Attach: ps.AttachType})
+		}
+	}
+	sort.Slice(programs, func(i, j int) bool { return programs[i].Name < programs[j].Name })
+	return programs
+}
+
+// Pod is a pod the programs are attached to. CgroupID is the ID of the pod
+// cgroup, which is also the key of its BPF cgroup storage.
+type Pod struct {
+	UID      string
+	Cgroup   string
+	CgroupID uint64
+}
+
+type attachment struct {
+	pod   Pod
+	links []io.Closer
+}
+
+// attachCgroup attaches a program to a cgroup. Tests replace it.
+func attachCgroup(opts link.CgroupOptions) (io.Closer, error) {
+	return link.AttachCgroup(opts)
+}
+
+// Attacher keeps a set of programs attached to every pod cgroup.
+type Attacher struct {
+	programs []Program
+	watcher  *podresolver.Watcher
+	attach   func(link.CgroupOptions) (io.Closer, error)
+
+	mu       sync.Mutex
+	attached map[string]*attachment
+	closed   bool
+}
+
+// New returns an Attacher for the pods below kubepodsDir, which must be on
+// the cgroup v2 hierarchy: programs can only be attached to v2 cgroups.
+func New(kubepodsDir string, programs []Program) (*Attacher, error) {
+	if len(programs) == 0 {
+		return nil, errors.New("no cgroup programs to attach")
+	}
+	if _, err := os.Stat(filepath.Join(kubepodsDir, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not on a cgroup v2 hierarchy", kubepodsDir)
+	}
+
+	// Attaching only needs pod directories, not their PIDs, so the cgroups
+	// are not rescanned.
+	watcher, err := podresolver.NewWatcher(kubepodsDir, podresolver.WatchOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Attacher{
+		programs: programs,
+		watcher:  watcher,
+		attach:   attachCgroup,
+		attached: map[string]*attachment{},
+	}, nil
+}
+
+// Start finds the kubepods cgroup, attaches programs to the pods that exist
+// now and keeps attaching and detaching them in the background until ctx is
+// done. Close detaches everything.
+func Start(ctx context.Context, programs []Program) (*Attacher, error) {
+	root, err := podresolver.GetRootCgroupPath()
+	if err != nil {
+		return nil, err
+	}
+	kubepodsDir, err := podresolver.KubepodsCgroupDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := New(kubepodsDir, programs)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Sync(); err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	go func() {
+		if err := a.Run(ctx); err != nil {
+			log.Printf("cgroupattach: %v\n", err)
+		}
+	}()
+	return a, nil
+}
+
+// Sync attaches the programs to pods that don't have them yet and detaches
+// them from pods that went away. A pod that fails to attach is skipped and
+// retried on the next sync.
+func (a *Attacher) Sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+
+	pods := map[string]podresolver.Pod{}
+	for _, pod := range a.watcher.Pods() {
+		pods[pod.UID] = pod
+	}
+
+	for uid, att := range a.attached {
+		if pod, ok := pods[uid]; ok && pod.Cgroup == att.pod.Cgroup {
+			continue
+		}
+		att.close()
+		delete(a.attached, uid)
+	}
+
+	var errs []error
+	for uid, pod := range pods {
+		if _, ok := a.attached[uid]; ok {
+			continue
+		}
+		att, err := a.attachPod(pod)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		a.attached[uid] = att
+	}
+
+	return errors.Join(errs...)
+}
+
+// attachPod attaches every program to the cgroup of pod, undoing the
+// attachments already made if one fails.
+func (a *Attacher) attachPod(pod podresolver.Pod) (*attachment, error) {
+	id, err := podresolver.CgroupID(pod.Cgroup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cgroup ID of pod %s: %w", pod.UID, err)
+	}
+
+	att := &attachment{pod: Pod{UID: pod.UID, Cgroup: pod.Cgroup, CgroupID: id}}
+	for _, p := range a.programs {
+		l, err := a.attach(link.CgroupOptions{
+			Path:    pod.Cgroup,
+			Attach:  p.Attach,
+			Program: p.Program,
+		})
+		if err != nil {
+			att.close()
+			return nil, fmt.Errorf("failed to attach %s to pod %s: %w", p.Name, pod.UID, err)
+		}
+		att.links = append(att.links, l)
+	}
+	return att, nil
+}
+
+func (att *attachment) close() {
+	for _, l := range att.links {
+		l.Close()
+	}
+	att.links = nil
+}
+
+// Run attaches and detaches programs as pods come and go until ctx is done.
+func (a *Attacher) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watchErr := make(chan error, 1)
+	go func() { watchErr <- a.watcher.Run(ctx) }()
+
+	// Pods that failed to attach, e.g. because their cgroup was still being
+	// set up, are retried on this interval.
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	events := a.watcher.Events()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watchErr:
+			return err
+		case <-ticker.C:
+		case e, ok := <-events:
+			if !ok {
+				return <-watchErr
+			}
+			if e.Type != podresolver.PodAdded && e.Type != podresolver.PodRemoved {
+				continue
+			}
+		}
+		if err := a.Sync(); err != nil && ctx.Err() == nil {
+			log.Printf("cgroupattach: %v\n", err)
+		}
+	}
+}
+
+// Pods returns the pods the programs are attached to, ordered by UID.
+func (a *Attacher) Pods() []Pod {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pods := make([]Pod, 0, len(a.attached))
+	for _, att := range a.attached {
+		pods = append(pods, att.pod)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].UID < pods[j].UID })
+	return pods
+}
+
+// Close detaches the programs from every pod and stops watching for pods,
+// which also ends Run.
+func (a *Attacher) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for uid, att := range a.attached {
+		att.close()
+		delete(a.attached, uid)
+	}
+	a.closed = true
+	return a.watcher.Close()
+}
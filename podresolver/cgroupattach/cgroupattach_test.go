@@ -0,0 +1,266 @@
+package cgroupattach
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"podresolver"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+func TestPrograms(t *testing.T) {
+	spec := &ebpf.CollectionSpec{Programs: map[string]*ebpf.ProgramSpec{
+		"ingress":    {Type: ebpf.CGroupSKB, AttachType: ebpf.AttachCGroupInetIngress},
+		"egress":     {Type: ebpf.CGroupSKB, AttachType: ebpf.AttachCGroupInetEgress},
+		"connect4":   {Type: ebpf.CGroupSockAddr, AttachType: ebpf.AttachCGroupInet4Connect},
+		"sock":       {Type: ebpf.CGroupSock, AttachType: ebpf.AttachCGroupInetSockCreate},
+		"devices":    {Type: ebpf.CGroupDevice, AttachType: ebpf.AttachCGroupDevice},
+		"trace_exec": {Type: ebpf.TracePoint},
+		"xdp_drop":   {Type: ebpf.XDP, AttachType: ebpf.AttachXDP},
+		// Removed from the collection, e.g. by proctree.Remove
+		"not_loaded": {Type: ebpf.CGroupSKB, AttachType: ebpf.AttachCGroupInetIngress},
+	}}
+	coll := &ebpf.Collection{Programs: map[string]*ebpf.Program{}}
+	for name := range spec.Programs {
+		if name != "not_loaded" {
+			coll.Programs[name] = &ebpf.Program{}
+		}
+	}
+
+	var got []string
+	for _, p := range Programs(spec, coll) {
+		if p.Program != coll.Programs[p.Name] || p.Attach != spec.Programs[p.Name].AttachType {
+			t.Errorf("%s: got %+v", p.Name, p)
+		}
+		got = append(got, p.Name)
+	}
+	if want := []string{"connect4", "devices", "egress", "ingress", "sock"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Programs = %v, want %v", got, want)
+	}
+}
+
+// fakeAttacher records attachments in place of link.AttachCgroup.
+type fakeAttacher struct {
+	mu       sync.Mutex
+	attached map[string]int // cgroup/attach type → live attachments
+	fail     bool           // fail to attach egress programs
+}
+
+type fakeLink struct {
+	f   *fakeAttacher
+	key string
+}
+
+func (l fakeLink) Close() error {
+	l.f.mu.Lock()
+	defer l.f.mu.Unlock()
+	l.f.attached[l.key]--
+	if l.f.attached[l.key] == 0 {
+		delete(l.f.attached, l.key)
+	}
+	return nil
+}
+
+func (f *fakeAttacher) attach(opts link.CgroupOptions) (io.Closer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail && opts.Attach == ebpf.AttachCGroupInetEgress {
+		return nil, errors.New("operation not permitted")
+	}
+	key := opts.Path + "/" + opts.Attach.String()
+	f.attached[key]++
+	return fakeLink{f, key}, nil
+}
+
+// links returns the live attachments, relative to root.
+func (f *fakeAttacher) links(root string) map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	links := map[string]int{}
+	for key, n := range f.attached {
+		links[strings.TrimPrefix(key, root+"/")] = n
+	}
+	return links
+}
+
+// fakeKubepods returns a directory that passes for a cgroup v2 kubepods
+// cgroup.
+func fakeKubepods(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory pids\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func mkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestAttacher returns an Attacher of an egress and a connect program
+// whose attachments are recorded by the returned fakeAttacher.
+func newTestAttacher(t *testing.T, root string) (*Attacher, *fakeAttacher) {
+	t.Helper()
+	programs := []Program{
+		{Name: "connect4", Program: &ebpf.Program{}, Attach: ebpf.AttachCGroupInet4Connect},
+		{Name: "egress", Program: &ebpf.Program{}, Attach: ebpf.AttachCGroupInetEgress},
+	}
+	a, err := New(root, programs)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+	f := &fakeAttacher{attached: map[string]int{}}
+	a.attach = f.attach
+	return a, f
+}
+
+// waitFor reads watcher events until one of type typ for uid arrives.
+func waitFor(t *testing.T, events <-chan podresolver.Event, typ podresolver.EventType, uid string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ && e.PodUID == uid {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s of %s", typ, uid)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(t.TempDir(), []Program{{Name: "ingress"}}); err == nil {
+		t.Error("New accepted a directory that isn't a cgroup v2 hierarchy")
+	}
+	if _, err := New(fakeKubepods(t), nil); err == nil {
+		t.Error("New accepted no programs")
+	}
+}
+
+func TestSync(t *testing.T) {
+	const (
+		webUID = "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81"
+		dbUID  = "3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d"
+	)
+	root := fakeKubepods(t)
+	burstable := "kubepods-burstable.slice/kubepods-burstable-pod6f1c2a34_8b1d_4e2f_9a7c_0d3e5b6a7c81.slice"
+	besteffort := "kubepods-besteffort.slice/kubepods-besteffort-pod6f1c2a34_8b1d_4e2f_9a7c_0d3e5b6a7c81.slice"
+	db := "kubepods-burstable.slice/kubepods-burstable-pod3b2a1c0d_9e8f_4a7b_6c5d_4e3f2a1b0c9d.slice"
+	mkdir(t, filepath.Join(root, burstable))
+
+	a, f := newTestAttacher(t, root)
+	attached := func(dir string) map[string]int {
+		return map[string]int{dir + "/CGroupInet4Connect": 1, dir + "/CGroupInetEgress": 1}
+	}
+
+	if err := a.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if want := attached(burstable); !reflect.DeepEqual(f.links(root), want) {
+		t.Errorf("links = %v, want %v", f.links(root), want)
+	}
+	pods := a.Pods()
+	if len(pods) != 1 || pods[0].UID != webUID || pods[0].Cgroup != filepath.Join(root, burstable) || pods[0].CgroupID == 0 {
+		t.Errorf("Pods = %+v", pods)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.watcher.Run(ctx)
+	events := a.watcher.Events()
+
+	// The same pod UID in another cgroup is attached there instead
+	if err := os.Remove(filepath.Join(root, burstable)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, events, podresolver.PodRemoved, webUID)
+	mkdir(t, filepath.Join(root, besteffort))
+	waitFor(t, events, podresolver.PodAdded, webUID)
+	if err := a.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if want := attached(besteffort); !reflect.DeepEqual(f.links(root), want) {
+		t.Errorf("links after move = %v, want %v", f.links(root), want)
+	}
+
+	// A pod that fails to attach keeps none of its links and is retried
+	f.fail = true
+	mkdir(t, filepath.Join(root, db))
+	waitFor(t, events, podresolver.PodAdded, dbUID)
+	if err := a.Sync(); err == nil {
+		t.Error("Sync succeeded although attaching failed")
+	}
+	if want := attached(besteffort); !reflect.DeepEqual(f.links(root), want) {
+		t.Errorf("links after failure = %v, want %v", f.links(root), want)
+	}
+	f.fail = false
+	if err := a.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if got := len(a.Pods()); got != 2 {
+		t.Errorf("%d pods attached after retry, want 2", got)
+	}
+
+	// Pods that went away are detached
+	if err := os.Remove(filepath.Join(root, besteffort)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, events, podresolver.PodRemoved, webUID)
+	if err := a.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if want := attached(db); !reflect.DeepEqual(f.links(root), want) {
+		t.Errorf("links after removal = %v, want %v", f.links(root), want)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if links := f.links(root); len(links) != 0 {
+		t.Errorf("links after Close = %v", links)
+	}
+}
+
+func TestCloseWithoutRun(t *testing.T) {
+	root := fakeKubepods(t)
+	mkdir(t, filepath.Join(root, "kubepods-pod6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81"))
+	a, f := newTestAttacher(t, root)
+	if err := a.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if links := f.links(root); len(links) != 0 {
+		t.Errorf("links after Close = %v", links)
+	}
+
+	// The watcher is closed too, so Run has nothing to do
+	done := make(chan error, 1)
+	go func() { done <- a.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run after Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run kept running after Close")
+	}
+}
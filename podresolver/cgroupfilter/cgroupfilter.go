@@ -0,0 +1,296 @@
+// Package cgroupfilter pushes a pod selector into the kernel. It keeps the
+// cgroup_filter map declared in headers/cgroup_filter.h filled with the cgroup
+// IDs of the selected pods, so BPF programs can drop events from every other
+// task before doing any work.
+package cgroupfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"podresolver"
+
+	"github.com/cilium/ebpf"
+)
+
+const (
+	// MapName is the name of the filter map in the BPF object.
+	MapName = "cgroup_filter"
+	// EnableConstant is the constant that turns the filter on.
+	EnableConstant = "filter_cgroup"
+)
+
+// Enable turns the filter on in spec. It must be called before the
+// collection is created; without it programs trace every task.
+func Enable(spec *ebpf.CollectionSpec) error {
+	if _, ok := spec.Maps[MapName]; !ok {
+		return fmt.Errorf("%s map not found, was the program built with cgroup_filter.h?", MapName)
+	}
+	if err := spec.RewriteConstants(map[string]interface{}{EnableConstant: uint8(1)}); err != nil {
+		return fmt.Errorf("failed to enable cgroup filter: %w", err)
+	}
+	return nil
+}
+
+// filterMap is the part of *ebpf.Map a Filter writes to. Tests replace it.
+type filterMap interface {
+	Put(key, value interface{}) error
+	Delete(key interface{}) error
+}
+
+// Filter keeps the filter map in sync with the pods matching a selector.
+type Filter struct {
+	m        filterMap
+	lister   podresolver.PodLister
+	selector podresolver.Selector
+	watcher  *podresolver.Watcher
+
+	mu       sync.Mutex
+	selected map[string]podresolver.KubePod
+	ids      map[uint64]string
+}
+
+// New returns a Filter writing to m. Pods are found with lister and matched
+// against selector, and their cgroups are looked up below kubepodsDir, which
+// must be on the cgroup v2 hierarchy: bpf_get_current_cgroup_id() only
+// reports v2 cgroup IDs.
+func New(m *ebpf.Map, kubepodsDir string, lister podresolver.PodLister, selector podresolver.Selector) (*Filter, error) {
+	if _, err := os.Stat(filepath.Join(kubepodsDir, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not on a cgroup v2 hierarchy", kubepodsDir)
+	}
+
+	watcher, err := podresolver.NewWatcher(kubepodsDir, podresolver.WatchOptions{Resync: 2 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{
+		m:        m,
+		lister:   lister,
+		selector: selector,
+		watcher:  watcher,
+		selected: map[string]podresolver.KubePod{},
+		ids:      map[uint64]string{},
+	}, nil
+}
+
+// Start finds the kubepods cgroup, fills m with the cgroups of the pods
+// crictl reports as matching selector and keeps it up to date in the
+// background until ctx is done.
+func Start(ctx context.Context, m *ebpf.Map, selector podresolver.Selector) (*Filter, error) {
+	root, err := podresolver.GetRootCgroupPath()
+	if err != nil {
+		return nil, err
+	}
+	kubepodsDir, err := podresolver.KubepodsCgroupDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := New(m, kubepodsDir, podresolver.Crictl{}, selector)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Sync(ctx); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := f.Run(ctx, 10*time.Second); err != nil {
+			log.Printf("cgroupfilter: %v\n", err)
+		}
+	}()
+	return f, nil
+}
+
+// Sync lists the pods, matches them against the selector and updates the map.
+func (f *Filter) Sync(ctx context.Context) error {
+	pods, err := f.lister.ListPods(ctx)
+	if err != nil {
+		return err
+	}
+
+	selected := map[string]podresolver.KubePod{}
+	for _, pod := range pods {
+		if f.selector.Matches(pod) {
+			selected[pod.UID] = pod
+		}
+	}
+
+	f.mu.Lock()
+	f.selected = selected
+	f.mu.Unlock()
+
+	return f.update()
+}
+
+// Run keeps the map up to date until ctx is done. Cgroups of selected pods
+// are added as soon as the watcher sees them; the pod list is refreshed
+// every resync interval and whenever an unknown pod appears, which is how
+// new pods and label changes are picked up.
+func (f *Filter) Run(ctx context.Context, resync time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watchErr := make(chan error, 1)
+	go func() { watchErr <- f.watcher.Run(ctx) }()
+
+	ticker := time.NewTicker(resync)
+	defer ticker.Stop()
+
+	events := f.watcher.Events()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watchErr:
+			return err
+		case <-ticker.C:
+			err = f.Sync(ctx)
+		case e, ok := <-events:
+			if !ok {
+				return <-watchErr
+			}
+			relist := f.unknownPod(e)
+			// Coalesce a burst of events, e.g. from a pod starting, into
+			// one update.
+			for drained := false; !drained; {
+				select {
+				case e, ok := <-events:
+					if !ok {
+						drained = true
+						break
+					}
+					relist = relist || f.unknownPod(e)
+				default:
+					drained = true
+				}
+			}
+			if relist {
+				err = f.Sync(ctx)
+			} else {
+				err = f.update()
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("cgroupfilter: %v\n", err)
+		}
+	}
+}
+
+// unknownPod reports whether e is about a pod the last listing didn't have.
+func (f *Filter) unknownPod(e podresolver.Event) bool {
+	if e.Type != podresolver.PodAdded {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.selected[e.PodUID]
+	return !ok
+}
+
+// update writes the cgroup IDs of the selected pods to the map and removes
+// those of pods that went away or no longer match.
+func (f *Filter) update() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ids := map[uint64]string{}
+	for _, pod := range f.watcher.Pods() {
+		if _, ok := f.selected[pod.UID]; !ok {
+			continue
+		}
+		if err := cgroupIDs(pod.Cgroup, ids); err != nil {
+			return err
+		}
+	}
+
+	for id, dir := range ids {
+		if _, ok := f.ids[id]; ok {
+			continue
+		}
+		if err := f.m.Put(id, uint8(1)); err != nil {
+			return fmt.Errorf("failed to add cgroup %s: %w", dir, err)
+		}
+		f.ids[id] = dir
+	}
+
+	for id, dir := range f.ids {
+		if _, ok := ids[id]; ok {
+			continue
+		}
+		if err := f.m.Delete(id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to remove cgroup %s: %w", dir, err)
+		}
+		delete(f.ids, id)
+	}
+
+	return nil
+}
+
+// cgroupIDs adds the ID of dir and every cgroup below it to ids. The ID of a
+// cgroup v2 directory is its inode number.
+func cgroupIDs(dir string, ids map[uint64]string) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Cgroups disappear while we walk them.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			ids[st.Ino] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk %s: %w", dir, err)
+	}
+	return nil
+}
+
+// Pods returns the pods currently selected, ordered by namespace and name.
+func (f *Filter) Pods() []podresolver.KubePod {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pods := make([]podresolver.KubePod, 0, len(f.selected))
+	for _, pod := range f.selected {
+		pods = append(pods, pod)
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return pods
+}
+
+// Cgroups returns the number of cgroups currently in the map.
+func (f *Filter) Cgroups() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.ids)
+}
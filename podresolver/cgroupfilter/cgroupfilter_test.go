@@ -0,0 +1,195 @@
+package cgroupfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"podresolver"
+
+	"github.com/cilium/ebpf"
+)
+
+// fakeMap records the cgroup IDs a Filter writes in place of the BPF map.
+type fakeMap struct {
+	ids     map[uint64]bool
+	puts    int
+	deletes int
+	fail    error // returned by Put
+}
+
+func (m *fakeMap) Put(key, value interface{}) error {
+	if m.fail != nil {
+		return m.fail
+	}
+	m.puts++
+	m.ids[key.(uint64)] = true
+	return nil
+}
+
+func (m *fakeMap) Delete(key interface{}) error {
+	m.deletes++
+	if !m.ids[key.(uint64)] {
+		return ebpf.ErrKeyNotExist
+	}
+	delete(m.ids, key.(uint64))
+	return nil
+}
+
+// fakeLister returns pods, or err.
+type fakeLister struct {
+	pods []podresolver.KubePod
+	err  error
+}
+
+func (l *fakeLister) ListPods(ctx context.Context) ([]podresolver.KubePod, error) {
+	return l.pods, l.err
+}
+
+// podDir creates the cgroup of the pod with uid, and of its containers,
+// below root and returns it.
+func podDir(t *testing.T, root, uid string, containers ...string) string {
+	t.Helper()
+	dir := filepath.Join(root, "kubepods-burstable.slice", fmt.Sprintf("kubepods-burstable-pod%s.slice", uid))
+	for _, c := range append([]string{""}, containers...) {
+		if err := os.MkdirAll(filepath.Join(dir, c), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// ids returns the cgroup IDs of dirs.
+func ids(t *testing.T, dirs ...string) map[uint64]bool {
+	t.Helper()
+	ids := map[uint64]bool{}
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[info.Sys().(*syscall.Stat_t).Ino] = true
+	}
+	return ids
+}
+
+func TestSync(t *testing.T) {
+	const (
+		apiUID = "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81"
+		webUID = "3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d"
+	)
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory pids\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	apiDir := podDir(t, root, "6f1c2a34_8b1d_4e2f_9a7c_0d3e5b6a7c81", "cri-containerd-4a3b2c1d0e9f.scope")
+	webDir := podDir(t, root, "3b2a1c0d_9e8f_4a7b_6c5d_4e3f2a1b0c9d", "cri-containerd-9e8d7c6b5a4f.scope")
+
+	api := podresolver.KubePod{UID: apiUID, Namespace: "payments", Name: "api-5d8f7", Labels: map[string]string{"app": "api"}}
+	web := podresolver.KubePod{UID: webUID, Namespace: "payments", Name: "web-9c2b1", Labels: map[string]string{"app": "web"}}
+	lister := &fakeLister{pods: []podresolver.KubePod{api, web}}
+	selector, err := podresolver.ParseSelector("payments", "app=api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := New(nil, root, lister, selector)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer f.watcher.Close()
+	m := &fakeMap{ids: map[uint64]bool{}}
+	f.m = m
+	ctx := context.Background()
+
+	check := func(step string, wantIDs map[uint64]bool, wantPods ...string) {
+		t.Helper()
+		if !reflect.DeepEqual(m.ids, wantIDs) {
+			t.Errorf("%s: map = %v, want %v", step, m.ids, wantIDs)
+		}
+		if f.Cgroups() != len(wantIDs) {
+			t.Errorf("%s: Cgroups = %d, want %d", step, f.Cgroups(), len(wantIDs))
+		}
+		var pods []string
+		for _, pod := range f.Pods() {
+			pods = append(pods, pod.Name)
+		}
+		if !reflect.DeepEqual(pods, wantPods) {
+			t.Errorf("%s: Pods = %v, want %v", step, pods, wantPods)
+		}
+	}
+
+	// The selected pod and its containers
+	if err := f.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	check("first sync", ids(t, apiDir, filepath.Join(apiDir, "cri-containerd-4a3b2c1d0e9f.scope")), "api-5d8f7")
+
+	// Nothing changed, nothing is written
+	puts, deletes := m.puts, m.deletes
+	if err := f.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if m.puts != puts || m.deletes != deletes {
+		t.Errorf("unchanged sync made %d puts and %d deletes", m.puts-puts, m.deletes-deletes)
+	}
+
+	// New containers of a selected pod are added
+	sidecar := filepath.Join(apiDir, "cri-containerd-1f0e2d3c4b5a.scope")
+	if err := os.Mkdir(sidecar, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	check("new container", ids(t, apiDir, filepath.Join(apiDir, "cri-containerd-4a3b2c1d0e9f.scope"), sidecar), "api-5d8f7")
+	if m.puts != puts+1 {
+		t.Errorf("new container made %d puts, want 1", m.puts-puts)
+	}
+
+	// A label change swaps the pods
+	api.Labels = map[string]string{"app": "api-old"}
+	web.Labels = map[string]string{"app": "api"}
+	lister.pods = []podresolver.KubePod{api, web}
+	if err := f.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	check("relabel", ids(t, webDir, filepath.Join(webDir, "cri-containerd-9e8d7c6b5a4f.scope")), "web-9c2b1")
+
+	// A failed listing leaves the map alone
+	lister.err = errors.New("connection refused")
+	if err := f.Sync(ctx); err == nil {
+		t.Error("Sync succeeded although listing failed")
+	}
+	check("list error", ids(t, webDir, filepath.Join(webDir, "cri-containerd-9e8d7c6b5a4f.scope")), "web-9c2b1")
+	lister.err = nil
+
+	// Cgroups that failed to be added are retried by the next Sync
+	api.Labels = map[string]string{"app": "api"}
+	lister.pods = []podresolver.KubePod{api, web}
+	m.fail = errors.New("no space left on device")
+	if err := f.Sync(ctx); err == nil {
+		t.Error("Sync succeeded although the map is full")
+	}
+	m.fail = nil
+	if err := f.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	check("retry", ids(t, apiDir, filepath.Join(apiDir, "cri-containerd-4a3b2c1d0e9f.scope"), sidecar,
+		webDir, filepath.Join(webDir, "cri-containerd-9e8d7c6b5a4f.scope")), "api-5d8f7", "web-9c2b1")
+
+	// Cgroups deleted from the map behind our back don't fail the removal
+	for id := range ids(t, webDir) {
+		delete(m.ids, id)
+	}
+	lister.pods = []podresolver.KubePod{api}
+	if err := f.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	check("pod gone", ids(t, apiDir, filepath.Join(apiDir, "cri-containerd-4a3b2c1d0e9f.scope"), sidecar), "api-5d8f7")
+}
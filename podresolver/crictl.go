@@ -0,0 +1,97 @@
+package podresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// Crictl looks up container metadata with crictl.
+type Crictl struct {
+	// Path of the crictl binary. Defaults to "crictl" on $PATH.
+	Path string
+}
+
+// crictlInspectResponse is the part of `crictl inspect` output we use.
+type crictlInspectResponse struct {
+	Status struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Image struct {
+			Image string `json:"image"`
+		} `json:"image"`
+		Labels map[string]string `json:"labels"`
+	} `json:"status"`
+}
+
+// ContainerMetadata implements MetadataSource.
+func (c Crictl) ContainerMetadata(containerID string) (Metadata, error) {
+	path := c.Path
+	if path == "" {
+		path = "crictl"
+	}
+
+	output, err := exec.Command(path, "inspect", "-o", "json", containerID).Output()
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+
+	var resp crictlInspectResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return Metadata{}, fmt.Errorf("failed to parse crictl inspect output: %w", err)
+	}
+
+	labels := resp.Status.Labels
+	return Metadata{
+		PodName:       labels["io.kubernetes.pod.name"],
+		PodNamespace:  labels["io.kubernetes.pod.namespace"],
+		PodUID:        labels["io.kubernetes.pod.uid"],
+		ContainerName: resp.Status.Metadata.Name,
+		Image:         resp.Status.Image.Image,
+	}, nil
+}
+
+// crictlPodsResponse is the part of `crictl pods` output we use.
+type crictlPodsResponse struct {
+	Items []struct {
+		ID       string `json:"id"`
+		Metadata struct {
+			Name      string `json:"name"`
+			UID       string `json:"uid"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Labels map[string]string `json:"labels"`
+	} `json:"items"`
+}
+
+// ListPods implements PodLister with the ready pod sandboxes of the runtime.
+// Containers are not listed.
+func (c Crictl) ListPods(ctx context.Context) ([]KubePod, error) {
+	path := c.Path
+	if path == "" {
+		path = "crictl"
+	}
+
+	output, err := exec.CommandContext(ctx, path, "pods", "--state", "ready", "-o", "json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var resp crictlPodsResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse crictl pods output: %w", err)
+	}
+
+	var pods []KubePod
+	for _, item := range resp.Items {
+		pods = append(pods, KubePod{
+			UID:       item.Metadata.UID,
+			Namespace: item.Metadata.Namespace,
+			Name:      item.Metadata.Name,
+			Labels:    item.Labels,
+		})
+	}
+	return pods, nil
+}
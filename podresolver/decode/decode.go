@@ -0,0 +1,89 @@
+// Package decode turns raw BPF event records into Go structs without the
+// reflection and per-event allocations of binary.Read.
+//
+// A Decoder copies the record straight over the struct, so the struct must
+// have the same layout as the C one: fields in the same order, of the same
+// sizes, and no padding Go would add where C doesn't. NewDecoder checks this
+// once. Events are in host byte order, which is also what the copy gives.
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// Decoder decodes records into a T.
+type Decoder[T any] struct {
+	// size is the packed size of T, which a record must at least have.
+	size int
+}
+
+// NewDecoder returns a Decoder for T, or an error if T can't be decoded by
+// copying.
+func NewDecoder[T any]() (Decoder[T], error) {
+	typ := reflect.TypeFor[T]()
+	size := binary.Size(reflect.New(typ).Interface())
+	if size < 0 {
+		return Decoder[T]{}, fmt.Errorf("%s has no fixed size", typ)
+	}
+	if err := checkLayout(typ, 0); err != nil {
+		return Decoder[T]{}, fmt.Errorf("%s: %w", typ, err)
+	}
+	return Decoder[T]{size: size}, nil
+}
+
+// MustDecoder is like NewDecoder but panics on error, for package-level
+// variables.
+func MustDecoder[T any]() Decoder[T] {
+	d, err := NewDecoder[T]()
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// checkLayout makes sure every field of typ, which starts at offset, is
+// where binary.Read would put it. Only padding at the end is allowed.
+func checkLayout(typ reflect.Type, offset uintptr) error {
+	switch typ.Kind() {
+	case reflect.Struct:
+		packed := offset
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if offset+f.Offset != packed {
+				return fmt.Errorf("field %s is at offset %d, not %d: add explicit padding", f.Name, offset+f.Offset, packed)
+			}
+			if err := checkLayout(f.Type, packed); err != nil {
+				return err
+			}
+			packed += uintptr(binary.Size(reflect.New(f.Type).Elem().Interface()))
+		}
+	case reflect.Array:
+		elem := uintptr(binary.Size(reflect.New(typ.Elem()).Elem().Interface()))
+		if typ.Len() > 0 && typ.Elem().Size() != elem {
+			return fmt.Errorf("elements of %s are padded", typ)
+		}
+		if typ.Len() > 0 {
+			return checkLayout(typ.Elem(), offset)
+		}
+	}
+	return nil
+}
+
+// Size returns the number of bytes Decode reads, the packed size of T.
+func (d Decoder[T]) Size() int {
+	return d.size
+}
+
+// Decode copies the start of raw into dst. Bytes past Size, like the
+// variable-length tail of some events, are left for the caller. It doesn't
+// allocate.
+func (d Decoder[T]) Decode(raw []byte, dst *T) error {
+	if len(raw) < d.size {
+		return fmt.Errorf("event too short: %d bytes, want %d", len(raw), d.size)
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(dst)), d.size), raw)
+	return nil
+}
@@ -0,0 +1,169 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// sample has the layout of a typical event: no padding inside, and none
+// needed at the end either.
+type sample struct {
+	PID      uint32
+	Flags    int32
+	Ts       uint64
+	Comm     [16]byte
+	Filename [64]byte
+}
+
+func TestNewDecoder(t *testing.T) {
+	type trailing struct {
+		Ts  uint64
+		PID uint32
+	}
+	type inner struct {
+		A uint8
+		B uint32
+	}
+	type explicit struct {
+		A   uint8
+		Pad [3]uint8
+		B   uint32
+	}
+
+	tests := []struct {
+		name    string
+		newFunc func() (int, error)
+		size    int
+		err     string
+	}{
+		{"packed", sizeOf[sample], 96, ""},
+		// Go pads trailing to 16 bytes, but only 12 are read
+		{"trailing padding", sizeOf[trailing], 12, ""},
+		{"explicit padding", sizeOf[explicit], 8, ""},
+		{"padding between fields", sizeOf[struct {
+			A uint8
+			B uint32
+		}], 0, "field B is at offset 4, not 1"},
+		{"padding in nested struct", sizeOf[struct {
+			Ts    uint64
+			Inner inner
+		}], 0, "field B is at offset 12, not 9"},
+		{"padded array elements", sizeOf[struct {
+			Items [2]trailing
+		}], 0, "are padded"},
+		{"no fixed size", sizeOf[struct {
+			Args []byte
+		}], 0, "no fixed size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := tt.newFunc()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if size != tt.size {
+				t.Errorf("got size %d, want %d", size, tt.size)
+			}
+		})
+	}
+}
+
+// sizeOf returns the size of a new Decoder for T.
+func sizeOf[T any]() (int, error) {
+	d, err := NewDecoder[T]()
+	return d.Size(), err
+}
+
+func TestMustDecoderPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("MustDecoder didn't panic for a padded struct")
+		}
+	}()
+	MustDecoder[struct {
+		A uint8
+		B uint64
+	}]()
+}
+
+func TestDecode(t *testing.T) {
+	want := sample{PID: 4242, Flags: -1, Ts: 1 << 40}
+	copy(want.Comm[:], "cat")
+	copy(want.Filename[:], "/etc/passwd")
+	raw := encode(t, &want)
+
+	d := MustDecoder[sample]()
+	var got sample
+	// Bytes past the struct, like execsnoop's arguments, are ignored
+	if err := d.Decode(append(raw, "tail"...), &got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := d.Decode(raw[:len(raw)-1], &got); err == nil {
+		t.Error("Decode of a short record succeeded")
+	}
+}
+
+func TestDecodeAllocs(t *testing.T) {
+	raw := encode(t, &sample{PID: 1})
+	d := MustDecoder[sample]()
+	var e sample
+	allocs := testing.AllocsPerRun(100, func() {
+		d.Decode(raw, &e)
+	})
+	if allocs != 0 {
+		t.Errorf("Decode allocated %.0f times per event, want 0", allocs)
+	}
+}
+
+func encode[T any](tb testing.TB, e *T) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.NativeEndian, e); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// reportRate adds events/s, the unit the tools are compared in.
+func reportRate(b *testing.B) {
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+}
+
+func BenchmarkBinaryRead(b *testing.B) {
+	raw := encode(b, &sample{PID: 4242})
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	var e sample
+	for i := 0; i < b.N; i++ {
+		if err := binary.Read(bytes.NewReader(raw), binary.NativeEndian, &e); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportRate(b)
+}
+
+func BenchmarkDecode(b *testing.B) {
+	raw := encode(b, &sample{PID: 4242})
+	d := MustDecoder[sample]()
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	var e sample
+	for i := 0; i < b.N; i++ {
+		if err := d.Decode(raw, &e); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportRate(b)
+}
@@ -0,0 +1,94 @@
+package podresolver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Docker talks to the Docker Engine API over its unix socket.
+type Docker struct {
+	client *engineClient
+}
+
+// NewDocker returns a Docker client for socket. An empty socket uses
+// /var/run/docker.sock.
+func NewDocker(socket string) *Docker {
+	if socket == "" {
+		socket = "/var/run/docker.sock"
+	}
+	return &Docker{client: newEngineClient(socket, "")}
+}
+
+// dockerContainerJSON is the part of GET /containers/{id}/json we use.
+type dockerContainerJSON struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	State struct {
+		Pid int `json:"Pid"`
+	} `json:"State"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+// ListContainers implements Engine.
+func (d *Docker) ListContainers(ctx context.Context) ([]EngineContainer, error) {
+	// The list doesn't include the PID, so every container is inspected.
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	if err := d.client.get(ctx, "/containers/json", url.Values{"all": {"1"}}, &list); err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var containers []EngineContainer
+	for _, item := range list {
+		c, err := d.InspectContainer(ctx, item.ID)
+		if err != nil {
+			// Removed since it was listed.
+			continue
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// InspectContainer implements Engine.
+func (d *Docker) InspectContainer(ctx context.Context, id string) (EngineContainer, error) {
+	var resp dockerContainerJSON
+	if err := d.client.get(ctx, "/containers/"+url.PathEscape(id)+"/json", nil, &resp); err != nil {
+		return EngineContainer{}, fmt.Errorf("failed to inspect container %s: %w", id, err)
+	}
+
+	return EngineContainer{
+		ID:     resp.ID,
+		Name:   strings.TrimPrefix(resp.Name, "/"),
+		Image:  resp.Config.Image,
+		Labels: resp.Config.Labels,
+		PID:    resp.State.Pid,
+	}, nil
+}
+
+var dockerActions = map[string]EngineEventType{
+	"create":  ContainerCreated,
+	"start":   ContainerStarted,
+	"die":     ContainerDied,
+	"destroy": ContainerRemoved,
+}
+
+// Events implements Engine.
+func (d *Docker) Events(ctx context.Context) (<-chan EngineEvent, <-chan error) {
+	return d.client.events(ctx, "/events", containerFilter("type", "container"), dockerActions)
+}
+
+// ContainerMetadata implements MetadataSource.
+func (d *Docker) ContainerMetadata(containerID string) (Metadata, error) {
+	c, err := d.InspectContainer(context.Background(), containerID)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return c.Metadata(), nil
+}
@@ -0,0 +1,142 @@
+package podresolver
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeDocker serves the containers and inspect endpoints of the Docker
+// Engine API for containers, keyed by ID. listed IDs that aren't in
+// containers are reported as removed on inspect.
+func fakeDocker(t *testing.T, listed []string, containers map[string]dockerContainerJSON) string {
+	t.Helper()
+	return fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/containers/json" {
+			if r.URL.Query().Get("all") != "1" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": "only running containers"})
+				return
+			}
+			var list []map[string]string
+			for _, id := range listed {
+				list = append(list, map[string]string{"Id": id})
+			}
+			writeJSON(w, http.StatusOK, list)
+			return
+		}
+
+		id, ok := strings.CutPrefix(r.URL.Path, "/containers/")
+		if id, ok = strings.CutSuffix(id, "/json"); !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "page not found"})
+			return
+		}
+		c, ok := containers[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "No such container: " + id})
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	}))
+}
+
+func dockerContainer(id, name, image string, pid int, labels map[string]string) dockerContainerJSON {
+	var c dockerContainerJSON
+	c.ID = id
+	c.Name = "/" + name
+	c.State.Pid = pid
+	c.Config.Image = image
+	c.Config.Labels = labels
+	return c
+}
+
+func TestDocker(t *testing.T) {
+	const (
+		redisID = "9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d"
+		nginxID = "4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b"
+		goneID  = "1f0e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"
+	)
+	podLabels := map[string]string{
+		"io.kubernetes.pod.uid":        "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+		"io.kubernetes.pod.name":       "web-7d4b9c-x2x9q",
+		"io.kubernetes.pod.namespace":  "default",
+		"io.kubernetes.container.name": "nginx",
+	}
+	socket := fakeDocker(t, []string{redisID, goneID, nginxID}, map[string]dockerContainerJSON{
+		// Stopped containers have no PID.
+		redisID: dockerContainer(redisID, "cache", "redis:7", 0, nil),
+		nginxID: dockerContainer(nginxID, "k8s_nginx_web-7d4b9c-x2x9q_default_6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81_0", "nginx:1.27", 4242, podLabels),
+	})
+	d := NewDocker(socket)
+
+	redis := EngineContainer{ID: redisID, Name: "cache", Image: "redis:7"}
+	nginx := EngineContainer{
+		ID:     nginxID,
+		Name:   "k8s_nginx_web-7d4b9c-x2x9q_default_6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81_0",
+		Image:  "nginx:1.27",
+		Labels: podLabels,
+		PID:    4242,
+	}
+
+	// The container removed between list and inspect is skipped.
+	containers, err := d.ListContainers(context.Background())
+	if err != nil {
+		t.Fatalf("ListContainers: %v", err)
+	}
+	if want := []EngineContainer{redis, nginx}; !reflect.DeepEqual(containers, want) {
+		t.Errorf("ListContainers = %+v, want %+v", containers, want)
+	}
+
+	tests := []struct {
+		id      string
+		want    EngineContainer
+		meta    Metadata
+		wantErr string
+	}{
+		{id: redisID, want: redis, meta: Metadata{ContainerName: "cache", Image: "redis:7"}},
+		{
+			id:   nginxID,
+			want: nginx,
+			meta: Metadata{
+				PodName:       "web-7d4b9c-x2x9q",
+				PodNamespace:  "default",
+				PodUID:        "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+				ContainerName: "nginx",
+				Image:         "nginx:1.27",
+			},
+		},
+		{id: goneID, wantErr: "No such container"},
+	}
+
+	for _, tt := range tests {
+		c, err := d.InspectContainer(context.Background(), tt.id)
+		md, mdErr := d.ContainerMetadata(tt.id)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("InspectContainer(%s) error = %v, want %q", tt.id, err, tt.wantErr)
+			}
+			if mdErr == nil {
+				t.Errorf("ContainerMetadata(%s) = %+v, want an error", tt.id, md)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("InspectContainer(%s): %v", tt.id, err)
+		} else if !reflect.DeepEqual(c, tt.want) {
+			t.Errorf("InspectContainer(%s) = %+v, want %+v", tt.id, c, tt.want)
+		}
+		if mdErr != nil {
+			t.Errorf("ContainerMetadata(%s): %v", tt.id, mdErr)
+		} else if md != tt.meta {
+			t.Errorf("ContainerMetadata(%s) = %+v, want %+v", tt.id, md, tt.meta)
+		}
+	}
+}
+
+func TestDockerNoEngine(t *testing.T) {
+	d := NewDocker("/nonexistent/docker.sock")
+	if _, err := d.ListContainers(context.Background()); err == nil {
+		t.Error("ListContainers succeeded without an engine")
+	}
+}
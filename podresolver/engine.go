@@ -0,0 +1,208 @@
+package podresolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// EngineContainer is a container as reported by the Docker or Podman API.
+type EngineContainer struct {
+	ID     string
+	Name   string
+	Image  string
+	Labels map[string]string
+	// PodID and PodName are set for containers in a Podman pod.
+	PodID   string
+	PodName string
+	// PID is the container's init process, or 0 if it isn't running.
+	PID int
+}
+
+// Metadata returns what the engine knows about the container. Containers
+// started by a kubelet through cri-dockerd carry the pod in their labels;
+// Podman containers may belong to a Podman pod.
+func (c EngineContainer) Metadata() Metadata {
+	m := Metadata{
+		PodName:       c.PodName,
+		PodUID:        c.PodID,
+		ContainerName: c.Name,
+		Image:         c.Image,
+	}
+	if uid, ok := c.Labels["io.kubernetes.pod.uid"]; ok {
+		m.PodUID = uid
+		m.PodName = c.Labels["io.kubernetes.pod.name"]
+		m.PodNamespace = c.Labels["io.kubernetes.pod.namespace"]
+		if name := c.Labels["io.kubernetes.container.name"]; name != "" {
+			m.ContainerName = name
+		}
+	}
+	return m
+}
+
+// EngineEventType is the kind of container lifecycle event an engine reports.
+type EngineEventType int
+
+const (
+	ContainerCreated EngineEventType = iota
+	ContainerStarted
+	ContainerDied
+	ContainerRemoved
+)
+
+// EngineEvent is a container lifecycle event.
+type EngineEvent struct {
+	Type        EngineEventType
+	ContainerID string
+}
+
+// Engine is a Docker or Podman engine reached over its API socket.
+type Engine interface {
+	// ListContainers returns every container, running or not.
+	ListContainers(ctx context.Context) ([]EngineContainer, error)
+	// InspectContainer returns a single container.
+	InspectContainer(ctx context.Context, id string) (EngineContainer, error)
+	// Events streams container lifecycle events until ctx is done.
+	Events(ctx context.Context) (<-chan EngineEvent, <-chan error)
+}
+
+// engineClient talks HTTP to an engine's unix socket.
+type engineClient struct {
+	prefix string
+	client *http.Client
+}
+
+func newEngineClient(socket, prefix string) *engineClient {
+	return &engineClient{
+		prefix: prefix,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+// do sends a GET request and returns the body of a successful response.
+func (c *engineClient) do(ctx context.Context, path string, query url.Values) (io.ReadCloser, error) {
+	// The host is ignored; every request goes to the socket.
+	u := "http://engine" + c.prefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Message != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, apiErr.Message)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// get decodes the JSON response of a GET request into out.
+func (c *engineClient) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	body, err := c.do(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(out)
+}
+
+// engineEventMessage is the Docker events message, which Podman also uses.
+type engineEventMessage struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID string `json:"ID"`
+	} `json:"Actor"`
+}
+
+// events streams the container events of path, translating actions with
+// actions. Actions not in the map are dropped.
+func (c *engineClient) events(ctx context.Context, path string, query url.Values, actions map[string]EngineEventType) (<-chan EngineEvent, <-chan error) {
+	events := make(chan EngineEvent)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+
+		body, err := c.do(ctx, path, query)
+		if err != nil {
+			errs <- fmt.Errorf("failed to subscribe to events: %w", err)
+			return
+		}
+		defer body.Close()
+
+		dec := json.NewDecoder(body)
+		for {
+			var msg engineEventMessage
+			if err := dec.Decode(&msg); err != nil {
+				if ctx.Err() == nil {
+					errs <- fmt.Errorf("event stream failed: %w", err)
+				}
+				return
+			}
+
+			// Docker appends the command to exec actions ("exec_start: sh").
+			action, _, _ := strings.Cut(msg.Action, ":")
+			t, ok := actions[action]
+			if msg.Type != "container" || !ok {
+				continue
+			}
+
+			select {
+			case events <- EngineEvent{Type: t, ContainerID: msg.Actor.ID}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, errs
+}
+
+// containerFilter is the filters query parameter selecting one container.
+func containerFilter(key, value string) url.Values {
+	filters, _ := json.Marshal(map[string][]string{key: {value}})
+	return url.Values{"filters": {string(filters)}}
+}
+
+// ContainerOfPID returns the container cgroup a process runs in, with every
+// process in it and in its descendant cgroups. cgroupRoot is the cgroup
+// mount point as returned by GetRootCgroupPath.
+func ContainerOfPID(procRoot, cgroupRoot string, pid int) (Container, error) {
+	info, err := ResolvePIDIn(procRoot, pid, nil)
+	if err != nil {
+		return Container{}, err
+	}
+
+	c, err := readContainer(filepath.Join(cgroupRoot, info.Cgroup), WalkOptions{})
+	if err != nil {
+		return Container{}, err
+	}
+	c.ID = info.ContainerID
+	c.Runtime = info.Runtime
+	return c, nil
+}
@@ -0,0 +1,257 @@
+package podresolver
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEngine serves handler on a unix socket and returns its path.
+func fakeEngine(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	// Not t.TempDir(): socket paths are limited to 108 bytes.
+	dir, err := os.MkdirTemp("", "engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "api.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+// writeJSON writes v as the response, or an engine error if status isn't OK.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// streamEvents writes msgs as a stream of JSON messages, then keeps the
+// stream open until the client goes away unless hangup is set.
+func streamEvents(w http.ResponseWriter, r *http.Request, msgs []string, hangup bool) {
+	w.WriteHeader(http.StatusOK)
+	for _, m := range msgs {
+		w.Write([]byte(m + "\n"))
+	}
+	w.(http.Flusher).Flush()
+	if !hangup {
+		<-r.Context().Done()
+	}
+}
+
+// eventMsg is an event message in the format of Docker and Podman.
+func eventMsg(typ, action, id string) string {
+	return `{"Type":"` + typ + `","Action":"` + action + `","Actor":{"ID":"` + id + `","Attributes":{}},"time":1700000000}`
+}
+
+func TestEngineEvents(t *testing.T) {
+	const id = "4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b"
+
+	tests := []struct {
+		name string
+		// newEngine returns the engine for socket, the events path it
+		// subscribes to and the query it must send.
+		newEngine func(socket string) Engine
+		path      string
+		query     map[string]string
+		msgs      []string
+		want      []EngineEvent
+	}{
+		{
+			name:      "docker",
+			newEngine: func(socket string) Engine { return NewDocker(socket) },
+			path:      "/events",
+			query:     map[string]string{"filters": `{"type":["container"]}`},
+			msgs: []string{
+				eventMsg("container", "create", id),
+				eventMsg("container", "start", id),
+				eventMsg("container", "exec_start: sh -c true", id),
+				eventMsg("network", "connect", "bridge"),
+				eventMsg("container", "die", id),
+				eventMsg("container", "destroy", id),
+			},
+			want: []EngineEvent{
+				{ContainerCreated, id},
+				{ContainerStarted, id},
+				{ContainerDied, id},
+				{ContainerRemoved, id},
+			},
+		},
+		{
+			name:      "podman",
+			newEngine: func(socket string) Engine { return NewPodman(socket) },
+			path:      "/v4.0.0/libpod/events",
+			query:     map[string]string{"filters": `{"type":["container"]}`, "stream": "true"},
+			msgs: []string{
+				eventMsg("container", "create", id),
+				eventMsg("container", "init", id),
+				eventMsg("container", "start", id),
+				eventMsg("pod", "start", "3b2a1c0d"),
+				eventMsg("container", "died", id),
+				eventMsg("container", "cleanup", id),
+				eventMsg("container", "remove", id),
+			},
+			want: []EngineEvent{
+				{ContainerCreated, id},
+				{ContainerStarted, id},
+				{ContainerDied, id},
+				{ContainerRemoved, id},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hangup := make(chan bool, 1)
+			socket := fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tt.path {
+					writeJSON(w, http.StatusNotFound, map[string]string{"message": "page not found"})
+					return
+				}
+				for k, v := range tt.query {
+					if got := r.URL.Query().Get(k); got != v {
+						writeJSON(w, http.StatusBadRequest, map[string]string{"message": k + "=" + got})
+						return
+					}
+				}
+				streamEvents(w, r, tt.msgs, <-hangup)
+			}))
+			engine := tt.newEngine(socket)
+
+			// The stream runs until the context is cancelled
+			hangup <- false
+			ctx, cancel := context.WithCancel(context.Background())
+			events, errs := engine.Events(ctx)
+			var got []EngineEvent
+			for len(got) < len(tt.want) {
+				select {
+				case e := <-events:
+					got = append(got, e)
+				case err := <-errs:
+					t.Fatalf("Events: %v", err)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out after %v", got)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+			cancel()
+			for range events {
+			}
+			select {
+			case err := <-errs:
+				t.Errorf("error after cancel: %v", err)
+			default:
+			}
+
+			// or fails when the engine hangs up
+			hangup <- true
+			events, errs = engine.Events(context.Background())
+			for range events {
+			}
+			if err := <-errs; err == nil || !strings.Contains(err.Error(), "event stream failed") {
+				t.Errorf("error after hangup = %v", err)
+			}
+		})
+	}
+}
+
+func TestEngineEventsSubscribeError(t *testing.T) {
+	socket := fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "daemon shutting down"})
+	}))
+
+	events, errs := NewDocker(socket).Events(context.Background())
+	for range events {
+	}
+	err := <-errs
+	if err == nil || !strings.Contains(err.Error(), "daemon shutting down") {
+		t.Errorf("Events error = %v, want the engine's message", err)
+	}
+}
+
+func TestEngineContainerMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		c    EngineContainer
+		want Metadata
+	}{
+		{
+			name: "plain container",
+			c:    EngineContainer{ID: "c1", Name: "redis", Image: "redis:7"},
+			want: Metadata{ContainerName: "redis", Image: "redis:7"},
+		},
+		{
+			name: "podman pod",
+			c:    EngineContainer{ID: "c2", Name: "web-app", Image: "nginx", PodID: "3b2a1c0d", PodName: "web"},
+			want: Metadata{PodName: "web", PodUID: "3b2a1c0d", ContainerName: "web-app", Image: "nginx"},
+		},
+		{
+			name: "cri-dockerd",
+			c: EngineContainer{
+				ID:    "c3",
+				Name:  "k8s_nginx_web-7d4b9c-x2x9q_default_6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81_0",
+				Image: "sha256:3b25b682ea82",
+				Labels: map[string]string{
+					"io.kubernetes.pod.uid":        "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+					"io.kubernetes.pod.name":       "web-7d4b9c-x2x9q",
+					"io.kubernetes.pod.namespace":  "default",
+					"io.kubernetes.container.name": "nginx",
+				},
+			},
+			want: Metadata{
+				PodName:       "web-7d4b9c-x2x9q",
+				PodNamespace:  "default",
+				PodUID:        "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+				ContainerName: "nginx",
+				Image:         "sha256:3b25b682ea82",
+			},
+		},
+		{
+			// The sandbox has no container name label.
+			name: "cri-dockerd sandbox",
+			c: EngineContainer{
+				ID:    "c4",
+				Name:  "k8s_POD_web-7d4b9c-x2x9q_default_6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81_0",
+				Image: "registry.k8s.io/pause:3.9",
+				Labels: map[string]string{
+					"io.kubernetes.pod.uid":       "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+					"io.kubernetes.pod.name":      "web-7d4b9c-x2x9q",
+					"io.kubernetes.pod.namespace": "default",
+				},
+			},
+			want: Metadata{
+				PodName:       "web-7d4b9c-x2x9q",
+				PodNamespace:  "default",
+				PodUID:        "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+				ContainerName: "k8s_POD_web-7d4b9c-x2x9q_default_6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81_0",
+				Image:         "registry.k8s.io/pause:3.9",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.c.Metadata(); got != tt.want {
+			t.Errorf("%s: Metadata() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
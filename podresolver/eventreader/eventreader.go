@@ -0,0 +1,257 @@
+// Package eventreader reads the events BPF programs send to userspace,
+// whether through a BPF ring buffer or, on kernels before 5.8, a perf event
+// array, and keeps count of what was read and lost. Run turns a Reader into
+// a pipeline that hands events to a callback until the tool is stopped.
+//
+// A program supports both transports by declaring its event map as a ring
+// buffer together with a use_ringbuf constant:
+//
+//	const volatile bool use_ringbuf = true;
+//
+//	if (use_ringbuf)
+//		bpf_ringbuf_output(&events, e, sizeof(*e), 0);
+//	else
+//		bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+//
+// Prepare turns the map into a perf event array and the constant off when
+// ring buffers aren't supported; the verifier then drops the dead branch.
+package eventreader
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// UseRingbufConstant is the constant Prepare clears when falling back to a
+// perf event array.
+const UseRingbufConstant = "use_ringbuf"
+
+// ErrClosed is returned by Read after Close. It is the same error the
+// ringbuf and perf readers return.
+var ErrClosed = os.ErrClosed
+
+// HaveRingbuf reports whether the kernel supports BPF ring buffers.
+func HaveRingbuf() bool {
+	return features.HaveMapType(ebpf.RingBuf) == nil
+}
+
+// Prepare makes the ring buffer mapName in spec loadable on this kernel. It
+// must be called before the collection is created, and reports whether the
+// ring buffer is kept.
+func Prepare(spec *ebpf.CollectionSpec, mapName string) (ringbuf bool, err error) {
+	ms, ok := spec.Maps[mapName]
+	if !ok {
+		return false, fmt.Errorf("%s map not found", mapName)
+	}
+	if ms.Type != ebpf.RingBuf {
+		return false, fmt.Errorf("%s is a %s, not a ring buffer", mapName, ms.Type)
+	}
+	if HaveRingbuf() {
+		return true, nil
+	}
+
+	ms.Type = ebpf.PerfEventArray
+	ms.KeySize = 4
+	ms.ValueSize = 4
+	// Zero sizes the array to the number of possible CPUs.
+	ms.MaxEntries = 0
+	if err := spec.RewriteConstants(map[string]interface{}{UseRingbufConstant: false}); err != nil {
+		return false, fmt.Errorf("failed to switch to the perf buffer: %w", err)
+	}
+	return false, nil
+}
+
+// Record is an event read from the kernel.
+type Record struct {
+	// CPU the event was sent from. Always 0 for ring buffers, which are
+	// shared by all CPUs.
+	CPU int
+	// RawSample is the event. It is only valid until the next ReadInto with
+	// the same Record.
+	RawSample []byte
+}
+
+// Options configures a Reader.
+type Options struct {
+	// PerCPUBuffer is the size of each CPU's perf buffer in bytes. Defaults
+	// to 64 pages. Unused for ring buffers, which are sized by the program.
+	PerCPUBuffer int
+	// Dropped is an optional per-CPU array whose entry 0 counts events the
+	// program failed to submit, which is how ring buffer overflows are seen.
+	Dropped *ebpf.Map
+	// Queue is how many events Run lets wait for the handler. When it is
+	// full Run stops reading until the handler catches up, and the kernel
+	// buffer absorbs the burst or loses events. Defaults to 1024.
+	Queue int
+}
+
+// Stats are the counters of a Reader.
+type Stats struct {
+	// Transport is "ringbuf" or "perf".
+	Transport string
+	Records   uint64
+	Bytes     uint64
+	// Lost counts events the kernel overwrote in a full perf buffer.
+	Lost uint64
+	// Dropped counts events the program couldn't submit, read from
+	// Options.Dropped.
+	Dropped uint64
+	// Stalls counts how often Run waited for the handler with a full queue.
+	Stalls  uint64
+	Elapsed time.Duration
+}
+
+// Rate returns the records read per second.
+func (s Stats) Rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Records) / s.Elapsed.Seconds()
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d events (%.0f/s, %d bytes) via %s, %d lost, %d dropped, %d stalls",
+		s.Records, s.Rate(), s.Bytes, s.Transport, s.Lost, s.Dropped, s.Stalls)
+}
+
+// Reader reads Records from a ring buffer or a perf event array.
+type Reader struct {
+	ring    *ringbuf.Reader
+	perf    *perf.Reader
+	dropped *ebpf.Map
+	queue   int
+	start   time.Time
+
+	records atomic.Uint64
+	bytes   atomic.Uint64
+	lost    atomic.Uint64
+	stalls  atomic.Uint64
+
+	ringRec ringbuf.Record
+	perfRec perf.Record
+}
+
+// New returns a Reader for m, which is either a ring buffer or a perf event
+// array, as left by Prepare.
+func New(m *ebpf.Map, opts Options) (*Reader, error) {
+	r := &Reader{dropped: opts.Dropped, queue: opts.Queue, start: time.Now()}
+	if r.queue <= 0 {
+		r.queue = 1024
+	}
+
+	var err error
+	switch m.Type() {
+	case ebpf.RingBuf:
+		r.ring, err = ringbuf.NewReader(m)
+	case ebpf.PerfEventArray:
+		size := opts.PerCPUBuffer
+		if size <= 0 {
+			size = 64 * os.Getpagesize()
+		}
+		r.perf, err = perf.NewReader(m, size)
+	default:
+		return nil, fmt.Errorf("can't read events from a %s", m.Type())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s reader: %w", m.Type(), err)
+	}
+	return r, nil
+}
+
+// Read blocks until an event arrives and returns it. Lost events are counted
+// and skipped. After Close it returns an error wrapping ErrClosed.
+func (r *Reader) Read() (Record, error) {
+	var rec Record
+	err := r.ReadInto(&rec)
+	if err == nil {
+		// Don't hand out the reused buffer.
+		rec.RawSample = append([]byte(nil), rec.RawSample...)
+	}
+	return rec, err
+}
+
+// ReadInto is like Read but reuses the Reader's buffers, so rec.RawSample
+// is overwritten by the next call. It must not be called concurrently.
+func (r *Reader) ReadInto(rec *Record) error {
+	if r.ring != nil {
+		if err := r.ring.ReadInto(&r.ringRec); err != nil {
+			return err
+		}
+		rec.CPU = 0
+		rec.RawSample = r.ringRec.RawSample
+		r.count(len(rec.RawSample))
+		return nil
+	}
+
+	for {
+		if err := r.perf.ReadInto(&r.perfRec); err != nil {
+			return err
+		}
+		if r.perfRec.LostSamples > 0 {
+			r.lost.Add(r.perfRec.LostSamples)
+			continue
+		}
+		rec.CPU = r.perfRec.CPU
+		rec.RawSample = r.perfRec.RawSample
+		r.count(len(rec.RawSample))
+		return nil
+	}
+}
+
+func (r *Reader) count(n int) {
+	r.records.Add(1)
+	r.bytes.Add(uint64(n))
+}
+
+// Transport returns "ringbuf" or "perf".
+func (r *Reader) Transport() string {
+	if r.ring != nil {
+		return "ringbuf"
+	}
+	return "perf"
+}
+
+// Stats returns the counters so far. It is safe to call while reading.
+func (r *Reader) Stats() Stats {
+	var dropped uint64
+	if r.dropped != nil {
+		var perCPU []uint64
+		if err := r.dropped.Lookup(uint32(0), &perCPU); err == nil {
+			for _, n := range perCPU {
+				dropped += n
+			}
+		}
+	}
+	return Stats{
+		Transport: r.Transport(),
+		Records:   r.records.Load(),
+		Bytes:     r.bytes.Load(),
+		Lost:      r.lost.Load(),
+		Dropped:   dropped,
+		Stalls:    r.stalls.Load(),
+		Elapsed:   time.Since(r.start),
+	}
+}
+
+// flush makes a blocked Read return what is buffered, then ErrFlushed.
+func (r *Reader) flush() error {
+	if r.ring != nil {
+		return r.ring.Flush()
+	}
+	return r.perf.Flush()
+}
+
+// Close unblocks Read and releases the buffers.
+func (r *Reader) Close() error {
+	if r.ring != nil {
+		return r.ring.Close()
+	}
+	return r.perf.Close()
+}
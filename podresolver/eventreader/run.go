@@ -0,0 +1,111 @@
+package eventreader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// SignalContext returns a context that is done on SIGINT or SIGTERM, for
+// passing to Run.
+func SignalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+}
+
+// Handler processes an event. rec.RawSample is reused once it returns.
+// Returning an error stops Run.
+type Handler func(rec Record) error
+
+// Run reads events in the background and passes them to handle, in order,
+// until ctx is done, the Reader is closed or handle fails. When ctx is done
+// the events already in the kernel buffer are still handled, so stopping a
+// tool doesn't lose the tail of its output. It returns the error of handle
+// or of reading, and nil on a clean stop.
+func (r *Reader) Run(ctx context.Context, handle Handler) error {
+	queue := make(chan Record, r.queue)
+	// Buffers handed back by the handler, so steady state doesn't allocate.
+	free := make(chan []byte, r.queue+1)
+	// Closed when the handler gives up, so the reading side stops too.
+	failed := make(chan struct{})
+	readErr := make(chan error, 1)
+
+	// Wake the reader up to drain the buffer and stop.
+	stopWatching := context.AfterFunc(ctx, func() { r.flush() })
+	defer stopWatching()
+
+	go func() {
+		defer close(queue)
+		var rec Record
+		for {
+			err := r.ReadInto(&rec)
+			if errors.Is(err, ringbuf.ErrFlushed) {
+				select {
+				case <-failed:
+					return
+				default:
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				if !errors.Is(err, ErrClosed) {
+					readErr <- err
+				}
+				return
+			}
+
+			var buf []byte
+			select {
+			case buf = <-free:
+			default:
+			}
+			out := Record{CPU: rec.CPU, RawSample: append(buf[:0], rec.RawSample...)}
+
+			select {
+			case queue <- out:
+				continue
+			case <-failed:
+				return
+			default:
+			}
+			// Back-pressure: wait for the handler and let the kernel buffer
+			// fill up in the meantime.
+			r.stalls.Add(1)
+			select {
+			case queue <- out:
+			case <-failed:
+				return
+			}
+		}
+	}()
+
+	var err error
+	for rec := range queue {
+		if err == nil {
+			if err = handle(rec); err != nil {
+				close(failed)
+				r.flush()
+			}
+		}
+		select {
+		case free <- rec.RawSample:
+		default:
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return nil
+	}
+}
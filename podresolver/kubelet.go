@@ -0,0 +1,328 @@
+package podresolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// KubePod is a pod as known to the kubelet on this node. Labels are not
+// known when the pod was read from the kubelet's directories.
+type KubePod struct {
+	UID        string
+	Namespace  string
+	Name       string
+	Labels     map[string]string
+	Containers []KubeContainer
+}
+
+// KubeContainer is a container of a KubePod. ID and Image are only known
+// when the pod was read from the kubelet API.
+type KubeContainer struct {
+	Name  string
+	ID    string
+	Image string
+}
+
+// PodLister lists the pods running on this node.
+type PodLister interface {
+	ListPods(ctx context.Context) ([]KubePod, error)
+}
+
+// KubeletAPI lists pods from the kubelet's /pods endpoint.
+type KubeletAPI struct {
+	// URL of the kubelet, e.g. http://127.0.0.1:10255 for the read-only port
+	// or https://127.0.0.1:10250 for the authenticated one.
+	URL string
+	// TokenFile is a bearer token sent to the authenticated port, such as a
+	// service account token.
+	TokenFile string
+	// Insecure skips verification of the kubelet's serving certificate,
+	// which is usually self-signed.
+	Insecure bool
+	// Client overrides the HTTP client.
+	Client *http.Client
+}
+
+// kubeletPodList is the part of the v1.PodList returned by /pods we use.
+type kubeletPodList struct {
+	Items []struct {
+		Metadata struct {
+			UID       string            `json:"uid"`
+			Namespace string            `json:"namespace"`
+			Name      string            `json:"name"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			Containers []struct {
+				Name  string `json:"name"`
+				Image string `json:"image"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			InitContainerStatuses []kubeletContainerStatus `json:"initContainerStatuses"`
+			ContainerStatuses     []kubeletContainerStatus `json:"containerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type kubeletContainerStatus struct {
+	Name        string `json:"name"`
+	Image       string `json:"image"`
+	ContainerID string `json:"containerID"`
+}
+
+// ListPods implements PodLister.
+func (k KubeletAPI) ListPods(ctx context.Context) ([]KubePod, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(k.URL, "/")+"/pods", nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.TokenFile != "" {
+		token, err := os.ReadFile(k.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+		if k.Insecure {
+			client = &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			}}
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query kubelet: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubelet returned %s", resp.Status)
+	}
+
+	var list kubeletPodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to parse kubelet pod list: %w", err)
+	}
+
+	var pods []KubePod
+	for _, item := range list.Items {
+		pod := KubePod{
+			UID:       item.Metadata.UID,
+			Namespace: item.Metadata.Namespace,
+			Name:      item.Metadata.Name,
+			Labels:    item.Metadata.Labels,
+		}
+
+		statuses := append(item.Status.InitContainerStatuses, item.Status.ContainerStatuses...)
+		for _, s := range statuses {
+			pod.Containers = append(pod.Containers, KubeContainer{
+				Name:  s.Name,
+				ID:    trimRuntimeScheme(s.ContainerID),
+				Image: s.Image,
+			})
+		}
+		// Containers that haven't started yet have no status.
+		if len(statuses) == 0 {
+			for _, c := range item.Spec.Containers {
+				pod.Containers = append(pod.Containers, KubeContainer{Name: c.Name, Image: c.Image})
+			}
+		}
+
+		pods = append(pods, pod)
+	}
+
+	return pods, nil
+}
+
+// ContainerMetadata implements MetadataSource by searching the pod list.
+func (k KubeletAPI) ContainerMetadata(containerID string) (Metadata, error) {
+	pods, err := k.ListPods(context.Background())
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	for _, pod := range pods {
+		for _, c := range pod.Containers {
+			// Containers that haven't started have no ID to match.
+			if c.ID != "" && c.ID == containerID {
+				return Metadata{
+					PodName:       pod.Name,
+					PodNamespace:  pod.Namespace,
+					PodUID:        pod.UID,
+					ContainerName: c.Name,
+					Image:         c.Image,
+				}, nil
+			}
+		}
+	}
+	return Metadata{}, fmt.Errorf("container %s not found in kubelet pod list", containerID)
+}
+
+// trimRuntimeScheme strips the "containerd://" style prefix of a container ID.
+func trimRuntimeScheme(id string) string {
+	if i := strings.Index(id, "://"); i >= 0 {
+		return id[i+3:]
+	}
+	return id
+}
+
+// KubeletDir lists pods from the kubelet's directories on disk, for nodes
+// where neither the API server nor the kubelet API can be reached.
+type KubeletDir struct {
+	// PodsDir holds a directory per pod UID. Defaults to /var/lib/kubelet/pods.
+	PodsDir string
+	// LogsDir holds <namespace>_<name>_<uid> directories. Defaults to
+	// /var/log/pods.
+	LogsDir string
+}
+
+// ListPods implements PodLister.
+func (k KubeletDir) ListPods(ctx context.Context) ([]KubePod, error) {
+	podsDir := k.PodsDir
+	if podsDir == "" {
+		podsDir = "/var/lib/kubelet/pods"
+	}
+	logsDir := k.LogsDir
+	if logsDir == "" {
+		logsDir = "/var/log/pods"
+	}
+
+	entries, err := os.ReadDir(podsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", podsDir, err)
+	}
+
+	names := podNamesFromLogs(logsDir)
+
+	var pods []KubePod
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(podsDir, entry.Name())
+		pod := KubePod{UID: entry.Name()}
+
+		if n, ok := names[pod.UID]; ok {
+			pod.Namespace, pod.Name = n[0], n[1]
+		} else {
+			pod.Namespace = readServiceAccountNamespace(dir)
+			pod.Name = readHostname(dir)
+		}
+
+		// containers/<name>/<restart count> holds each container's termination log.
+		containers, _ := os.ReadDir(filepath.Join(dir, "containers"))
+		for _, c := range containers {
+			if c.IsDir() {
+				pod.Containers = append(pod.Containers, KubeContainer{Name: c.Name()})
+			}
+		}
+
+		pods = append(pods, pod)
+	}
+
+	sort.Slice(pods, func(i, j int) bool { return pods[i].UID < pods[j].UID })
+	return pods, nil
+}
+
+// podNamesFromLogs maps pod UIDs to namespace and name using the
+// /var/log/pods/<namespace>_<name>_<uid> directories.
+func podNamesFromLogs(logsDir string) map[string][2]string {
+	names := map[string][2]string{}
+
+	entries, err := os.ReadDir(logsDir)
+	if err != nil {
+		return names
+	}
+	for _, entry := range entries {
+		// Namespaces and pod names can't contain "_", so splitting is safe.
+		parts := strings.Split(entry.Name(), "_")
+		if len(parts) != 3 {
+			continue
+		}
+		names[parts[2]] = [2]string{parts[0], parts[1]}
+	}
+	return names
+}
+
+// readServiceAccountNamespace reads the namespace from the pod's projected
+// service account volume, if it has one.
+func readServiceAccountNamespace(podDir string) string {
+	matches, _ := filepath.Glob(filepath.Join(podDir, "volumes", "kubernetes.io~projected", "*", "namespace"))
+	for _, m := range matches {
+		if data, err := os.ReadFile(m); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return ""
+}
+
+// readHostname reads the pod's hostname, which is its name unless the pod
+// sets spec.hostname, from the pod's own entry in its etc-hosts file.
+func readHostname(podDir string) string {
+	data, err := os.ReadFile(filepath.Join(podDir, "etc-hosts"))
+	if err != nil {
+		return ""
+	}
+
+	var hostname string
+	for _, line := range strings.Split(string(data), "\n") {
+		// Host aliases from the pod spec are appended after the pod's own entry.
+		if strings.HasPrefix(line, "# Entries added by HostAliases") {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// "<ip> [<fqdn>] <hostname>"
+		hostname = fields[len(fields)-1]
+	}
+	return hostname
+}
+
+// FindPodCgroup finds the cgroup directory of a pod by UID below the kubepods
+// cgroup.
+func FindPodCgroup(kubepodsDir, uid string) (string, error) {
+	var found string
+	err := filepath.WalkDir(kubepodsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != kubepodsDir {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if podUID, ok := ParsePodDir(d.Name()); ok {
+			if podUID == uid {
+				found = path
+				return fs.SkipAll
+			}
+			// Pods don't nest.
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to walk %s: %w", kubepodsDir, err)
+	}
+	if found == "" {
+		return "", fmt.Errorf("no cgroup found for pod %s", uid)
+	}
+	return found, nil
+}
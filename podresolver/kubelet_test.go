@@ -0,0 +1,269 @@
+package podresolver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// kubeletFixture is the pod list served by fake kubelets, and the on-disk
+// layout of the same node under testdata/kubelet.
+const kubeletFixture = "testdata/kubelet"
+
+// wantKubeletPods is what ListPods reads from pods.json.
+var wantKubeletPods = []KubePod{
+	{
+		UID:       "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+		Namespace: "default",
+		Name:      "web-7d4b9c-x2x9q",
+		Labels:    map[string]string{"app": "web", "pod-template-hash": "7d4b9c"},
+		Containers: []KubeContainer{
+			{Name: "istio-init", ID: "1f0e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0", Image: "docker.io/istio/proxyv2:1.23.0"},
+			{Name: "nginx", ID: "4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b", Image: "docker.io/library/nginx:1.27"},
+			{Name: "istio-proxy", ID: "9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d", Image: "docker.io/istio/proxyv2:1.23.0"},
+		},
+	},
+	{
+		UID:       "3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d",
+		Namespace: "jobs",
+		Name:      "batch-5k2lp",
+		// Not started yet, so only the spec is known.
+		Containers: []KubeContainer{{Name: "worker", Image: "busybox:1.36"}},
+	},
+}
+
+// fakeKubelet serves body on /pods, to requests carrying token if it is set.
+func fakeKubelet(t *testing.T, tls bool, token string, status int, body []byte) *httptest.Server {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	})
+
+	var srv *httptest.Server
+	if tls {
+		srv = httptest.NewTLSServer(handler)
+	} else {
+		srv = httptest.NewServer(handler)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestKubeletAPIListPods(t *testing.T) {
+	podList, err := os.ReadFile(filepath.Join(kubeletFixture, "pods.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		tls       bool
+		token     string // required by the server
+		tokenFile string
+		status    int
+		body      []byte
+		wantErr   bool
+	}{
+		{name: "read-only port", status: http.StatusOK, body: podList},
+		{name: "authenticated port", tls: true, token: "s3cr3t", tokenFile: tokenFile, status: http.StatusOK, body: podList},
+		{name: "missing token", tls: true, token: "s3cr3t", status: http.StatusOK, body: podList, wantErr: true},
+		{name: "unreadable token", token: "s3cr3t", tokenFile: filepath.Join(t.TempDir(), "missing"), status: http.StatusOK, body: podList, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, body: []byte("boom"), wantErr: true},
+		{name: "malformed list", status: http.StatusOK, body: []byte(`{"items": [`), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeKubelet(t, tt.tls, tt.token, tt.status, tt.body)
+			k := KubeletAPI{URL: srv.URL + "/", TokenFile: tt.tokenFile, Insecure: tt.tls}
+
+			pods, err := k.ListPods(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ListPods succeeded with %d pods", len(pods))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ListPods: %v", err)
+			}
+			if !reflect.DeepEqual(pods, wantKubeletPods) {
+				t.Errorf("pods = %+v, want %+v", pods, wantKubeletPods)
+			}
+		})
+	}
+}
+
+func TestKubeletAPIContainerMetadata(t *testing.T) {
+	podList, err := os.ReadFile(filepath.Join(kubeletFixture, "pods.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := KubeletAPI{URL: fakeKubelet(t, false, "", http.StatusOK, podList).URL}
+
+	tests := []struct {
+		name    string
+		id      string
+		want    Metadata
+		wantErr bool
+	}{
+		{
+			name: "container",
+			id:   "4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b",
+			want: Metadata{
+				PodName:       "web-7d4b9c-x2x9q",
+				PodNamespace:  "default",
+				PodUID:        "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+				ContainerName: "nginx",
+				Image:         "docker.io/library/nginx:1.27",
+			},
+		},
+		{
+			name: "init container",
+			id:   "1f0e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0",
+			want: Metadata{
+				PodName:       "web-7d4b9c-x2x9q",
+				PodNamespace:  "default",
+				PodUID:        "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+				ContainerName: "istio-init",
+				Image:         "docker.io/istio/proxyv2:1.23.0",
+			},
+		},
+		{name: "unknown container", id: "0000000000000000000000000000000000000000000000000000000000000000", wantErr: true},
+		// Containers that haven't started have no ID to match.
+		{name: "empty ID", id: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := k.ContainerMetadata(tt.id)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ContainerMetadata = %+v, want an error", md)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ContainerMetadata: %v", err)
+			}
+			if md != tt.want {
+				t.Errorf("ContainerMetadata = %+v, want %+v", md, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeletDirListPods(t *testing.T) {
+	podsDir := filepath.Join(kubeletFixture, "pods")
+	logsDir := filepath.Join(kubeletFixture, "logs")
+
+	web := KubePod{
+		UID:        "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81",
+		Namespace:  "default",
+		Name:       "web-7d4b9c-x2x9q",
+		Containers: []KubeContainer{{Name: "istio-proxy"}, {Name: "nginx"}},
+	}
+	// Named from its service account volume and etc-hosts, as it has no
+	// logs directory. Host aliases after the pod's own entry are skipped.
+	coredns := KubePod{
+		UID:        "0a9b8c7d-6e5f-4a3b-2c1d-0e9f8a7b6c5d",
+		Namespace:  "kube-system",
+		Name:       "coredns-76f75df574-8kq2w",
+		Containers: []KubeContainer{{Name: "coredns"}},
+	}
+	// Nothing on disk tells the name of a host network pod without logs.
+	hostNetwork := KubePod{UID: "d4c3b2a1-0f9e-4d8c-7b6a-5f4e3d2c1b0a"}
+
+	tests := []struct {
+		name    string
+		dir     KubeletDir
+		want    []KubePod
+		wantErr bool
+	}{
+		{
+			name: "with logs",
+			dir:  KubeletDir{PodsDir: podsDir, LogsDir: logsDir},
+			want: []KubePod{coredns, web, hostNetwork},
+		},
+		{
+			name: "without logs",
+			dir:  KubeletDir{PodsDir: podsDir, LogsDir: filepath.Join(kubeletFixture, "missing")},
+			want: []KubePod{coredns, {UID: web.UID, Name: web.Name, Containers: web.Containers}, hostNetwork},
+		},
+		{
+			name:    "missing pods dir",
+			dir:     KubeletDir{PodsDir: filepath.Join(kubeletFixture, "missing"), LogsDir: logsDir},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pods, err := tt.dir.ListPods(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ListPods succeeded with %d pods", len(pods))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ListPods: %v", err)
+			}
+			if !reflect.DeepEqual(pods, tt.want) {
+				t.Errorf("pods = %+v, want %+v", pods, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindPodCgroup(t *testing.T) {
+	root := t.TempDir()
+	web := fakePod(t, root, "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81")
+	besteffort := filepath.Join(root, "kubepods-besteffort.slice")
+	batch := fakePod(t, besteffort, "3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d")
+	// A pod directory is not searched for other pods.
+	fakePod(t, web, "0a9b8c7d-6e5f-4a3b-2c1d-0e9f8a7b6c5d")
+
+	tests := []struct {
+		uid     string
+		want    string
+		wantErr bool
+	}{
+		{uid: "6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81", want: web},
+		{uid: "3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d", want: batch},
+		{uid: "0a9b8c7d-6e5f-4a3b-2c1d-0e9f8a7b6c5d", wantErr: true},
+		{uid: "d4c3b2a1-0f9e-4d8c-7b6a-5f4e3d2c1b0a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := FindPodCgroup(root, tt.uid)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("FindPodCgroup(%s) = %s, want an error", tt.uid, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("FindPodCgroup(%s): %v", tt.uid, err)
+		} else if got != tt.want {
+			t.Errorf("FindPodCgroup(%s) = %s, want %s", tt.uid, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package podresolver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// NSPIDs returns the PIDs of a process in every PID namespace it is visible
+// in, from the namespace of the proc mount (pid itself) to the process's own,
+// as listed by the NSpid line of /proc/<pid>/status.
+func NSPIDs(pid int) ([]int, error) {
+	return NSPIDsIn("/proc", pid)
+}
+
+// NSPIDsIn is NSPIDs with a different proc mount.
+func NSPIDsIn(procRoot string, pid int) ([]int, error) {
+	file, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ESRCH) {
+			return nil, fmt.Errorf("pid %d: %w", pid, ErrProcessNotFound)
+		}
+		return nil, fmt.Errorf("failed to read status of pid %d: %w", pid, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "NSpid:")
+		if !ok {
+			continue
+		}
+
+		var pids []int
+		for _, field := range strings.Fields(value) {
+			p, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid NSpid of pid %d: %q", pid, value)
+			}
+			pids = append(pids, p)
+		}
+		return pids, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read status of pid %d: %w", pid, err)
+	}
+
+	// Kernels before 4.1 don't report NSpid.
+	return []int{pid}, nil
+}
+
+// ContainerPID returns the PID a process sees for itself, i.e. its PID in
+// its innermost PID namespace. It is pid for processes on the host.
+func ContainerPID(procRoot string, pid int) (int, error) {
+	pids, err := NSPIDsIn(procRoot, pid)
+	if err != nil {
+		return 0, err
+	}
+	if len(pids) == 0 {
+		return pid, nil
+	}
+	return pids[len(pids)-1], nil
+}
+
+// StartTime returns when a process started, in clock ticks after boot, from
+// field 22 of /proc/<pid>/stat. A PID and its start time identify a process
+// even after the PID is reused.
+func StartTime(procRoot string, pid int) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ESRCH) {
+			return 0, fmt.Errorf("pid %d: %w", pid, ErrProcessNotFound)
+		}
+		return 0, fmt.Errorf("failed to read stat of pid %d: %w", pid, err)
+	}
+
+	// comm, field 2, is in parentheses and may contain spaces
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0, fmt.Errorf("malformed stat of pid %d", pid)
+	}
+	// Fields from state (field 3) on
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed stat of pid %d", pid)
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed stat of pid %d: %w", pid, err)
+	}
+	return start, nil
+}
@@ -0,0 +1,152 @@
+package podresolver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrProcessNotFound is returned when a process has already exited.
+var ErrProcessNotFound = errors.New("process not found")
+
+// Kind says what a process was found to be running in.
+type Kind string
+
+const (
+	KindPod       Kind = "pod"
+	KindContainer Kind = "container"
+	KindService   Kind = "service"
+	KindHost      Kind = "host"
+)
+
+// Metadata is what a runtime or the Kubernetes API knows about a container.
+type Metadata struct {
+	PodName       string
+	PodNamespace  string
+	PodUID        string
+	ContainerName string
+	Image         string
+}
+
+// MetadataSource looks up metadata for a container by its ID.
+type MetadataSource interface {
+	ContainerMetadata(containerID string) (Metadata, error)
+}
+
+// ProcessInfo is the pod and container a process belongs to.
+type ProcessInfo struct {
+	PID         int
+	Kind        Kind
+	Cgroup      string
+	PodUID      string
+	ContainerID string
+	Runtime     string
+	// Unit is the systemd unit of a host service.
+	Unit     string
+	Metadata Metadata
+}
+
+// ResolvePID finds the pod and container of a process by reading
+// /proc/<pid>/cgroup. meta is optional and used to add pod and container
+// names; a failed metadata lookup is not an error.
+func ResolvePID(pid int, meta MetadataSource) (*ProcessInfo, error) {
+	return ResolvePIDIn("/proc", pid, meta)
+}
+
+// ResolvePIDIn is ResolvePID with a different proc mount, e.g. the host's
+// /proc mounted into a container.
+func ResolvePIDIn(procRoot string, pid int, meta MetadataSource) (*ProcessInfo, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ESRCH) {
+			return nil, fmt.Errorf("pid %d: %w", pid, ErrProcessNotFound)
+		}
+		return nil, fmt.Errorf("failed to read cgroup of pid %d: %w", pid, err)
+	}
+
+	info := ClassifyCgroup(ParseProcCgroup(string(data)))
+	info.PID = pid
+
+	if meta != nil && info.ContainerID != "" {
+		if m, err := meta.ContainerMetadata(info.ContainerID); err == nil {
+			info.Metadata = m
+			if info.PodUID == "" {
+				info.PodUID = m.PodUID
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// ParseProcCgroup returns the cgroup path from the contents of
+// /proc/<pid>/cgroup. A path that places the process in a pod wins on any
+// hierarchy, since hybrid v1/v2 hosts may only have the pod on the v1
+// controllers. Otherwise the unified (v2) hierarchy, then the name=systemd
+// hierarchy, then the first one is used.
+func ParseProcCgroup(data string) string {
+	var first, unified, systemd string
+	for _, line := range strings.Split(data, "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if strings.Contains(parts[2], "kubepods") {
+			return parts[2]
+		}
+		if first == "" {
+			first = parts[2]
+		}
+		if unified == "" && parts[0] == "0" && parts[1] == "" {
+			unified = parts[2]
+		}
+		if systemd == "" && parts[1] == "name=systemd" {
+			systemd = parts[2]
+		}
+	}
+
+	switch {
+	case unified != "":
+		return unified
+	case systemd != "":
+		return systemd
+	}
+	return first
+}
+
+// ClassifyCgroup works out the pod UID, container ID or systemd unit from a
+// cgroup path.
+func ClassifyCgroup(cgroup string) *ProcessInfo {
+	info := &ProcessInfo{Cgroup: cgroup, Kind: KindHost}
+
+	for _, part := range strings.Split(cgroup, "/") {
+		if uid, ok := ParsePodDir(part); ok {
+			info.PodUID = uid
+			continue
+		}
+		if runtime, id, ok := ParseContainerDir(part); ok {
+			info.ContainerID = id
+			info.Runtime = runtime
+			continue
+		}
+		if strings.HasSuffix(part, ".service") {
+			info.Unit = part
+		}
+	}
+
+	switch {
+	case info.PodUID != "":
+		info.Kind = KindPod
+	case info.ContainerID != "":
+		info.Kind = KindContainer
+	case info.Unit != "":
+		info.Kind = KindService
+	}
+	return info
+}
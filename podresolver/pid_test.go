@@ -0,0 +1,78 @@
+package podresolver
+
+import "testing"
+
+func TestParseProcCgroup(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "v2",
+			data: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod6f1c2a34_8b1d_4e2f_9a7c_0d3e5b6a7c81.slice/cri-containerd-4a3b2c1d0e9f.scope\n",
+			want: "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod6f1c2a34_8b1d_4e2f_9a7c_0d3e5b6a7c81.slice/cri-containerd-4a3b2c1d0e9f.scope",
+		},
+		{
+			name: "v2 host service",
+			data: "0::/system.slice/containerd.service\n",
+			want: "/system.slice/containerd.service",
+		},
+		{
+			name: "v1",
+			data: `12:pids:/kubepods/burstable/pod6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81/4a3b2c1d0e9f
+11:memory:/kubepods/burstable/pod6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81/4a3b2c1d0e9f
+3:cpu,cpuacct:/kubepods/burstable/pod6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81/4a3b2c1d0e9f
+1:name=systemd:/kubepods/burstable/pod6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81/4a3b2c1d0e9f
+`,
+			want: "/kubepods/burstable/pod6f1c2a34-8b1d-4e2f-9a7c-0d3e5b6a7c81/4a3b2c1d0e9f",
+		},
+		{
+			name: "v1 host service",
+			data: `12:pids:/system.slice/sshd.service
+11:memory:/
+1:name=systemd:/system.slice/sshd.service
+`,
+			want: "/system.slice/sshd.service",
+		},
+		{
+			name: "v1 without systemd",
+			data: "4:memory:/docker/9e8d7c6b5a4f\n2:cpu:/\n",
+			want: "/docker/9e8d7c6b5a4f",
+		},
+		{
+			// systemd only moved its own hierarchy to v2, the kubelet uses
+			// the v1 controllers with the cgroupfs driver
+			name: "hybrid",
+			data: `12:pids:/kubepods/besteffort/pod3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d/9e8d7c6b5a4f
+11:memory:/kubepods/besteffort/pod3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d/9e8d7c6b5a4f
+1:name=systemd:/system.slice/containerd.service
+0::/system.slice/containerd.service
+`,
+			want: "/kubepods/besteffort/pod3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d/9e8d7c6b5a4f",
+		},
+		{
+			name: "hybrid root unified",
+			data: `11:memory:/kubepods/besteffort/pod3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d/9e8d7c6b5a4f
+1:name=systemd:/kubepods/besteffort/pod3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d/9e8d7c6b5a4f
+0::/
+`,
+			want: "/kubepods/besteffort/pod3b2a1c0d-9e8f-4a7b-6c5d-4e3f2a1b0c9d/9e8d7c6b5a4f",
+		},
+		{
+			name: "hybrid host service",
+			data: `11:memory:/system.slice/sshd.service
+1:name=systemd:/system.slice/sshd.service
+0::/system.slice/sshd.service
+`,
+			want: "/system.slice/sshd.service",
+		},
+		{name: "empty", data: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := ParseProcCgroup(tt.data); got != tt.want {
+			t.Errorf("%s: ParseProcCgroup = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
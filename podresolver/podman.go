@@ -0,0 +1,106 @@
+package podresolver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Podman talks to the Podman (libpod) API over its unix socket.
+type Podman struct {
+	client *engineClient
+}
+
+// NewPodman returns a Podman client for socket. An empty socket uses the
+// rootful /run/podman/podman.sock, or the rootless socket under
+// $XDG_RUNTIME_DIR when not running as root.
+func NewPodman(socket string) *Podman {
+	if socket == "" {
+		socket = "/run/podman/podman.sock"
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+			socket = filepath.Join(dir, "podman", "podman.sock")
+		}
+	}
+	return &Podman{client: newEngineClient(socket, "/v4.0.0/libpod")}
+}
+
+// podmanListContainer is an entry of GET /libpod/containers/json.
+type podmanListContainer struct {
+	ID      string            `json:"Id"`
+	Names   []string          `json:"Names"`
+	Image   string            `json:"Image"`
+	Labels  map[string]string `json:"Labels"`
+	Pid     int               `json:"Pid"`
+	Pod     string            `json:"Pod"`
+	PodName string            `json:"PodName"`
+}
+
+func (c podmanListContainer) engineContainer() EngineContainer {
+	ec := EngineContainer{
+		ID:      c.ID,
+		Image:   c.Image,
+		Labels:  c.Labels,
+		PodID:   c.Pod,
+		PodName: c.PodName,
+		PID:     c.Pid,
+	}
+	if len(c.Names) > 0 {
+		ec.Name = c.Names[0]
+	}
+	return ec
+}
+
+// ListContainers implements Engine.
+func (p *Podman) ListContainers(ctx context.Context) ([]EngineContainer, error) {
+	var list []podmanListContainer
+	if err := p.client.get(ctx, "/containers/json", url.Values{"all": {"true"}}, &list); err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	containers := make([]EngineContainer, 0, len(list))
+	for _, c := range list {
+		containers = append(containers, c.engineContainer())
+	}
+	return containers, nil
+}
+
+// InspectContainer implements Engine. The list endpoint is used because,
+// unlike inspect, it reports the pod name.
+func (p *Podman) InspectContainer(ctx context.Context, id string) (EngineContainer, error) {
+	query := containerFilter("id", id)
+	query.Set("all", "true")
+
+	var list []podmanListContainer
+	if err := p.client.get(ctx, "/containers/json", query, &list); err != nil {
+		return EngineContainer{}, fmt.Errorf("failed to inspect container %s: %w", id, err)
+	}
+	if len(list) == 0 {
+		return EngineContainer{}, fmt.Errorf("container %s not found", id)
+	}
+	return list[0].engineContainer(), nil
+}
+
+var podmanActions = map[string]EngineEventType{
+	"create": ContainerCreated,
+	"start":  ContainerStarted,
+	"died":   ContainerDied,
+	"remove": ContainerRemoved,
+}
+
+// Events implements Engine.
+func (p *Podman) Events(ctx context.Context) (<-chan EngineEvent, <-chan error) {
+	query := containerFilter("type", "container")
+	query.Set("stream", "true")
+	return p.client.events(ctx, "/events", query, podmanActions)
+}
+
+// ContainerMetadata implements MetadataSource.
+func (p *Podman) ContainerMetadata(containerID string) (Metadata, error) {
+	c, err := p.InspectContainer(context.Background(), containerID)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return c.Metadata(), nil
+}
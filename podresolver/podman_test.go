@@ -0,0 +1,113 @@
+package podresolver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakePodman serves the libpod containers endpoint for containers,
+// honouring the id filter.
+func fakePodman(t *testing.T, containers []podmanListContainer) string {
+	t.Helper()
+	return fakeEngine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4.0.0/libpod/containers/json" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "page not found"})
+			return
+		}
+		if r.URL.Query().Get("all") != "true" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "only running containers"})
+			return
+		}
+
+		var filters map[string][]string
+		if f := r.URL.Query().Get("filters"); f != "" {
+			if err := json.Unmarshal([]byte(f), &filters); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+				return
+			}
+		}
+		list := []podmanListContainer{}
+		for _, c := range containers {
+			if ids, ok := filters["id"]; ok && !strings.HasPrefix(c.ID, ids[0]) {
+				continue
+			}
+			list = append(list, c)
+		}
+		writeJSON(w, http.StatusOK, list)
+	}))
+}
+
+func TestPodman(t *testing.T) {
+	const (
+		infraID = "0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b"
+		appID   = "4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b"
+		soloID  = "9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b1a0f9e8d"
+		podID   = "3b2a1c0d9e8f4a7b6c5d4e3f2a1b0c9d3b2a1c0d9e8f4a7b6c5d4e3f2a1b0c9d"
+	)
+	listed := []podmanListContainer{
+		{ID: infraID, Names: []string{"3b2a1c0d9e8f-infra"}, Image: "localhost/podman-pause:5.2.2", Pid: 3100, Pod: podID, PodName: "web"},
+		{ID: appID, Names: []string{"web-app"}, Image: "docker.io/library/nginx:1.27", Labels: map[string]string{"tier": "frontend"}, Pid: 3120, Pod: podID, PodName: "web"},
+		// Created but never started.
+		{ID: soloID, Image: "docker.io/library/redis:7"},
+	}
+	p := NewPodman(fakePodman(t, listed))
+
+	infra := EngineContainer{ID: infraID, Name: "3b2a1c0d9e8f-infra", Image: "localhost/podman-pause:5.2.2", PodID: podID, PodName: "web", PID: 3100}
+	app := EngineContainer{ID: appID, Name: "web-app", Image: "docker.io/library/nginx:1.27", Labels: map[string]string{"tier": "frontend"}, PodID: podID, PodName: "web", PID: 3120}
+	solo := EngineContainer{ID: soloID, Image: "docker.io/library/redis:7"}
+
+	containers, err := p.ListContainers(context.Background())
+	if err != nil {
+		t.Fatalf("ListContainers: %v", err)
+	}
+	if want := []EngineContainer{infra, app, solo}; !reflect.DeepEqual(containers, want) {
+		t.Errorf("ListContainers = %+v, want %+v", containers, want)
+	}
+
+	tests := []struct {
+		id      string
+		want    EngineContainer
+		meta    Metadata
+		wantErr bool
+	}{
+		{
+			id:   appID,
+			want: app,
+			meta: Metadata{PodName: "web", PodUID: podID, ContainerName: "web-app", Image: "docker.io/library/nginx:1.27"},
+		},
+		{
+			id:   soloID,
+			want: solo,
+			meta: Metadata{Image: "docker.io/library/redis:7"},
+		},
+		{id: "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		c, err := p.InspectContainer(context.Background(), tt.id)
+		md, mdErr := p.ContainerMetadata(tt.id)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("InspectContainer(%s) = %+v, want an error", tt.id, c)
+			}
+			if mdErr == nil {
+				t.Errorf("ContainerMetadata(%s) = %+v, want an error", tt.id, md)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("InspectContainer(%s): %v", tt.id, err)
+		} else if !reflect.DeepEqual(c, tt.want) {
+			t.Errorf("InspectContainer(%s) = %+v, want %+v", tt.id, c, tt.want)
+		}
+		if mdErr != nil {
+			t.Errorf("ContainerMetadata(%s): %v", tt.id, mdErr)
+		} else if md != tt.meta {
+			t.Errorf("ContainerMetadata(%s) = %+v, want %+v", tt.id, md, tt.meta)
+		}
+	}
+}
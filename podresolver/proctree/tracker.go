@@ -0,0 +1,165 @@
+package proctree
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"podresolver/decode"
+	"podresolver/eventreader"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// MapName is the name of the event ring buffer in the BPF object.
+const MapName = "proctree_events"
+
+// tracepoints maps the programs of proctree.h to their raw tracepoints.
+var tracepoints = []struct {
+	prog, name string
+}{
+	{"proctree_fork", "sched_process_fork"},
+	{"proctree_exec", "sched_process_exec"},
+	{"proctree_exit", "sched_process_exit"},
+}
+
+// Event types of struct proctree_event.
+const (
+	eventFork = 1
+	eventExec = 2
+	eventExit = 3
+)
+
+// event matches struct proctree_event in headers/proctree.h.
+type event struct {
+	Type     uint32
+	PID      uint32
+	PPID     uint32
+	ExitCode uint32
+	Ts       uint64
+	Comm     [16]byte
+	Filename [256]byte
+}
+
+var eventDecoder = decode.MustDecoder[event]()
+
+// Remove deletes the proctree programs and map from spec, for tools that
+// include proctree.h but don't need the tree this run. It keeps them from
+// being loaded, which fails on kernels without ring buffers.
+func Remove(spec *ebpf.CollectionSpec) {
+	for _, tp := range tracepoints {
+		delete(spec.Programs, tp.prog)
+	}
+	delete(spec.Maps, MapName)
+}
+
+// Tracker is a Tree fed by the programs of proctree.h.
+type Tracker struct {
+	*Tree
+
+	links     []link.Link
+	reader    *eventreader.Reader
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	// Event time of the last Prune, only used by handle.
+	pruned time.Duration
+}
+
+// Start attaches the proctree programs of coll, which must have been built
+// with proctree.h, seeds the tree from /proc and keeps it up to date until
+// ctx is done or Close is called. Seeding after attaching leaves no window
+// in which a process can go unseen.
+func Start(ctx context.Context, coll *ebpf.Collection) (*Tracker, error) {
+	m := coll.Maps[MapName]
+	if m == nil {
+		return nil, fmt.Errorf("%s map not found, was the program built with proctree.h?", MapName)
+	}
+
+	t := &Tracker{Tree: New()}
+	for _, tp := range tracepoints {
+		prog := coll.Programs[tp.prog]
+		if prog == nil {
+			t.Close()
+			return nil, fmt.Errorf("%s program not found", tp.prog)
+		}
+		l, err := link.AttachRawTracepoint(link.RawTracepointOptions{Name: tp.name, Program: prog})
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to attach %s: %w", tp.name, err)
+		}
+		t.links = append(t.links, l)
+	}
+
+	reader, err := eventreader.New(m, eventreader.Options{})
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.reader = reader
+
+	if err := t.Seed(); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		if err := reader.Run(ctx, t.handle); err != nil {
+			log.Printf("proctree: %v\n", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		t.Close()
+	}()
+
+	return t, nil
+}
+
+// handle applies an event to the tree, and prunes exited processes as time,
+// as seen in event timestamps, goes by.
+func (t *Tracker) handle(rec eventreader.Record) error {
+	var e event
+	if err := eventDecoder.Decode(rec.RawSample, &e); err != nil {
+		return nil
+	}
+
+	now := time.Duration(e.Ts)
+	comm := string(bytes.TrimRight(e.Comm[:], "\x00"))
+	switch e.Type {
+	case eventFork:
+		t.Fork(int(e.PPID), int(e.PID), comm, now)
+	case eventExec:
+		t.Exec(int(e.PID), comm, string(bytes.TrimRight(e.Filename[:], "\x00")), now)
+	case eventExit:
+		t.Exit(int(e.PID), int(e.ExitCode), now)
+	}
+
+	if now-t.pruned > t.Linger {
+		t.Prune(now)
+		t.pruned = now
+	}
+	return nil
+}
+
+// Close detaches the programs and stops updating the tree. The tree can
+// still be queried.
+func (t *Tracker) Close() error {
+	t.closeOnce.Do(func() {
+		for _, l := range t.links {
+			l.Close()
+		}
+		if t.reader != nil {
+			t.reader.Close()
+			t.wg.Wait()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,349 @@
+// Package proctree keeps an in-memory process tree up to date from the fork,
+// exec and exit events of headers/proctree.h, seeded from /proc. It answers
+// ancestry queries such as "what spawned this curl?" for PIDs reported by any
+// tracing program, including processes that exited a moment ago.
+package proctree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the start time in /proc/<pid>/stat.
+// It is 100 on every Linux architecture Go supports.
+const clockTicks = 100
+
+// Process is a process in the tree. Start and End are times since boot; End
+// is zero while the process runs.
+type Process struct {
+	PID      int
+	PPID     int
+	Comm     string
+	Filename string
+	Start    time.Duration
+	End      time.Duration
+	ExitCode int
+}
+
+// Exited reports whether the process has exited.
+func (p Process) Exited() bool {
+	return p.End != 0
+}
+
+// Lifetime returns how long the process ran, or has been running for at
+// time now since boot.
+func (p Process) Lifetime(now time.Duration) time.Duration {
+	if p.Exited() {
+		return p.End - p.Start
+	}
+	return now - p.Start
+}
+
+func (p Process) String() string {
+	return fmt.Sprintf("%s(%d)", p.Comm, p.PID)
+}
+
+// Tree is a process tree. It is safe for concurrent use.
+type Tree struct {
+	// ProcRoot is where unknown PIDs are looked up. Defaults to /proc.
+	ProcRoot string
+	// Linger is how long exited processes are kept, so that events still in
+	// flight when they exit can be attributed. Defaults to 30s.
+	Linger time.Duration
+
+	mu    sync.RWMutex
+	procs map[int]*Process
+}
+
+// New returns an empty Tree.
+func New() *Tree {
+	return &Tree{
+		ProcRoot: "/proc",
+		Linger:   30 * time.Second,
+		procs:    map[int]*Process{},
+	}
+}
+
+// Seed adds every process currently in ProcRoot.
+func (t *Tree) Seed() error {
+	entries, err := os.ReadDir(t.ProcRoot)
+	if err != nil {
+		return fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		p, err := readProcess(t.ProcRoot, pid)
+		if err != nil {
+			// Exited since the listing.
+			continue
+		}
+
+		t.mu.Lock()
+		if _, ok := t.procs[pid]; !ok {
+			t.procs[pid] = p
+		}
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// readProcess reads a process from /proc/<pid>/stat and its executable.
+func readProcess(procRoot string, pid int) (*Process, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseStat(string(data))
+	if err != nil {
+		return nil, err
+	}
+	// Kernel threads and processes of other users have no readable exe.
+	p.Filename, _ = os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "exe"))
+	return p, nil
+}
+
+// parseStat parses /proc/<pid>/stat. The comm field is in parentheses and
+// may itself contain spaces and parentheses.
+func parseStat(stat string) (*Process, error) {
+	open := strings.IndexByte(stat, '(')
+	end := strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return nil, errors.New("malformed stat")
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(stat[:open]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed stat: %w", err)
+	}
+
+	// Fields from state (field 3) on.
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return nil, errors.New("malformed stat")
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed stat: %w", err)
+	}
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed stat: %w", err)
+	}
+
+	return &Process{
+		PID:   pid,
+		PPID:  ppid,
+		Comm:  stat[open+1 : end],
+		Start: time.Duration(ticks) * time.Second / clockTicks,
+	}, nil
+}
+
+// Fork records that ppid created pid at ts.
+func (t *Tree) Fork(ppid, pid int, comm string, ts time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := &Process{PID: pid, PPID: ppid, Comm: comm, Start: ts}
+	// The child runs the parent's program until it execs.
+	if parent, ok := t.procs[ppid]; ok {
+		p.Filename = parent.Filename
+	}
+	t.procs[pid] = p
+}
+
+// Exec records that pid started running filename at ts.
+func (t *Tree) Exec(pid int, comm, filename string, ts time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.procs[pid]
+	if !ok {
+		// Forked before the tree was seeded; the parent is looked up lazily.
+		p = &Process{PID: pid, PPID: -1, Start: ts}
+		t.procs[pid] = p
+	}
+	p.Comm = comm
+	p.Filename = filename
+}
+
+// Exit records that pid exited at ts with the given wait status.
+func (t *Tree) Exit(pid int, exitCode int, ts time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.procs[pid]; ok {
+		p.End = ts
+		p.ExitCode = exitCode
+	}
+}
+
+// Prune forgets processes that exited more than Linger before now, a time
+// since boot.
+func (t *Tree) Prune(now time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for pid, p := range t.procs {
+		if p.Exited() && now-p.End > t.Linger {
+			delete(t.procs, pid)
+		}
+	}
+}
+
+// Get returns the process with pid, reading it from ProcRoot if the tree
+// doesn't know it yet.
+func (t *Tree) Get(pid int) (Process, bool) {
+	t.mu.RLock()
+	var known Process
+	p, ok := t.procs[pid]
+	if ok {
+		known = *p
+	}
+	t.mu.RUnlock()
+	if ok && known.PPID >= 0 {
+		return known, true
+	}
+
+	loaded, err := readProcess(t.ProcRoot, pid)
+	if err != nil {
+		return known, ok
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.procs[pid]; ok {
+		// Keep what events told us, fill in the parent.
+		p.PPID = loaded.PPID
+		return *p, true
+	}
+	t.procs[pid] = loaded
+	return *loaded, true
+}
+
+// Ancestors returns the parent of pid, its parent, and so on up to the
+// first process the tree can't find, usually init.
+func (t *Tree) Ancestors(pid int) []Process {
+	var ancestors []Process
+	seen := map[int]bool{pid: true}
+
+	p, ok := t.Get(pid)
+	for ok && p.PPID > 0 && !seen[p.PPID] {
+		seen[p.PPID] = true
+		p, ok = t.Get(p.PPID)
+		if ok {
+			ancestors = append(ancestors, p)
+		}
+	}
+	return ancestors
+}
+
+// Chain formats pid and its ancestors from the oldest down, like
+// "systemd(1)─containerd-shim(812)─sh(900)─curl(901)".
+func (t *Tree) Chain(pid int) string {
+	ancestors := t.Ancestors(pid)
+	parts := make([]string, 0, len(ancestors)+1)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		parts = append(parts, ancestors[i].String())
+	}
+	if p, ok := t.Get(pid); ok {
+		parts = append(parts, p.String())
+	} else {
+		parts = append(parts, fmt.Sprintf("?(%d)", pid))
+	}
+	return strings.Join(parts, "─")
+}
+
+// Children returns the processes whose parent is pid, ordered by PID.
+func (t *Tree) Children(pid int) []Process {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var children []Process
+	for _, p := range t.procs {
+		if p.PPID == pid {
+			children = append(children, *p)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].PID < children[j].PID })
+	return children
+}
+
+// Len returns the number of processes in the tree, including the exited
+// ones not yet pruned.
+func (t *Tree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.procs)
+}
+
+// WritePstree prints the subtree below root like pstree -p. Exited processes
+// are marked with their exit status. A root of 0 prints every tree whose
+// parent is unknown, which on the host is just init and kthreadd.
+func (t *Tree) WritePstree(w io.Writer, root int) error {
+	if root != 0 {
+		p, ok := t.Get(root)
+		if !ok {
+			return fmt.Errorf("process %d not found", root)
+		}
+		return t.writeSubtree(w, p, "", "", map[int]bool{})
+	}
+
+	t.mu.RLock()
+	var roots []Process
+	for _, p := range t.procs {
+		if _, ok := t.procs[p.PPID]; !ok {
+			roots = append(roots, *p)
+		}
+	}
+	t.mu.RUnlock()
+	sort.Slice(roots, func(i, j int) bool { return roots[i].PID < roots[j].PID })
+
+	seen := map[int]bool{}
+	for _, p := range roots {
+		if err := t.writeSubtree(w, p, "", "", seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSubtree prints p and its descendants. seen guards against cycles
+// left by PID reuse.
+func (t *Tree) writeSubtree(w io.Writer, p Process, prefix, childPrefix string, seen map[int]bool) error {
+	if seen[p.PID] {
+		return nil
+	}
+	seen[p.PID] = true
+
+	label := p.String()
+	if p.Exited() {
+		label += fmt.Sprintf(" [exited %d]", p.ExitCode>>8)
+	}
+	if _, err := fmt.Fprintf(w, "%s%s\n", prefix, label); err != nil {
+		return err
+	}
+
+	children := t.Children(p.PID)
+	for i, c := range children {
+		branch, next := "├─", "│ "
+		if i == len(children)-1 {
+			branch, next = "└─", "  "
+		}
+		if err := t.writeSubtree(w, c, childPrefix+branch, childPrefix+next, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
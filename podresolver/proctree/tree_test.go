@@ -0,0 +1,267 @@
+package proctree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stat returns a /proc/<pid>/stat line with the given start time in ticks.
+func stat(pid int, comm string, ppid int, ticks uint64) string {
+	return fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0 %d 2048000 200 18446744073709551615\n",
+		pid, comm, ppid, pid, pid, ticks)
+}
+
+// newTestTree returns a Tree reading unknown PIDs from an empty proc
+// directory, and that directory.
+func newTestTree(t *testing.T) (*Tree, string) {
+	t.Helper()
+	tree := New()
+	tree.ProcRoot = t.TempDir()
+	return tree, tree.ProcRoot
+}
+
+func writeStat(t *testing.T, procRoot string, pid int, line string) {
+	t.Helper()
+	dir := filepath.Join(procRoot, fmt.Sprint(pid))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		stat    string
+		want    *Process
+		wantErr bool
+	}{
+		{
+			name: "plain",
+			stat: stat(1, "systemd", 0, 2),
+			want: &Process{PID: 1, PPID: 0, Comm: "systemd", Start: 20 * time.Millisecond},
+		},
+		{
+			name: "parentheses",
+			stat: stat(812, "(sd-pam)", 811, 12345),
+			want: &Process{PID: 812, PPID: 811, Comm: "(sd-pam)", Start: 123450 * time.Millisecond},
+		},
+		{
+			// Only the last ")" ends comm
+			name: "spaces and closing parenthesis",
+			stat: stat(4242, "a) S 1 (b c", 4200, 100),
+			want: &Process{PID: 4242, PPID: 4200, Comm: "a) S 1 (b c", Start: time.Second},
+		},
+		{
+			name:    "truncated",
+			stat:    "4242 (sh) S 4200 4242 4242 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0",
+			wantErr: true,
+		},
+		{
+			name:    "truncated in comm",
+			stat:    "4242 (sh",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			stat:    "",
+			wantErr: true,
+		},
+		{
+			name:    "bad PID",
+			stat:    strings.Replace(stat(4242, "sh", 4200, 100), "4242", "x", 1),
+			wantErr: true,
+		},
+		{
+			name:    "bad start time",
+			stat:    strings.Replace(stat(4242, "sh", 4200, 100), " 100 2048000", " -1 2048000", 1),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parseStat(tt.stat)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseStat = %+v, want an error", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseStat: %v", err)
+			}
+			if *p != *tt.want {
+				t.Errorf("parseStat = %+v, want %+v", *p, *tt.want)
+			}
+		})
+	}
+}
+
+func TestTreeEvents(t *testing.T) {
+	tree, procRoot := newTestTree(t)
+	tree.Linger = 10 * time.Second
+
+	tree.Fork(1, 100, "bash", 1*time.Second)
+	tree.Exec(100, "bash", "/usr/bin/bash", 1*time.Second)
+	tree.Fork(100, 101, "bash", 2*time.Second)
+	if p, _ := tree.Get(101); p.Filename != "/usr/bin/bash" {
+		t.Errorf("forked child runs %q, want its parent's program", p.Filename)
+	}
+
+	tree.Exec(101, "curl", "/usr/bin/curl", 3*time.Second)
+	tree.Exit(101, 6<<8, 4*time.Second)
+	// Unknown PIDs are ignored
+	tree.Exit(999, 0, 4*time.Second)
+
+	want := Process{PID: 101, PPID: 100, Comm: "curl", Filename: "/usr/bin/curl", Start: 2 * time.Second, End: 4 * time.Second, ExitCode: 6 << 8}
+	if p, ok := tree.Get(101); !ok || p != want {
+		t.Errorf("Get(101) = %+v, %v, want %+v", p, ok, want)
+	}
+	if got := want.Lifetime(time.Minute); got != 2*time.Second {
+		t.Errorf("Lifetime = %v", got)
+	}
+
+	// Exited processes stay for Linger
+	tree.Prune(14 * time.Second)
+	if _, ok := tree.Get(101); !ok {
+		t.Error("pruned before Linger")
+	}
+	tree.Prune(14*time.Second + 1)
+	if p, ok := tree.Get(101); ok {
+		t.Errorf("Get(101) = %+v after Prune", p)
+	}
+	if tree.Len() != 1 {
+		t.Errorf("Len = %d, want 1", tree.Len())
+	}
+
+	// A process forked before the tree was seeded gets its parent from /proc
+	writeStat(t, procRoot, 200, stat(200, "python3", 100, 500))
+	tree.Exec(200, "python3", "/usr/bin/python3", 6*time.Second)
+	want = Process{PID: 200, PPID: 100, Comm: "python3", Filename: "/usr/bin/python3", Start: 6 * time.Second}
+	if p, ok := tree.Get(200); !ok || p != want {
+		t.Errorf("Get(200) = %+v, %v, want %+v", p, ok, want)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	tree, procRoot := newTestTree(t)
+	writeStat(t, procRoot, 1, stat(1, "systemd", 0, 2))
+	writeStat(t, procRoot, 900, stat(900, "sh", 1, 300))
+	writeStat(t, procRoot, 901, "901 (broken")
+	if err := os.MkdirAll(filepath.Join(procRoot, "sys"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Events that arrived before seeding win
+	tree.Exec(900, "curl", "/usr/bin/curl", 5*time.Second)
+
+	if err := tree.Seed(); err != nil {
+		t.Fatalf("Seed: %v", err)
+	}
+	if tree.Len() != 2 {
+		t.Errorf("Len = %d, want 2", tree.Len())
+	}
+	if p, _ := tree.Get(900); p.Comm != "curl" || p.PPID != 1 {
+		t.Errorf("Get(900) = %+v", p)
+	}
+}
+
+// shimTree is a container's processes below the host's init.
+func shimTree(t *testing.T) *Tree {
+	tree, _ := newTestTree(t)
+	tree.Fork(0, 1, "systemd", 0)
+	tree.Fork(1, 812, "containerd-shim", time.Second)
+	tree.Fork(812, 900, "sh", 2*time.Second)
+	tree.Fork(900, 901, "curl", 3*time.Second)
+	tree.Fork(900, 902, "sleep", 3*time.Second)
+	tree.Exit(902, 0, 4*time.Second)
+	tree.Fork(812, 903, "nginx", 3*time.Second)
+	tree.Exit(903, 1<<8, 5*time.Second)
+	return tree
+}
+
+func TestAncestors(t *testing.T) {
+	tree := shimTree(t)
+	// Parent 700 exited and was pruned
+	tree.Fork(700, 950, "orphan", 6*time.Second)
+	// PID reuse can make two processes each other's parent
+	tree.Fork(11, 10, "a", 7*time.Second)
+	tree.Fork(10, 11, "b", 8*time.Second)
+
+	tests := []struct {
+		pid   int
+		want  []int
+		chain string
+	}{
+		{901, []int{900, 812, 1}, "systemd(1)─containerd-shim(812)─sh(900)─curl(901)"},
+		{1, nil, "systemd(1)"},
+		{950, nil, "orphan(950)"},
+		{999, nil, "?(999)"},
+		{10, []int{11}, "b(11)─a(10)"},
+	}
+
+	for _, tt := range tests {
+		var got []int
+		for _, p := range tree.Ancestors(tt.pid) {
+			got = append(got, p.PID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Ancestors(%d) = %v, want %v", tt.pid, got, tt.want)
+		}
+		if chain := tree.Chain(tt.pid); chain != tt.chain {
+			t.Errorf("Chain(%d) = %q, want %q", tt.pid, chain, tt.chain)
+		}
+	}
+}
+
+func TestWritePstree(t *testing.T) {
+	tree := shimTree(t)
+
+	tests := []struct {
+		root    int
+		want    string
+		wantErr bool
+	}{
+		{
+			root: 0,
+			want: `systemd(1)
+└─containerd-shim(812)
+  ├─sh(900)
+  │ ├─curl(901)
+  │ └─sleep(902) [exited 0]
+  └─nginx(903) [exited 1]
+`,
+		},
+		{
+			root: 900,
+			want: `sh(900)
+├─curl(901)
+└─sleep(902) [exited 0]
+`,
+		},
+		{root: 999, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		err := tree.WritePstree(&b, tt.root)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("WritePstree(%d) succeeded", tt.root)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("WritePstree(%d): %v", tt.root, err)
+		} else if b.String() != tt.want {
+			t.Errorf("WritePstree(%d) =\n%s\nwant\n%s", tt.root, b.String(), tt.want)
+		}
+	}
+}
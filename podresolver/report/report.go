@@ -0,0 +1,338 @@
+// Package report is the output shared by the pod mapping commands
+// (cgroup2pod, pidsofpods and pidsofpodsfromcgroups): one schema, written as
+// JSON, YAML or a table, and one set of exit codes.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"podresolver"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Exit codes of the pod mapping commands.
+const (
+	// ExitOK means every pod was resolved.
+	ExitOK = 0
+	// ExitFailure means nothing could be listed, e.g. the runtime is down.
+	ExitFailure = 1
+	// ExitUsage means the command line was invalid, as with the flag package.
+	ExitUsage = 2
+	// ExitPartial means the output is incomplete: some pods or containers
+	// could not be resolved and carry an error.
+	ExitPartial = 3
+)
+
+// Formats accepted by Write.
+var Formats = []string{"table", "json", "yaml"}
+
+// Report is the document written by the commands.
+type Report struct {
+	Pods []Pod `json:"pods"`
+}
+
+// Pod is a pod and what was resolved about it. Fields a command can't know
+// are left empty.
+type Pod struct {
+	Namespace   string                   `json:"namespace"`
+	Name        string                   `json:"pod"`
+	UID         string                   `json:"uid"`
+	Cgroup      *Cgroup                  `json:"cgroup,omitempty"`
+	Node        string                   `json:"node,omitempty"`
+	Workload    *Workload                `json:"workload,omitempty"`
+	Labels      map[string]string        `json:"labels,omitempty"`
+	Annotations map[string]string        `json:"annotations,omitempty"`
+	Stats       *podresolver.CgroupStats `json:"stats,omitempty"`
+	Containers  []Container              `json:"containers"`
+	// Error is set when the pod could only be partly resolved.
+	Error string `json:"error,omitempty"`
+}
+
+// Container is a container of a pod and its processes.
+type Container struct {
+	ID      string                   `json:"id"`
+	Name    string                   `json:"name,omitempty"`
+	Image   string                   `json:"image,omitempty"`
+	Runtime string                   `json:"runtime,omitempty"`
+	Cgroup  *Cgroup                  `json:"cgroup,omitempty"`
+	PIDs    []int                    `json:"pids"`
+	TIDs    []int                    `json:"tids,omitempty"`
+	Stats   *podresolver.CgroupStats `json:"stats,omitempty"`
+}
+
+// Cgroup locates a cgroup. ID is the cgroup v2 ID BPF programs see, and is
+// zero when unknown.
+type Cgroup struct {
+	Path string `json:"path"`
+	ID   uint64 `json:"id,omitempty"`
+}
+
+// Workload is the top-level owner of a pod, such as a Deployment.
+type Workload struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// NewCgroup describes the cgroup directory dir, looking up its ID.
+func NewCgroup(dir string) *Cgroup {
+	c := &Cgroup{Path: dir}
+	if id, err := podresolver.CgroupID(dir); err == nil {
+		c.ID = id
+	}
+	return c
+}
+
+// ContainerFromResolver converts a container found in the cgroup tree.
+func ContainerFromResolver(c podresolver.Container) Container {
+	return Container{
+		ID:      c.ID,
+		Runtime: c.Runtime,
+		Cgroup:  NewCgroup(c.Cgroup),
+		PIDs:    c.PIDs,
+		TIDs:    c.TIDs,
+		Stats:   c.Stats,
+	}
+}
+
+// ValidFormat reports whether format can be passed to Write.
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes pods to w in format, one of Formats.
+func Write(w io.Writer, format string, pods []Pod) error {
+	r := Report{Pods: pods}
+	if r.Pods == nil {
+		r.Pods = []Pod{}
+	}
+	for i := range r.Pods {
+		if r.Pods[i].Containers == nil {
+			r.Pods[i].Containers = []Container{}
+		}
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "yaml":
+		data, err := yaml.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case "table":
+		return writeTable(w, r.Pods)
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// ExitCode returns ExitPartial if any pod has an error and ExitOK otherwise.
+func ExitCode(pods []Pod) int {
+	for _, pod := range pods {
+		if pod.Error != "" {
+			return ExitPartial
+		}
+	}
+	return ExitOK
+}
+
+// tableColumns are the table columns in order. Columns that are empty for
+// every row are left out, so each command only shows what it knows.
+var tableColumns = []string{
+	"NAMESPACE", "POD", "CONTAINER", "CONTAINER ID", "PIDS", "TIDS",
+	"CGROUP", "CGROUP ID", "CPU", "THROTTLED", "MEMORY", "MEMORY EVENTS",
+	"IO READ", "IO WRITE", "CPU PRESSURE", "MEMORY PRESSURE",
+	"WORKLOAD", "NODE", "LABELS", "ERROR",
+}
+
+// podRow is the CONTAINER of the row holding the stats of a whole pod.
+const podRow = "(pod)"
+
+// writeTable prints a row per container, or per pod for pods without
+// containers. Stats of a pod with containers get a row of their own.
+func writeTable(w io.Writer, pods []Pod) error {
+	var rows []map[string]string
+	for _, pod := range pods {
+		base := map[string]string{
+			"NAMESPACE": pod.Namespace,
+			"POD":       pod.Name,
+			"NODE":      pod.Node,
+			"LABELS":    formatLabels(pod.Labels),
+			"ERROR":     pod.Error,
+		}
+		if pod.Workload != nil {
+			base["WORKLOAD"] = pod.Workload.Kind + "/" + pod.Workload.Name
+		}
+
+		if len(pod.Containers) == 0 {
+			row := copyRow(base)
+			addCgroup(row, pod.Cgroup)
+			addStats(row, pod.Stats)
+			rows = append(rows, row)
+			continue
+		}
+
+		if pod.Stats != nil {
+			row := copyRow(base)
+			row["CONTAINER"] = podRow
+			addCgroup(row, pod.Cgroup)
+			addStats(row, pod.Stats)
+			rows = append(rows, row)
+		}
+		for _, c := range pod.Containers {
+			row := copyRow(base)
+			row["CONTAINER"] = c.Name
+			row["CONTAINER ID"] = podresolver.ShortID(c.ID)
+			row["PIDS"] = formatIDs(c.PIDs)
+			if len(c.TIDs) > 0 {
+				row["TIDS"] = formatIDs(c.TIDs)
+			}
+			addCgroup(row, c.Cgroup)
+			addStats(row, c.Stats)
+			rows = append(rows, row)
+		}
+	}
+
+	var columns []string
+	for _, col := range tableColumns {
+		for _, row := range rows {
+			if row[col] != "" {
+				columns = append(columns, col)
+				break
+			}
+		}
+	}
+	if len(columns) == 0 {
+		columns = []string{"NAMESPACE", "POD", "CONTAINER", "PIDS"}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _, row := range rows {
+		cells := make([]string, len(columns))
+		for i, col := range columns {
+			cells[i] = row[col]
+			if cells[i] == "" {
+				cells[i] = "-"
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+func copyRow(row map[string]string) map[string]string {
+	c := make(map[string]string, len(row))
+	for k, v := range row {
+		c[k] = v
+	}
+	return c
+}
+
+func addCgroup(row map[string]string, c *Cgroup) {
+	if c == nil {
+		return
+	}
+	row["CGROUP"] = c.Path
+	if c.ID != 0 {
+		row["CGROUP ID"] = fmt.Sprint(c.ID)
+	}
+}
+
+func addStats(row map[string]string, s *podresolver.CgroupStats) {
+	if s == nil {
+		return
+	}
+	if s.CPU != nil {
+		row["CPU"] = usecs(s.CPU.UsageUsec)
+		row["THROTTLED"] = fmt.Sprintf("%d/%d for %s", s.CPU.NrThrottled, s.CPU.NrPeriods, usecs(s.CPU.ThrottledUsec))
+	}
+	if s.Memory != nil {
+		row["MEMORY"] = HumanBytes(s.Memory.Current)
+		if s.Memory.Events != nil {
+			row["MEMORY EVENTS"] = fmt.Sprintf("high=%d,max=%d,oom=%d,oom_kill=%d",
+				s.Memory.Events["high"], s.Memory.Events["max"], s.Memory.Events["oom"], s.Memory.Events["oom_kill"])
+		}
+	}
+	if s.IO != nil {
+		// Summed over devices; the JSON and YAML output have them apart
+		var total podresolver.IOStats
+		for _, dev := range s.IO {
+			total.RBytes += dev.RBytes
+			total.WBytes += dev.WBytes
+			total.RIOs += dev.RIOs
+			total.WIOs += dev.WIOs
+		}
+		row["IO READ"] = fmt.Sprintf("%s (%d ops)", HumanBytes(total.RBytes), total.RIOs)
+		row["IO WRITE"] = fmt.Sprintf("%s (%d ops)", HumanBytes(total.WBytes), total.WIOs)
+	}
+	row["CPU PRESSURE"] = formatPressure(s.CPUPressure)
+	row["MEMORY PRESSURE"] = formatPressure(s.MemoryPressure)
+}
+
+// usecs rounds a duration in microseconds to milliseconds.
+func usecs(us uint64) string {
+	return (time.Duration(us) * time.Microsecond).Round(time.Millisecond).String()
+}
+
+// formatPressure prints the 10s/60s/300s stall averages of a PSI file.
+func formatPressure(p *podresolver.Pressure) string {
+	if p == nil {
+		return ""
+	}
+	var parts []string
+	if p.Some != nil {
+		parts = append(parts, fmt.Sprintf("some %.2f%%/%.2f%%/%.2f%%", p.Some.Avg10, p.Some.Avg60, p.Some.Avg300))
+	}
+	if p.Full != nil {
+		parts = append(parts, fmt.Sprintf("full %.2f%%/%.2f%%/%.2f%%", p.Full.Avg10, p.Full.Avg60, p.Full.Avg300))
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatIDs(ids []int) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = fmt.Sprint(id)
+	}
+	return strings.Join(strs, ",")
+}
+
+// formatLabels prints labels as sorted key=value pairs.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// HumanBytes formats a byte count with a binary unit, e.g. "1.5MiB".
+func HumanBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
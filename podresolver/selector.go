@@ -0,0 +1,126 @@
+package podresolver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Selector selects pods by namespace and labels, like `kubectl get pods -n
+// <namespace> -l <selector>`. The zero Selector matches every pod.
+type Selector struct {
+	Namespace    string
+	Requirements []Requirement
+}
+
+// Requirement is one term of a label selector.
+type Requirement struct {
+	Key string
+	// Op is one of "=", "!=", "exists" or "!exists".
+	Op    string
+	Value string
+}
+
+// ParseSelector builds a Selector from a namespace and a comma separated
+// label selector. Supported terms are key=value, key==value, key!=value, key
+// and !key; set-based terms such as "app in (a,b)" are rejected.
+func ParseSelector(namespace, labels string) (Selector, error) {
+	sel := Selector{Namespace: namespace}
+
+	for _, term := range strings.Split(labels, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		// Splitting on commas breaks the value list of set-based terms
+		// apart, so don't let any part of one through as an equality or
+		// exists term.
+		if strings.ContainsAny(term, "()") {
+			return Selector{}, fmt.Errorf("set-based label selector term %q is not supported", term)
+		}
+
+		var req Requirement
+		switch {
+		case strings.Contains(term, "!="):
+			key, value, _ := strings.Cut(term, "!=")
+			req = Requirement{Key: key, Op: "!=", Value: value}
+		case strings.Contains(term, "=="):
+			key, value, _ := strings.Cut(term, "==")
+			req = Requirement{Key: key, Op: "=", Value: value}
+		case strings.Contains(term, "="):
+			key, value, _ := strings.Cut(term, "=")
+			req = Requirement{Key: key, Op: "=", Value: value}
+		case strings.HasPrefix(term, "!"):
+			req = Requirement{Key: term[1:], Op: "!exists"}
+		default:
+			req = Requirement{Key: term, Op: "exists"}
+		}
+
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+		if req.Key == "" || strings.ContainsAny(req.Key, " \t") || strings.ContainsAny(req.Value, " \t") {
+			return Selector{}, fmt.Errorf("invalid label selector term %q", term)
+		}
+		sel.Requirements = append(sel.Requirements, req)
+	}
+
+	return sel, nil
+}
+
+// Empty reports whether the selector matches every pod.
+func (s Selector) Empty() bool {
+	return s.Namespace == "" && len(s.Requirements) == 0
+}
+
+// Matches reports whether pod is selected.
+func (s Selector) Matches(pod KubePod) bool {
+	if s.Namespace != "" && pod.Namespace != s.Namespace {
+		return false
+	}
+
+	for _, req := range s.Requirements {
+		value, ok := pod.Labels[req.Key]
+		switch req.Op {
+		case "=":
+			if !ok || value != req.Value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.Value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String formats the selector as kubectl flags, e.g. "-n payments -l app=api".
+func (s Selector) String() string {
+	var terms []string
+	for _, req := range s.Requirements {
+		switch req.Op {
+		case "exists":
+			terms = append(terms, req.Key)
+		case "!exists":
+			terms = append(terms, "!"+req.Key)
+		default:
+			terms = append(terms, req.Key+req.Op+req.Value)
+		}
+	}
+
+	var flags []string
+	if s.Namespace != "" {
+		flags = append(flags, "-n "+s.Namespace)
+	}
+	if len(terms) > 0 {
+		flags = append(flags, "-l "+strings.Join(terms, ","))
+	}
+	return strings.Join(flags, " ")
+}
@@ -0,0 +1,101 @@
+package podresolver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		labels  string
+		want    []Requirement
+		str     string
+		wantErr bool
+	}{
+		{labels: "", str: "-n payments"},
+		{
+			labels: "app=api, tier==backend,env!=dev",
+			want: []Requirement{
+				{Key: "app", Op: "=", Value: "api"},
+				{Key: "tier", Op: "=", Value: "backend"},
+				{Key: "env", Op: "!=", Value: "dev"},
+			},
+			str: "-n payments -l app=api,tier=backend,env!=dev",
+		},
+		{
+			labels: "canary,!legacy,",
+			want: []Requirement{
+				{Key: "canary", Op: "exists"},
+				{Key: "legacy", Op: "!exists"},
+			},
+			str: "-n payments -l canary,!legacy",
+		},
+		{labels: "app=", want: []Requirement{{Key: "app", Op: "=", Value: ""}}, str: "-n payments -l app="},
+		{labels: "=api", wantErr: true},
+		{labels: "!", wantErr: true},
+		{labels: "app in (api,web)", wantErr: true},
+		{labels: "app notin (api)", wantErr: true},
+		{labels: "tier=backend,app in (api,web)", wantErr: true},
+		{labels: "app in api", wantErr: true},
+		{labels: "app=a b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		sel, err := ParseSelector("payments", tt.labels)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSelector(%q) = %+v, want an error", tt.labels, sel)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSelector(%q): %v", tt.labels, err)
+			continue
+		}
+		if sel.Namespace != "payments" || !reflect.DeepEqual(sel.Requirements, tt.want) {
+			t.Errorf("ParseSelector(%q) = %+v, want %+v", tt.labels, sel, tt.want)
+		}
+		if s := sel.String(); s != tt.str {
+			t.Errorf("ParseSelector(%q).String() = %q, want %q", tt.labels, s, tt.str)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	api := KubePod{Namespace: "payments", Name: "api-5d8f7", Labels: map[string]string{"app": "api", "canary": ""}}
+	web := KubePod{Namespace: "payments", Name: "web-9c2b1", Labels: map[string]string{"app": "web"}}
+	other := KubePod{Namespace: "default", Name: "api-7b4e2", Labels: map[string]string{"app": "api"}}
+
+	tests := []struct {
+		namespace, labels string
+		want              []string
+	}{
+		{"", "", []string{"api-5d8f7", "web-9c2b1", "api-7b4e2"}},
+		{"payments", "", []string{"api-5d8f7", "web-9c2b1"}},
+		{"", "app=api", []string{"api-5d8f7", "api-7b4e2"}},
+		{"", "app!=api", []string{"web-9c2b1"}},
+		{"", "canary", []string{"api-5d8f7"}},
+		{"", "!canary", []string{"web-9c2b1", "api-7b4e2"}},
+		{"default", "app=api,!canary", []string{"api-7b4e2"}},
+		{"", "app=db", nil},
+	}
+
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.namespace, tt.labels)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q, %q): %v", tt.namespace, tt.labels, err)
+		}
+		var got []string
+		for _, pod := range []KubePod{api, web, other} {
+			if sel.Matches(pod) {
+				got = append(got, pod.Name)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q matches %v, want %v", sel, got, tt.want)
+		}
+		if sel.Empty() != (tt.namespace == "" && tt.labels == "") {
+			t.Errorf("%q: Empty = %v", sel, sel.Empty())
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package podresolver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CgroupStats is a snapshot of the resource usage of a cgroup v2 directory.
+// A field is nil when its controller isn't enabled for the cgroup.
+type CgroupStats struct {
+	CPU            *CPUStats    `json:"cpu,omitempty"`
+	Memory         *MemoryStats `json:"memory,omitempty"`
+	IO             []IOStats    `json:"io,omitempty"`
+	CPUPressure    *Pressure    `json:"cpuPressure,omitempty"`
+	MemoryPressure *Pressure    `json:"memoryPressure,omitempty"`
+}
+
+// CPUStats is read from cpu.stat.
+type CPUStats struct {
+	UsageUsec     uint64 `json:"usageUsec"`
+	UserUsec      uint64 `json:"userUsec"`
+	SystemUsec    uint64 `json:"systemUsec"`
+	NrPeriods     uint64 `json:"nrPeriods"`
+	NrThrottled   uint64 `json:"nrThrottled"`
+	ThrottledUsec uint64 `json:"throttledUsec"`
+}
+
+// MemoryStats is read from memory.current and memory.events.
+type MemoryStats struct {
+	Current uint64 `json:"current"`
+	// Events counts how often the cgroup hit its low, high and max limits
+	// and how many processes the OOM killer killed in it.
+	Events map[string]uint64 `json:"events,omitempty"`
+}
+
+// IOStats is one device line of io.stat.
+type IOStats struct {
+	// Device is the "major:minor" number of the block device.
+	Device string `json:"device"`
+	RBytes uint64 `json:"rbytes"`
+	WBytes uint64 `json:"wbytes"`
+	RIOs   uint64 `json:"rios"`
+	WIOs   uint64 `json:"wios"`
+}
+
+// Pressure is read from a PSI file such as cpu.pressure. Full is nil for
+// files that don't report it.
+type Pressure struct {
+	Some *PressureLine `json:"some,omitempty"`
+	Full *PressureLine `json:"full,omitempty"`
+}
+
+// PressureLine holds the share of wall time tasks were stalled over the last
+// 10, 60 and 300 seconds, in percent, and the total stall time.
+type PressureLine struct {
+	Avg10     float64 `json:"avg10"`
+	Avg60     float64 `json:"avg60"`
+	Avg300    float64 `json:"avg300"`
+	TotalUsec uint64  `json:"totalUsec"`
+}
+
+// ReadCgroupStats reads the CPU, memory, IO and pressure statistics of a
+// cgroup v2 directory. Files missing because a controller isn't enabled are
+// skipped.
+func ReadCgroupStats(dir string) (*CgroupStats, error) {
+	stats := &CgroupStats{}
+
+	cpu, err := readFlatKeyed(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	if cpu != nil {
+		stats.CPU = &CPUStats{
+			UsageUsec:     cpu["usage_usec"],
+			UserUsec:      cpu["user_usec"],
+			SystemUsec:    cpu["system_usec"],
+			NrPeriods:     cpu["nr_periods"],
+			NrThrottled:   cpu["nr_throttled"],
+			ThrottledUsec: cpu["throttled_usec"],
+		}
+	}
+
+	current, err := readSingleValue(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		stats.Memory = &MemoryStats{Current: *current}
+		stats.Memory.Events, err = readFlatKeyed(filepath.Join(dir, "memory.events"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stats.IO, err = readIOStat(filepath.Join(dir, "io.stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	stats.CPUPressure, err = readPressure(filepath.Join(dir, "cpu.pressure"))
+	if err != nil {
+		return nil, err
+	}
+	stats.MemoryPressure, err = readPressure(filepath.Join(dir, "memory.pressure"))
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// readFile reads a cgroup file. Tests replace it.
+var readFile = os.ReadFile
+
+// readStatFile reads a cgroup file, returning nil data if it doesn't exist.
+func readStatFile(path string) ([]byte, error) {
+	data, err := readFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		// PSI files exist but can't be read when PSI is disabled at boot.
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// readFlatKeyed parses a "key value" per line file such as cpu.stat.
+func readFlatKeyed(path string) (map[string]uint64, error) {
+	data, err := readStatFile(path)
+	if data == nil || err != nil {
+		return nil, err
+	}
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in %s: %q", path, scanner.Text())
+		}
+		values[fields[0]] = v
+	}
+	return values, nil
+}
+
+// readSingleValue parses a file holding one number such as memory.current.
+func readSingleValue(path string) (*uint64, error) {
+	data, err := readStatFile(path)
+	if data == nil || err != nil {
+		return nil, err
+	}
+
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value in %s: %q", path, strings.TrimSpace(string(data)))
+	}
+	return &v, nil
+}
+
+// readIOStat parses io.stat, which has a line per device:
+//
+//	8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0
+func readIOStat(path string) ([]IOStats, error) {
+	data, err := readStatFile(path)
+	if data == nil || err != nil {
+		return nil, err
+	}
+
+	var devices []IOStats
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		dev := IOStats{Device: fields[0]}
+		for _, kv := range fields[1:] {
+			key, value, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				dev.RBytes = v
+			case "wbytes":
+				dev.WBytes = v
+			case "rios":
+				dev.RIOs = v
+			case "wios":
+				dev.WIOs = v
+			}
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// readPressure parses a PSI file:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func readPressure(path string) (*Pressure, error) {
+	data, err := readStatFile(path)
+	if data == nil || err != nil {
+		return nil, err
+	}
+
+	p := &Pressure{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		pl := &PressureLine{}
+		for _, kv := range fields[1:] {
+			key, value, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "avg10":
+				pl.Avg10, _ = strconv.ParseFloat(value, 64)
+			case "avg60":
+				pl.Avg60, _ = strconv.ParseFloat(value, 64)
+			case "avg300":
+				pl.Avg300, _ = strconv.ParseFloat(value, 64)
+			case "total":
+				pl.TotalUsec, _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+
+		switch fields[0] {
+		case "some":
+			p.Some = pl
+		case "full":
+			p.Full = pl
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,147 @@
+package podresolver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestReadCgroupStats(t *testing.T) {
+	tests := []struct {
+		dir     string
+		want    *CgroupStats
+		wantErr bool
+	}{
+		{
+			dir: "testdata/cgroup/pod",
+			want: &CgroupStats{
+				CPU: &CPUStats{
+					UsageUsec:     8126341,
+					UserUsec:      5371902,
+					SystemUsec:    2754439,
+					NrPeriods:     4210,
+					NrThrottled:   37,
+					ThrottledUsec: 1893021,
+				},
+				Memory: &MemoryStats{
+					Current: 218103808,
+					Events:  map[string]uint64{"low": 0, "high": 12, "max": 3, "oom": 1, "oom_kill": 1, "oom_group_kill": 0},
+				},
+				IO: []IOStats{
+					{Device: "8:0", RBytes: 4382720, WBytes: 1191936, RIOs: 310, WIOs: 58},
+					// Keys the kernel left out, or that don't parse, are zero
+					{Device: "259:0", RBytes: 65536, RIOs: 4},
+					{Device: "253:1", WIOs: 2},
+				},
+				CPUPressure: &Pressure{
+					Some: &PressureLine{Avg10: 1.25, Avg60: 0.84, Avg300: 0.31, TotalUsec: 2817344},
+					Full: &PressureLine{},
+				},
+				MemoryPressure: &Pressure{
+					Some: &PressureLine{Avg60: 0.12, Avg300: 0.05, TotalUsec: 90132},
+				},
+			},
+		},
+		{
+			// memory.events is missing although memory.current isn't
+			dir:  "testdata/cgroup/memory-only",
+			want: &CgroupStats{Memory: &MemoryStats{Current: 4096}},
+		},
+		{dir: t.TempDir(), want: &CgroupStats{}},
+		{dir: "testdata/cgroup/invalid", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		stats, err := ReadCgroupStats(tt.dir)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ReadCgroupStats(%s) = %+v, want an error", tt.dir, stats)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadCgroupStats(%s): %v", tt.dir, err)
+			continue
+		}
+		if !reflect.DeepEqual(stats, tt.want) {
+			t.Errorf("ReadCgroupStats(%s) = %s, want %s", tt.dir, dump(stats), dump(tt.want))
+		}
+	}
+}
+
+// dump formats stats with the values behind its pointers.
+func dump(stats *CgroupStats) string {
+	s := fmt.Sprintf("{IO:%+v", stats.IO)
+	if stats.CPU != nil {
+		s += fmt.Sprintf(" CPU:%+v", *stats.CPU)
+	}
+	if stats.Memory != nil {
+		s += fmt.Sprintf(" Memory:%+v", *stats.Memory)
+	}
+	for name, p := range map[string]*Pressure{"CPUPressure": stats.CPUPressure, "MemoryPressure": stats.MemoryPressure} {
+		if p == nil {
+			continue
+		}
+		s += " " + name + ":{"
+		if p.Some != nil {
+			s += fmt.Sprintf("Some:%+v", *p.Some)
+		}
+		if p.Full != nil {
+			s += fmt.Sprintf(" Full:%+v", *p.Full)
+		}
+		s += "}"
+	}
+	return s + "}"
+}
+
+// TestReadCgroupStatsErrors reads the pod fixture with one file failing.
+func TestReadCgroupStatsErrors(t *testing.T) {
+	defer func(f func(string) ([]byte, error)) { readFile = f }(readFile)
+
+	tests := []struct {
+		file    string
+		err     error
+		wantErr bool
+	}{
+		// PSI disabled at boot
+		{file: "cpu.pressure", err: syscall.EOPNOTSUPP},
+		{file: "memory.pressure", err: syscall.EOPNOTSUPP},
+		{file: "cpu.pressure", err: syscall.EACCES, wantErr: true},
+		{file: "io.stat", err: syscall.ENODEV, wantErr: true},
+		{file: "memory.events", err: syscall.EIO, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		readFile = func(path string) ([]byte, error) {
+			if filepath.Base(path) == tt.file {
+				return nil, &os.PathError{Op: "read", Path: path, Err: tt.err}
+			}
+			return os.ReadFile(path)
+		}
+
+		stats, err := ReadCgroupStats("testdata/cgroup/pod")
+		if tt.wantErr {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s failing with %v: error = %v", tt.file, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s failing with %v: %v", tt.file, tt.err, err)
+			continue
+		}
+		if stats.CPU == nil || stats.Memory == nil || len(stats.IO) != 3 {
+			t.Errorf("%s failing with %v: other files weren't read: %s", tt.file, tt.err, dump(stats))
+		}
+		pressure := map[string]*Pressure{"cpu.pressure": stats.CPUPressure, "memory.pressure": stats.MemoryPressure}
+		for file, p := range pressure {
+			if (p == nil) != (file == tt.file) {
+				t.Errorf("%s failing with %v: %s = %+v", tt.file, tt.err, file, p)
+			}
+		}
+	}
+}
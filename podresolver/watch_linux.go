@@ -0,0 +1,484 @@
+package podresolver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// EventType is the kind of change published by a Watcher.
+type EventType int
+
+const (
+	PodAdded EventType = iota
+	PodRemoved
+	PIDAdded
+	PIDRemoved
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PodAdded:
+		return "pod-added"
+	case PodRemoved:
+		return "pod-removed"
+	case PIDAdded:
+		return "pid-added"
+	case PIDRemoved:
+		return "pid-removed"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a change in the pod to PID mapping. PID and ContainerID are only
+// set for PIDAdded and PIDRemoved.
+type Event struct {
+	Type        EventType
+	PodUID      string
+	PodCgroup   string
+	ContainerID string
+	PID         int
+}
+
+// Pod is a pod found in the cgroup tree together with its containers.
+type Pod struct {
+	UID        string
+	Cgroup     string
+	Containers []Container
+}
+
+// WatchOptions configures a Watcher.
+type WatchOptions struct {
+	// Resync rescans every known cgroup at this interval. The kernel doesn't
+	// raise inotify events when a process forks into or moves between
+	// cgroups, so this is what picks up those changes on a real cgroupfs.
+	// Zero disables resyncing.
+	Resync time.Duration
+	// EventBuffer is the capacity of the Events channel. Defaults to 1024.
+	EventBuffer int
+}
+
+// Watcher keeps an in-memory PID→pod and cgroup→pod cache for a kubepods
+// cgroup tree up to date by watching it with inotify.
+type Watcher struct {
+	root    string
+	opts    WatchOptions
+	fd      int
+	file    *os.File
+	events  chan Event
+	pending []Event
+
+	mu       sync.RWMutex
+	wds      map[int32]string
+	dirs     map[string]int32
+	pods     map[string]*podState
+	owners   map[string]*containerState
+	pidToPod map[int]*podState
+}
+
+type podState struct {
+	uid        string
+	dir        string
+	containers map[string]*containerState
+}
+
+type containerState struct {
+	pod     *podState
+	id      string
+	runtime string
+	dir     string
+	pids    map[int]bool
+}
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE
+
+// NewWatcher watches root, usually the kubepods cgroup, and seeds the cache
+// with the pods that already exist below it.
+func NewWatcher(root string, opts WatchOptions) (*Watcher, error) {
+	if opts.EventBuffer <= 0 {
+		opts.EventBuffer = 1024
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+
+	w := &Watcher{
+		root:     filepath.Clean(root),
+		opts:     opts,
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		events:   make(chan Event, opts.EventBuffer),
+		wds:      map[int32]string{},
+		dirs:     map[string]int32{},
+		pods:     map[string]*podState{},
+		owners:   map[string]*containerState{},
+		pidToPod: map[int]*podState{},
+	}
+
+	// Events found while seeding are kept so Run can publish them.
+	if err := w.addTree(w.root, w.queue); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Events returns the channel add and remove events are published on. It is
+// closed when Run returns.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Close releases the inotify instance, for a Watcher that was never run.
+// A running Run returns once it is closed.
+func (w *Watcher) Close() error {
+	err := w.file.Close()
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Run processes inotify events until ctx is done. Events are published on
+// the Events channel; a slow reader blocks the watcher rather than losing
+// events.
+func (w *Watcher) Run(ctx context.Context) error {
+	defer close(w.events)
+	defer w.file.Close()
+
+	raw := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := w.file.Read(buf)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			select {
+			case raw <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var resync <-chan time.Time
+	if w.opts.Resync > 0 {
+		ticker := time.NewTicker(w.opts.Resync)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	publish := func(e Event) {
+		select {
+		case w.events <- e:
+		case <-ctx.Done():
+		}
+	}
+	for _, e := range w.pending {
+		publish(e)
+	}
+	w.pending = nil
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			if errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read inotify events: %w", err)
+		case <-resync:
+			w.resync(publish)
+		case chunk := <-raw:
+			w.handle(chunk, publish)
+		}
+	}
+}
+
+// PodForPID returns the pod a process belongs to.
+func (w *Watcher) PodForPID(pid int) (Pod, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	p, ok := w.pidToPod[pid]
+	if !ok {
+		return Pod{}, false
+	}
+	return p.snapshot(), true
+}
+
+// PodForCgroup returns the pod owning a cgroup directory, which may be the
+// pod cgroup itself or any cgroup below it.
+func (w *Watcher) PodForCgroup(dir string) (Pod, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	dir = filepath.Clean(dir)
+	if p, ok := w.pods[dir]; ok {
+		return p.snapshot(), true
+	}
+	if c, ok := w.owners[dir]; ok {
+		return c.pod.snapshot(), true
+	}
+	return Pod{}, false
+}
+
+// Pods returns all pods currently in the cache.
+func (w *Watcher) Pods() []Pod {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	pods := make([]Pod, 0, len(w.pods))
+	for _, p := range w.pods {
+		pods = append(pods, p.snapshot())
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].UID < pods[j].UID })
+	return pods
+}
+
+func (p *podState) snapshot() Pod {
+	pod := Pod{UID: p.uid, Cgroup: p.dir}
+	for _, c := range p.containers {
+		pod.Containers = append(pod.Containers, Container{
+			ID:      c.id,
+			Runtime: c.runtime,
+			Cgroup:  c.dir,
+			PIDs:    sortedKeys(c.pids),
+		})
+	}
+	sort.Slice(pod.Containers, func(i, j int) bool { return pod.Containers[i].ID < pod.Containers[j].ID })
+	return pod
+}
+
+// queue holds events found by NewWatcher until Run starts publishing.
+func (w *Watcher) queue(e Event) {
+	w.pending = append(w.pending, e)
+}
+
+// addTree adds a watch on dir and everything below it, registering pods and
+// containers as they are found.
+func (w *Watcher) addTree(dir string, publish func(Event)) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return w.addDir(path, publish)
+	})
+}
+
+func (w *Watcher) addDir(dir string, publish func(Event)) error {
+	w.mu.Lock()
+	if _, ok := w.dirs[dir]; ok {
+		w.mu.Unlock()
+		return nil
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		w.mu.Unlock()
+		if errors.Is(err, syscall.ENOENT) {
+			return nil
+		}
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+	w.wds[int32(wd)] = dir
+	w.dirs[dir] = int32(wd)
+
+	var owner *containerState
+	name := filepath.Base(dir)
+	parent := filepath.Dir(dir)
+	if uid, ok := ParsePodDir(name); ok {
+		if _, exists := w.pods[dir]; !exists {
+			w.pods[dir] = &podState{uid: uid, dir: dir, containers: map[string]*containerState{}}
+			w.mu.Unlock()
+			publish(Event{Type: PodAdded, PodUID: uid, PodCgroup: dir})
+			return nil
+		}
+	} else if c, ok := w.owners[parent]; ok {
+		// Nested cgroups inside a container belong to that container.
+		owner = c
+		w.owners[dir] = c
+	} else if p, ok := w.pods[parent]; ok {
+		if runtime, id, ok := ParseContainerDir(name); ok {
+			owner = &containerState{pod: p, id: id, runtime: runtime, dir: dir, pids: map[int]bool{}}
+			p.containers[dir] = owner
+			w.owners[dir] = owner
+		}
+	}
+	w.mu.Unlock()
+
+	if owner != nil {
+		return w.rescan(owner, publish)
+	}
+	return nil
+}
+
+// removeDir forgets a deleted cgroup and everything that was below it.
+func (w *Watcher) removeDir(dir string, publish func(Event)) {
+	w.mu.Lock()
+	var removed []Event
+	for path, wd := range w.dirs {
+		if path != dir && !isBelow(path, dir) {
+			continue
+		}
+		delete(w.dirs, path)
+		delete(w.wds, wd)
+		syscall.InotifyRmWatch(w.fd, uint32(wd))
+
+		if c, ok := w.owners[path]; ok {
+			delete(w.owners, path)
+			if c.dir == path {
+				for pid := range c.pids {
+					delete(w.pidToPod, pid)
+					removed = append(removed, Event{Type: PIDRemoved, PodUID: c.pod.uid, PodCgroup: c.pod.dir, ContainerID: c.id, PID: pid})
+				}
+				delete(c.pod.containers, path)
+			}
+		}
+	}
+	if p, ok := w.pods[dir]; ok {
+		delete(w.pods, dir)
+		removed = append(removed, Event{Type: PodRemoved, PodUID: p.uid, PodCgroup: p.dir})
+	}
+	w.mu.Unlock()
+
+	for _, e := range removed {
+		publish(e)
+	}
+}
+
+// rescan rereads the processes of a container and its nested cgroups and
+// publishes the difference from what is cached.
+func (w *Watcher) rescan(c *containerState, publish func(Event)) error {
+	current, err := readContainer(c.dir, WalkOptions{})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	w.mu.Lock()
+	var changes []Event
+	seen := map[int]bool{}
+	for _, pid := range current.PIDs {
+		seen[pid] = true
+		if !c.pids[pid] {
+			c.pids[pid] = true
+			w.pidToPod[pid] = c.pod
+			changes = append(changes, Event{Type: PIDAdded, PodUID: c.pod.uid, PodCgroup: c.pod.dir, ContainerID: c.id, PID: pid})
+		}
+	}
+	for pid := range c.pids {
+		if !seen[pid] {
+			delete(c.pids, pid)
+			if w.pidToPod[pid] == c.pod {
+				delete(w.pidToPod, pid)
+			}
+			changes = append(changes, Event{Type: PIDRemoved, PodUID: c.pod.uid, PodCgroup: c.pod.dir, ContainerID: c.id, PID: pid})
+		}
+	}
+	w.mu.Unlock()
+
+	for _, e := range changes {
+		publish(e)
+	}
+	return nil
+}
+
+// resync rescans every known container and picks up directories whose
+// creation was missed.
+func (w *Watcher) resync(publish func(Event)) {
+	// A pod removed mid-walk fails the walk; the containers already known
+	// are still rescanned
+	if err := w.addTree(w.root, publish); err != nil {
+		log.Printf("podresolver: resync: %v\n", err)
+	}
+
+	w.mu.RLock()
+	var containers []*containerState
+	for _, p := range w.pods {
+		for _, c := range p.containers {
+			containers = append(containers, c)
+		}
+	}
+	w.mu.RUnlock()
+
+	for _, c := range containers {
+		if err := w.rescan(c, publish); err != nil {
+			log.Printf("podresolver: resync: %v\n", err)
+		}
+	}
+}
+
+// handle decodes a buffer of inotify events.
+func (w *Watcher) handle(buf []byte, publish func(Event)) {
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		end := syscall.SizeofInotifyEvent + int(raw.Len)
+		if end > len(buf) {
+			return
+		}
+		name := string(bytes.TrimRight(buf[syscall.SizeofInotifyEvent:end], "\x00"))
+		buf = buf[end:]
+
+		if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			w.resync(publish)
+			continue
+		}
+
+		w.mu.RLock()
+		dir, ok := w.wds[raw.Wd]
+		w.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, name)
+
+		switch {
+		case raw.Mask&syscall.IN_ISDIR != 0 && raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			w.addTree(path, publish)
+		case raw.Mask&syscall.IN_ISDIR != 0 && raw.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+			w.removeDir(path, publish)
+		case raw.Mask&syscall.IN_DELETE_SELF != 0:
+			w.removeDir(dir, publish)
+		case raw.Mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0 && (name == "cgroup.procs" || name == "cgroup.events"):
+			w.mu.RLock()
+			c, ok := w.owners[dir]
+			w.mu.RUnlock()
+			if ok {
+				w.rescan(c, publish)
+			}
+		}
+	}
+}
+
+func isBelow(path, dir string) bool {
+	return len(path) > len(dir) && path[:len(dir)] == dir && path[len(dir)] == filepath.Separator
+}
@@ -0,0 +1,168 @@
+package podresolver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePod creates a pod cgroup below root as the systemd driver names it
+// and returns its directory.
+func fakePod(t *testing.T, root, uid string) string {
+	t.Helper()
+	dir := filepath.Join(root, "kubepods-burstable-pod"+strings.ReplaceAll(uid, "-", "_")+".slice")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// fakeContainer creates a container cgroup in podDir holding pids.
+func fakeContainer(t *testing.T, podDir, id string, pids string) string {
+	t.Helper()
+	dir := filepath.Join(podDir, "cri-containerd-"+id+".scope")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeProcs(t, dir, pids)
+	return dir
+}
+
+func writeProcs(t *testing.T, dir, pids string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(pids), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect reads events until it has seen all of want, in any order.
+func expect(t *testing.T, events <-chan Event, want ...Event) {
+	t.Helper()
+	missing := map[Event]bool{}
+	for _, e := range want {
+		missing[e] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for len(missing) > 0 {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed, still missing %v", missing)
+			}
+			delete(missing, e)
+		case <-timeout:
+			t.Fatalf("timed out, still missing %v", missing)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	const (
+		uid1 = "11111111-2222-3333-4444-555555555555"
+		uid2 = "66666666-7777-8888-9999-000000000000"
+	)
+	id1 := strings.Repeat("a", 64)
+	id2 := strings.Repeat("b", 64)
+
+	root := t.TempDir()
+	pod1 := fakePod(t, root, uid1)
+	c1 := fakeContainer(t, pod1, id1, "10\n11\n")
+
+	w, err := NewWatcher(root, WatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+	events := w.Events()
+
+	// Pods found when the watcher starts
+	expect(t, events,
+		Event{Type: PodAdded, PodUID: uid1, PodCgroup: pod1},
+		Event{Type: PIDAdded, PodUID: uid1, PodCgroup: pod1, ContainerID: id1, PID: 10},
+		Event{Type: PIDAdded, PodUID: uid1, PodCgroup: pod1, ContainerID: id1, PID: 11},
+	)
+
+	// A pod created later
+	pod2 := fakePod(t, root, uid2)
+	expect(t, events, Event{Type: PodAdded, PodUID: uid2, PodCgroup: pod2})
+	c2 := fakeContainer(t, pod2, id2, "20\n")
+	expect(t, events, Event{Type: PIDAdded, PodUID: uid2, PodCgroup: pod2, ContainerID: id2, PID: 20})
+
+	if pod, ok := w.PodForPID(20); !ok || pod.UID != uid2 {
+		t.Errorf("PodForPID(20) = %v, %v, want pod %s", pod.UID, ok, uid2)
+	}
+	if pod, ok := w.PodForCgroup(c2); !ok || pod.UID != uid2 {
+		t.Errorf("PodForCgroup(%s) = %v, %v, want pod %s", c2, pod.UID, ok, uid2)
+	}
+
+	// A process leaving a container
+	writeProcs(t, c1, "10\n")
+	expect(t, events, Event{Type: PIDRemoved, PodUID: uid1, PodCgroup: pod1, ContainerID: id1, PID: 11})
+	if _, ok := w.PodForPID(11); ok {
+		t.Error("PodForPID(11) found a pod after the process left")
+	}
+
+	// A pod removed. cgroupfs only allows removing empty cgroups, one at a
+	// time, but a plain directory takes its files along.
+	if err := os.RemoveAll(pod2); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, events,
+		Event{Type: PIDRemoved, PodUID: uid2, PodCgroup: pod2, ContainerID: id2, PID: 20},
+		Event{Type: PodRemoved, PodUID: uid2, PodCgroup: pod2},
+	)
+
+	pods := w.Pods()
+	if len(pods) != 1 || pods[0].UID != uid1 {
+		t.Fatalf("Pods() = %+v, want only %s", pods, uid1)
+	}
+	if got := pods[0].Containers; len(got) != 1 || got[0].ID != id1 || len(got[0].PIDs) != 1 || got[0].PIDs[0] != 10 {
+		t.Errorf("containers of %s = %+v, want %s with PID 10", uid1, got, id1)
+	}
+}
+
+func TestWatcherResyncContinuesAfterWalkError(t *testing.T) {
+	uid1 := "11111111-2222-3333-4444-555555555555"
+	uid2 := "66666666-7777-8888-9999-000000000000"
+	id1 := strings.Repeat("c", 64)
+	id2 := strings.Repeat("d", 64)
+
+	root := t.TempDir()
+	pod1 := fakePod(t, root, uid1)
+	c1 := fakeContainer(t, pod1, id1, "30\n")
+
+	w, err := NewWatcher(root, WatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.file.Close()
+
+	var got []Event
+	publish := func(e Event) { got = append(got, e) }
+
+	// Without Run, inotify events are left unread, so only resync can see
+	// the new PID. The walk fails on the unreadable cgroup.procs of a new
+	// pod; the known container must still be rescanned.
+	writeProcs(t, c1, "30\n31\n")
+	fakeContainer(t, fakePod(t, root, uid2), id2, "not a pid\n")
+
+	w.resync(publish)
+	want := Event{Type: PIDAdded, PodUID: uid1, PodCgroup: pod1, ContainerID: id1, PID: 31}
+	for _, e := range got {
+		if e == want {
+			return
+		}
+	}
+	t.Errorf("resync published %v, want %v among them", got, want)
+}
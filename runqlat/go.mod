@@ -5,6 +5,7 @@ go 1.22.2
 require (
 	github.com/cilium/ebpf v0.16.0
 	github.com/stretchr/testify v1.9.0
+	podresolver v0.0.0
 )
 
 require (
@@ -18,3 +19,5 @@ require (
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace podresolver => ../podresolver
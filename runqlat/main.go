@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"math"
@@ -8,6 +10,9 @@ import (
 	"testing"
 	"time"
 
+	"podresolver"
+	"podresolver/cgroupfilter"
+
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/stretchr/testify/assert"
@@ -16,15 +21,35 @@ import (
 const maxSlots = 64
 
 func main() {
+	namespace := flag.String("n", "", "Only trace pods in this namespace")
+	labels := flag.String("l", "", "Only trace pods matching this label selector, e.g. app=api")
+	pid := flag.Uint("pid", 0, "Only print the histogram of this process")
+	cpid := flag.Int("cpid", 0, "Only print the histograms of processes with this PID inside their container")
+	flag.Parse()
+
+	selector, err := podresolver.ParseSelector(*namespace, *labels)
+	if err != nil {
+		log.Fatalf("Invalid selector: %v", err)
+	}
+
 	// Load eBPF collection
 	spec, err := ebpf.LoadCollectionSpec("runqlat.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF spec: %v", err)
 	}
 
+	if !selector.Empty() {
+		if err := cgroupfilter.Enable(spec); err != nil {
+			log.Fatalf("Failed to enable pod filter: %v", err)
+		}
+	}
+
 	for i := 0; i < 1; i++ {
-		allBuckets := runqlat(spec, 5*time.Second)
-		printHistogram(allBuckets, 6875, true)
+		allBuckets := runqlat(spec, selector, 5*time.Second)
+		if *cpid != 0 {
+			allBuckets = filterContainerPID(allBuckets, *cpid)
+		}
+		printHistogram(allBuckets, uint32(*pid), true)
 		// printPercentiles(allBuckets, 6875, []float64{50.0, 95.0, 99.0})
 	}
 
@@ -36,13 +61,25 @@ type Histogram struct {
 	Counts []uint64
 }
 
-func runqlat(spec *ebpf.CollectionSpec, duration time.Duration) map[uint32]Histogram {
+func runqlat(spec *ebpf.CollectionSpec, selector podresolver.Selector, duration time.Duration) map[uint32]Histogram {
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
 		log.Fatalf("Failed to create eBPF collection: %v", err)
 	}
 	defer coll.Close()
 
+	// Only trace the selected pods
+	if !selector.Empty() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		filter, err := cgroupfilter.Start(ctx, coll.Maps[cgroupfilter.MapName], selector)
+		if err != nil {
+			log.Fatalf("Failed to start pod filter: %v", err)
+		}
+		fmt.Printf("Tracing %d pods matching %s\n", len(filter.Pods()), selector)
+	}
+
 	// Get maps and programs
 	// start := coll.Maps["start"]
 	latencyHist := coll.Maps["dist"]
@@ -128,6 +165,28 @@ func runqlat(spec *ebpf.CollectionSpec, duration time.Duration) map[uint32]Histo
 	return histograms
 }
 
+// filterContainerPID keeps the histograms of the processes that have pid in
+// their own PID namespace. Processes that already exited are dropped.
+func filterContainerPID(histograms map[uint32]Histogram, pid int) map[uint32]Histogram {
+	filtered := map[uint32]Histogram{}
+	for id, histogram := range histograms {
+		if nsPID, err := podresolver.ContainerPID("/proc", int(id)); err == nil && nsPID == pid {
+			filtered[id] = histogram
+		}
+	}
+	return filtered
+}
+
+// pidLabel formats a host PID together with the PID the process sees inside
+// its container, if that differs.
+func pidLabel(id uint32) string {
+	nsPID, err := podresolver.ContainerPID("/proc", int(id))
+	if err != nil || nsPID == int(id) {
+		return fmt.Sprintf("%d", id)
+	}
+	return fmt.Sprintf("%d (container pid %d)", id, nsPID)
+}
+
 func printHistogram(histograms map[uint32]Histogram, pid uint32, log2 bool) {
 
 	fmt.Printf("Run Queue Latency Histogram:\n")
@@ -138,7 +197,7 @@ func printHistogram(histograms map[uint32]Histogram, pid uint32, log2 bool) {
 			continue
 		}
 
-		fmt.Printf("Pid=%d | Latency (us)  |  Count\n", id)
+		fmt.Printf("Pid=%s | Latency (us)  |  Count\n", pidLabel(id))
 		for i, _ := range histogram.Bins {
 			if log2 {
 				start := int(math.Pow(2, float64(histogram.Bins[i])))
@@ -2,6 +2,7 @@
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
+#include "cgroup_filter.h"
 
 static __inline __u64 bpf_log2l(__u64 v) {
     __u64 r = 0;
@@ -32,6 +33,7 @@ struct {
 
 static int trace_enqueue(struct task_struct *p) {
     if (!p) return 0; 
+    if (!task_cgroup_allowed(p)) return 0;
 
     __u32 tgid = 0, pid = 0;
     bpf_probe_read_kernel(&tgid, sizeof(tgid), &p->tgid);
@@ -70,7 +72,7 @@ int sched_switch(struct bpf_raw_tracepoint_args *ctx) {
     // ivcsw: treat like an enqueue event and store timestamp
     unsigned int prev_state = 0;
     bpf_probe_read_kernel(&prev_state, sizeof(prev_state), &prev->__state);
-    if (prev_state == 0) { // TASK_RUNNING
+    if (prev_state == 0 && task_cgroup_allowed(prev)) { // TASK_RUNNING
         bpf_probe_read_kernel(&pid, sizeof(pid), &prev->pid);
 
         if (pid != 0) { //  non-idle
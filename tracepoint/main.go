@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
+	"time"
+
+	"podresolver/decode"
+	"podresolver/eventreader"
+	"podresolver/proctree"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/perf"
 )
 
 // Define event structure (must match the C struct)
@@ -19,13 +23,55 @@ type eventT struct {
 	Comm [16]byte
 }
 
+// decoder decodes eventT records without binary.Read
+var decoder = decode.MustDecoder[eventT]()
+
+// showPstree redraws the process tree below root until ctx is done
+func showPstree(ctx context.Context, tree *proctree.Tracker, root int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Clear the screen and move the cursor home, like top
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Process tree (%d processes), refreshed every %s\n\n", tree.Len(), interval)
+		if err := tree.WritePstree(os.Stdout, root); err != nil {
+			log.Printf("Failed to print process tree: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func main() {
+	showTree := flag.Bool("tree", false, "Print the parent chain of each process")
+	pstree := flag.Bool("pstree", false, "Show a live pstree view instead of exec events")
+	root := flag.Int("root", 1, "PID at the top of the -pstree view, 0 for every tree")
+	interval := flag.Duration("interval", 2*time.Second, "Refresh interval of the -pstree view")
+	statsInterval := flag.Duration("stats", 0, "Print event throughput and losses at this interval, 0 to only print them on exit")
+	flag.Parse()
+
+	// Stop on Ctrl-C or SIGTERM
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
+
 	// Load eBPF object file
 	spec, err := ebpf.LoadCollectionSpec("trace_exec.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF object file: %v", err)
 	}
 
+	// Use the ring buffer if the kernel has it, the perf buffer otherwise
+	if _, err := eventreader.Prepare(spec, "events"); err != nil {
+		log.Fatalf("Failed to prepare event transport: %v", err)
+	}
+	if !*showTree && !*pstree {
+		proctree.Remove(spec)
+	}
+
 	// Create an eBPF collection from the spec
 	coll, err := ebpf.NewCollection(spec)
 	if err != nil {
@@ -33,6 +79,16 @@ func main() {
 	}
 	defer coll.Close()
 
+	// Track the process tree from fork, exec and exit events
+	var tree *proctree.Tracker
+	if *showTree || *pstree {
+		tree, err = proctree.Start(ctx, coll)
+		if err != nil {
+			log.Fatalf("Failed to start process tree: %v", err)
+		}
+		defer tree.Close()
+	}
+
 	// Get the eBPF program and map from the collection
 	prog := coll.Programs["trace_exec"]
 	if prog == nil {
@@ -53,43 +109,54 @@ func main() {
 	}
 	defer tp.Close()
 
-	// Set up perf event reader
-	reader, err := perf.NewReader(events, 4096)
+	// Set up the event reader
+	reader, err := eventreader.New(events, eventreader.Options{Dropped: coll.Maps["dropped"]})
 	if err != nil {
-		log.Fatalf("Failed to create perf event reader: %v", err)
+		log.Fatalf("Failed to create event reader: %v", err)
 	}
 	defer reader.Close()
 
-	fmt.Println("Listening for exec events...")
-
-	// Capture termination signals
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-
-	go func() {
-		for {
-			record, err := reader.Read()
-			if err != nil {
-				log.Printf("Failed to read event: %v", err)
-				continue
-			}
+	if *pstree {
+		showPstree(ctx, tree, *root, *interval)
+		return
+	}
 
-			if record.LostSamples > 0 {
-				log.Printf("Lost %d events", record.LostSamples)
-				continue
+	fmt.Printf("Listening for exec events via %s...\n", reader.Transport())
+
+	// Report throughput and losses periodically, if asked to
+	if *statsInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(*statsInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					log.Printf("Stats: %s", reader.Stats())
+				}
 			}
+		}()
+	}
 
-			var event eventT
-			err = binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event)
-			if err != nil {
-				log.Printf("Failed to decode event: %v", err)
-				continue
-			}
+	// Print events until stopped, then the ones still buffered
+	err = reader.Run(ctx, func(record eventreader.Record) error {
+		var event eventT
+		if err := decoder.Decode(record.RawSample, &event); err != nil {
+			log.Printf("Failed to decode event: %v", err)
+			return nil
+		}
 
-			fmt.Printf("Process executed: PID=%d, Comm=%s\n", event.PID, bytes.Trim(event.Comm[:], "\x00"))
+		fmt.Printf("Process executed: PID=%d, Comm=%s\n", event.PID, bytes.Trim(event.Comm[:], "\x00"))
+		if *showTree {
+			fmt.Printf("  %s\n", tree.Chain(int(event.PID)))
 		}
-	}()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to read events: %v", err)
+	}
 
-	<-stop
 	fmt.Println("\nExiting...")
+	fmt.Printf("Read %s\n", reader.Stats())
 }
@@ -1,7 +1,8 @@
 //go:build ignore
 
-#include <linux/bpf.h>
+#include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
+#include "proctree.h"
 
 #define TASK_COMM_LEN 16  // Define TASK_COMM_LEN manually
 
@@ -11,11 +12,24 @@ struct event_t {
     char comm[TASK_COMM_LEN];
 };
 
-// Define a perf buffer map to send events to user-space
+// Ring buffer to send events to user-space. On kernels without ring buffers
+// (before 5.8) user-space turns it into a perf event array and clears
+// use_ringbuf before loading.
 struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
+// Events that didn't fit in the ring buffer, per CPU
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, __u64);
+} dropped SEC(".maps");
+
+const volatile bool use_ringbuf = true;
+
 // eBPF program attached to tracepoint "sched_process_exec"
 SEC("tracepoint/sched/sched_process_exec")
 int trace_exec(void *ctx) {
@@ -26,8 +40,17 @@ int trace_exec(void *ctx) {
     bpf_get_current_comm(&event.comm, sizeof(event.comm));
     event.pid = pid;
 
-    // Send event to user-space via perf buffer
-    bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &event, sizeof(event));
+    // Send event to user-space. The perf buffer counts its own losses.
+    if (use_ringbuf) {
+        if (bpf_ringbuf_output(&events, &event, sizeof(event), 0)) {
+            __u32 key = 0;
+            __u64 *count = bpf_map_lookup_elem(&dropped, &key);
+            if (count)
+                (*count)++;
+        }
+    } else {
+        bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &event, sizeof(event));
+    }
     return 0;
 }
 
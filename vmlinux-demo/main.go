@@ -1,43 +1,75 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
+	"strings"
+	"time"
+
+	"podresolver/eventreader"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
-	"github.com/cilium/ebpf/perf"
 )
 
-// Define the Go struct to match the eBPF event struct
-type SwitchEvent struct {
-	PrevPid  uint32
-	PrevTgid uint32
-	NextPid  uint32
-	NextTgid uint32
-}
-
 func main() {
+	interval := flag.Duration("interval", 2*time.Second, "Refresh interval")
+	sortBy := flag.String("sort", "cpu", "Sort by "+strings.Join(sortKeys, ", "))
+	groupBy := flag.String("by", "tgid", "Group by "+strings.Join(groupKeys, ", "))
+	limit := flag.Int("n", 20, "Number of rows to show, 0 for all")
+	recordFor := flag.Duration("record", 0, "Record a per-CPU scheduling timeline for this long instead of showing the view")
+	output := flag.String("o", "sched.json", "File to write the -record timeline to, in Chrome Trace Event format")
+	flag.Parse()
+
+	view, err := newTopView(*sortBy, *groupBy, *limit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Handle Ctrl+C for clean exit
+	ctx, stop := eventreader.SignalContext(context.Background())
+	defer stop()
+
 	// Load eBPF program from compiled object file
 	spec, err := ebpf.LoadCollectionSpec("sched_switch.o")
 	if err != nil {
 		log.Fatalf("Failed to load eBPF spec: %v", err)
 	}
 
+	// Send every switch to user space only when recording
+	ringbuf, err := eventreader.Prepare(spec, "switches")
+	if err != nil {
+		log.Fatalf("Failed to prepare event transport: %v", err)
+	}
+	if *recordFor > 0 {
+		if err := spec.RewriteConstants(map[string]interface{}{"record_switches": true}); err != nil {
+			log.Fatalf("Failed to enable recording: %v", err)
+		}
+	} else if ringbuf {
+		spec.Maps["switches"].MaxEntries = uint32(os.Getpagesize())
+	}
+
 	// Create eBPF collection
 	objects := struct {
 		SchedSwitch *ebpf.Program `ebpf:"sched_switch"`
-		Events      *ebpf.Map     `ebpf:"events"`
+		Stats       *ebpf.Map     `ebpf:"stats"`
+		OncpuStart  *ebpf.Map     `ebpf:"oncpu_start"`
+		Switches    *ebpf.Map     `ebpf:"switches"`
+		Dropped     *ebpf.Map     `ebpf:"dropped"`
 	}{}
 	if err := spec.LoadAndAssign(&objects, nil); err != nil {
 		log.Fatalf("Failed to load eBPF objects: %v", err)
 	}
 	defer objects.SchedSwitch.Close()
-	defer objects.Events.Close()
+	defer objects.Stats.Close()
+	defer objects.OncpuStart.Close()
+	defer objects.Switches.Close()
+	defer objects.Dropped.Close()
 
 	// Attach eBPF program to raw tracepoint
 	tp, err := link.AttachRawTracepoint(link.RawTracepointOptions{
@@ -49,45 +81,88 @@ func main() {
 	}
 	defer tp.Close()
 
-	// Set up perf event reader
-	rd, err := perf.NewReader(objects.Events, 4096)
-	if err != nil {
-		log.Fatalf("Failed to create perf reader: %v", err)
-	}
-	defer rd.Close()
+	pods := newPodIndex()
 
-	// Handle Ctrl+C for clean exit
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	if *recordFor > 0 {
+		reader, err := eventreader.New(objects.Switches, eventreader.Options{Dropped: objects.Dropped})
+		if err != nil {
+			log.Fatalf("Failed to create event reader: %v", err)
+		}
+		defer reader.Close()
 
-	fmt.Println("Listening for sched_switch events...")
+		fmt.Printf("Recording context switches for %s, Ctrl+C to stop early...\n", *recordFor)
+		if err := record(ctx, reader, pods, *recordFor, *output); err != nil {
+			log.Fatalf("Failed to record: %v", err)
+		}
+		fmt.Printf("Wrote %s, open it in https://ui.perfetto.dev\n", *output)
+		fmt.Printf("Read %s\n", reader.Stats())
+		return
+	}
 
-	tgidSet := map[uint32]bool{}
+	// Sort with a key press when run in a terminal
+	keys, restore, err := readKeys(os.Stdin)
+	if err != nil {
+		log.Printf("Sorting keys disabled: %v", err)
+	}
+	defer restore()
 
-	// Read and print events
-	go func() {
-		for {
-			record, err := rd.Read()
-			if err != nil {
-				log.Printf("Error reading event: %v", err)
-				continue
-			}
+	fmt.Printf("Counting context switches, first refresh in %s...\n", *interval)
 
-			var event SwitchEvent
-			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event); err != nil {
-				log.Printf("Error decoding event: %v", err)
-				continue
+	// Redraw the counters the kernel aggregated on each tick
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-keys:
+			if key == 'q' {
+				return
 			}
-
-			// fmt.Printf("Prev TGID: %d, Prev PID: %d -> Next TGID: %d, Next PID: %d\n",
-			// 	event.PrevTgid, event.PrevPid, event.NextTgid, event.NextPid)
-			if _, ok := tgidSet[event.NextTgid]; !ok {
-				fmt.Printf("TGID: %d\n", event.NextTgid)
-				tgidSet[event.NextTgid] = true
+			// Re-sort what is on screen rather than read counters early
+			if view.handleKey(key) {
+				view.render(os.Stdout)
 			}
+			continue
+		case <-ticker.C:
+		}
+
+		pods.refresh(ctx)
+		if err := view.update(objects.Stats, pods); err != nil {
+			log.Printf("Failed to read stats: %v", err)
+			continue
 		}
-	}()
+		view.render(os.Stdout)
+	}
+}
 
-	<-stop
-	fmt.Println("\nExiting...")
+// record writes the switches read in the window, or until ctx is done, to a
+// trace file at path
+func record(ctx context.Context, reader *eventreader.Reader, pods *podIndex, window time.Duration, path string) error {
+	pods.refresh(ctx)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	trace, err := newTraceWriter(f, pods)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+	if err := reader.Run(ctx, trace.handle); err != nil {
+		return err
+	}
+
+	if err := trace.Close(); err != nil {
+		return err
+	}
+	if trace.invalid > 0 {
+		log.Printf("Skipped %d switches that failed to decode", trace.invalid)
+	}
+	return f.Close()
 }
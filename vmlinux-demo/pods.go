@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"podresolver"
+)
+
+// podIndex names the pod of a cgroup ID
+type podIndex struct {
+	kubepods  string
+	refreshed time.Time
+	// byCgroup maps the cgroup IDs of pods, their containers and anything
+	// nested below to "namespace/name", or the pod UID if crictl can't
+	// name it
+	byCgroup map[uint64]string
+}
+
+// newPodIndex returns an index of the pods on this node, which is empty
+// when the node runs no pods or uses cgroup v1
+func newPodIndex() *podIndex {
+	p := &podIndex{byCgroup: map[uint64]string{}}
+	if root, err := podresolver.GetRootCgroupPath(); err == nil {
+		p.kubepods, _ = podresolver.KubepodsCgroupDir(root)
+	}
+	return p
+}
+
+// refresh rereads the pod cgroups, at most every 10 seconds
+func (p *podIndex) refresh(ctx context.Context) {
+	if p.kubepods == "" || time.Since(p.refreshed) < 10*time.Second {
+		return
+	}
+	p.refreshed = time.Now()
+
+	names := map[string]string{}
+	if pods, err := (podresolver.Crictl{}).ListPods(ctx); err == nil {
+		for _, pod := range pods {
+			names[pod.UID] = pod.Namespace + "/" + pod.Name
+		}
+	}
+
+	byCgroup := map[uint64]string{}
+	filepath.WalkDir(p.kubepods, func(path string, d fs.DirEntry, err error) error {
+		// Cgroups can disappear while we walk them
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		uid := podresolver.ClassifyCgroup(path).PodUID
+		if uid == "" {
+			return nil
+		}
+		id, err := podresolver.CgroupID(path)
+		if err != nil {
+			return nil
+		}
+		if name, ok := names[uid]; ok {
+			byCgroup[id] = name
+		} else {
+			byCgroup[id] = uid
+		}
+		return nil
+	})
+	p.byCgroup = byCgroup
+}
+
+// lookup returns the pod of a cgroup ID, or "-" for the host
+func (p *podIndex) lookup(cgroupID uint64) string {
+	if name, ok := p.byCgroup[cgroupID]; ok {
+		return name
+	}
+	return "-"
+}
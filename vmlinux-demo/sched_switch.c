@@ -1,35 +1,180 @@
+//go:build ignore
+
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
 
 char LICENSE[] SEC("license") = "GPL";
 
-// Define a perf event map for sending data to user-space
+#define TASK_RUNNING 0
+#define TASK_COMM_LEN 16
+
+// Context-switch counters of a process, summed over its threads. They are
+// kept in the kernel so that only the totals cross into user space.
+struct task_stats {
+    // Switches where the task gave up the CPU, e.g. to wait for I/O or a lock
+    u64 voluntary;
+    // Switches where the task was preempted while it could still run
+    u64 involuntary;
+    // Time spent on a CPU, in ns
+    u64 oncpu_ns;
+    // cgroup v2 ID, to find the pod of the process
+    u64 cgroup_id;
+    char comm[TASK_COMM_LEN];
+};
+
+// Counters by TGID. Entries of exited processes are not deleted: they stop
+// being updated, so user space shows nothing for them, and as the least
+// recently used entries they are the ones evicted when the map fills up.
 struct {
-    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
-    __uint(max_entries, 128);
-} events SEC(".maps");
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u32);
+    __type(value, struct task_stats);
+} stats SEC(".maps");
 
+// When the task running on each CPU was switched in, in ns
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, u64);
+} oncpu_start SEC(".maps");
+
+// A switch, only sent while recording a timeline
 struct switch_event {
+    u64 ts;
+    // cgroup v2 ID of prev
+    u64 prev_cgroup_id;
+    u32 cpu;
     u32 prev_pid;
     u32 prev_tgid;
     u32 next_pid;
     u32 next_tgid;
+    u32 prev_state;
+    u32 preempt;
+    char prev_comm[TASK_COMM_LEN];
+    char next_comm[TASK_COMM_LEN];
 };
 
+// Switches for user space. On kernels without ring buffers (before 5.8) user
+// space turns it into a perf event array and clears use_ringbuf before
+// loading. User space shrinks it when not recording.
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 16 * 1024 * 1024);
+} switches SEC(".maps");
+
+// Switches that didn't fit in the ring buffer, per CPU
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, u64);
+} dropped SEC(".maps");
+
+const volatile bool record_switches = false;
+const volatile bool use_ringbuf = true;
+
+// task_struct before Linux 5.14, when state was renamed __state
+struct task_struct___o {
+    volatile long state;
+} __attribute__((preserve_access_index));
+
+static __always_inline unsigned int task_state(struct task_struct *task)
+{
+    struct task_struct___o *old = (void *)task;
+
+    if (bpf_core_field_exists(task->__state))
+        return BPF_CORE_READ(task, __state);
+    return BPF_CORE_READ(old, state);
+}
+
+static __always_inline void record_switch(void *ctx, struct task_struct *prev, struct task_struct *next,
+                                          bool preempt, unsigned int state, u64 now)
+{
+    struct switch_event e = {};
+    u32 zero = 0;
+    u64 *count;
+
+    e.ts = now;
+    e.prev_cgroup_id = bpf_get_current_cgroup_id();
+    e.cpu = bpf_get_smp_processor_id();
+    bpf_probe_read_kernel(&e.prev_pid, sizeof(e.prev_pid), &prev->pid);
+    bpf_probe_read_kernel(&e.prev_tgid, sizeof(e.prev_tgid), &prev->tgid);
+    bpf_probe_read_kernel(&e.next_pid, sizeof(e.next_pid), &next->pid);
+    bpf_probe_read_kernel(&e.next_tgid, sizeof(e.next_tgid), &next->tgid);
+    e.prev_state = state;
+    e.preempt = preempt;
+    bpf_probe_read_kernel_str(&e.prev_comm, sizeof(e.prev_comm), &prev->comm);
+    bpf_probe_read_kernel_str(&e.next_comm, sizeof(e.next_comm), &next->comm);
+
+    if (!use_ringbuf) {
+        bpf_perf_event_output(ctx, &switches, BPF_F_CURRENT_CPU, &e, sizeof(e));
+        return;
+    }
+    if (bpf_ringbuf_output(&switches, &e, sizeof(e), 0)) {
+        count = bpf_map_lookup_elem(&dropped, &zero);
+        if (count)
+            (*count)++;
+    }
+}
+
+// sched_switch(bool preempt, struct task_struct *prev, struct task_struct *next, ...)
 SEC("raw_tracepoint/sched_switch")
 int sched_switch(struct bpf_raw_tracepoint_args *ctx) {
+    bool preempt = (bool)ctx->args[0];
     struct task_struct *prev = (struct task_struct *)ctx->args[1];
     struct task_struct *next = (struct task_struct *)ctx->args[2];
+    struct task_struct *leader = NULL;
+    static const struct task_stats empty = {};
+    struct task_stats *s;
+    u32 pid = 0, tgid = 0, zero = 0;
+    unsigned int state = 0;
+    u64 now = bpf_ktime_get_ns();
+    u64 *start;
+
+    start = bpf_map_lookup_elem(&oncpu_start, &zero);
+    if (!start)
+        return 0;
+
+    bpf_probe_read_kernel(&pid, sizeof(pid), &prev->pid);
+    bpf_probe_read_kernel(&tgid, sizeof(tgid), &prev->tgid);
+    state = task_state(prev);
+
+    if (record_switches)
+        record_switch(ctx, prev, next, preempt, state, now);
+
+    // PID 0 is the idle task of each CPU
+    if (!pid)
+        goto out;
+
+    s = bpf_map_lookup_elem(&stats, &tgid);
+    if (!s) {
+        bpf_map_update_elem(&stats, &tgid, &empty, BPF_NOEXIST);
+        s = bpf_map_lookup_elem(&stats, &tgid);
+        if (!s)
+            goto out;
+    }
+
+    if (preempt || state == TASK_RUNNING)
+        __sync_fetch_and_add(&s->involuntary, 1);
+    else
+        __sync_fetch_and_add(&s->voluntary, 1);
 
-    struct switch_event event = {};
-    bpf_probe_read_kernel(&event.prev_pid, sizeof(event.prev_pid), &prev->pid);
-    bpf_probe_read_kernel(&event.prev_tgid, sizeof(event.prev_tgid), &prev->tgid);
-    bpf_probe_read_kernel(&event.next_pid, sizeof(event.next_pid), &next->pid);
-    bpf_probe_read_kernel(&event.next_tgid, sizeof(event.next_tgid), &next->tgid);
+    // Nothing to add for the first switch seen on this CPU
+    if (*start)
+        __sync_fetch_and_add(&s->oncpu_ns, now - *start);
 
-    // Send event to user-space
-    bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &event, sizeof(event));
+    // prev is still the current task
+    s->cgroup_id = bpf_get_current_cgroup_id();
+    // Name the process after its main thread
+    bpf_probe_read_kernel(&leader, sizeof(leader), &prev->group_leader);
+    if (leader)
+        bpf_probe_read_kernel_str(&s->comm, sizeof(s->comm), &leader->comm);
 
+out:
+    *start = now;
     return 0;
 }
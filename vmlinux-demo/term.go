@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readKeys puts the terminal on f in cbreak mode, so key presses are read
+// one at a time without echo, and sends them on the returned channel. The
+// restore function puts the terminal back. When f isn't a terminal, no keys
+// are ever sent.
+func readKeys(f *os.File) (<-chan byte, func(), error) {
+	keys := make(chan byte)
+	fd := int(f.Fd())
+
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if errors.Is(err, unix.ENOTTY) {
+		return keys, func() {}, nil
+	}
+	if err != nil {
+		return keys, func() {}, err
+	}
+	raw := *old
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return keys, func() {}, err
+	}
+
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := f.Read(buf); err != nil || n == 0 {
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	return keys, func() { unix.IoctlSetTermios(fd, unix.TCSETS, old) }, nil
+}
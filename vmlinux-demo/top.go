@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// TaskStats matches struct task_stats in sched_switch.c
+type TaskStats struct {
+	Voluntary   uint64
+	Involuntary uint64
+	OncpuNs     uint64
+	CgroupID    uint64
+	Comm        [16]byte
+}
+
+// sortKeys are the columns the view can be sorted by
+var sortKeys = []string{"cpu", "sw", "vol", "invol"}
+
+// sortKeyPresses maps the keys that change the sort order in a terminal
+var sortKeyPresses = map[byte]string{'c': "cpu", 's': "sw", 'v': "vol", 'i': "invol"}
+
+// groupKeys are what rows can be aggregated by
+var groupKeys = []string{"tgid", "comm", "pod"}
+
+// topRow is the activity of a process, or a group of them, in the last
+// interval
+type topRow struct {
+	tgid        uint32
+	comm        string
+	pod         string
+	procs       int
+	voluntary   uint64
+	involuntary uint64
+	oncpu       time.Duration
+	// Switches since the process was first seen
+	total uint64
+}
+
+func (r *topRow) switches() uint64 {
+	return r.voluntary + r.involuntary
+}
+
+func (r *topRow) add(o topRow) {
+	r.procs += o.procs
+	r.voluntary += o.voluntary
+	r.involuntary += o.involuntary
+	r.oncpu += o.oncpu
+	r.total += o.total
+}
+
+// topView turns snapshots of the stats map into a top-like table
+type topView struct {
+	sortBy  string
+	groupBy string
+	limit   int
+
+	previous map[uint32]TaskStats
+	last     time.Time
+	elapsed  time.Duration
+	rows     []topRow
+}
+
+func newTopView(sortBy, groupBy string, limit int) (*topView, error) {
+	if !contains(sortKeys, sortBy) {
+		return nil, fmt.Errorf("invalid sort key %q", sortBy)
+	}
+	if !contains(groupKeys, groupBy) {
+		return nil, fmt.Errorf("invalid grouping %q", groupBy)
+	}
+	return &topView{
+		sortBy:   sortBy,
+		groupBy:  groupBy,
+		limit:    limit,
+		previous: map[uint32]TaskStats{},
+		last:     time.Now(),
+	}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// update reads the stats map and computes the activity since the last
+// update. A process not seen before counts all of its switches.
+func (v *topView) update(m *ebpf.Map, pods *podIndex) error {
+	now := time.Now()
+	current := map[uint32]TaskStats{}
+	groups := map[string]*topRow{}
+
+	var (
+		tgid  uint32
+		stats TaskStats
+	)
+	iter := m.Iterate()
+	for iter.Next(&tgid, &stats) {
+		current[tgid] = stats
+
+		delta := stats
+		if prev, ok := v.previous[tgid]; ok && stats.Voluntary >= prev.Voluntary && stats.Involuntary >= prev.Involuntary {
+			delta.Voluntary -= prev.Voluntary
+			delta.Involuntary -= prev.Involuntary
+			delta.OncpuNs -= prev.OncpuNs
+		}
+		if delta.Voluntary+delta.Involuntary == 0 {
+			continue
+		}
+
+		row := topRow{
+			tgid:        tgid,
+			comm:        string(bytes.TrimRight(stats.Comm[:], "\x00")),
+			pod:         pods.lookup(stats.CgroupID),
+			procs:       1,
+			voluntary:   delta.Voluntary,
+			involuntary: delta.Involuntary,
+			oncpu:       time.Duration(delta.OncpuNs),
+			total:       stats.Voluntary + stats.Involuntary,
+		}
+
+		var key string
+		switch v.groupBy {
+		case "tgid":
+			key = strconv.Itoa(int(tgid))
+		case "comm":
+			key = row.comm
+		case "pod":
+			key = row.pod
+		}
+		if g, ok := groups[key]; ok {
+			g.add(row)
+		} else {
+			groups[key] = &row
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	v.rows = v.rows[:0]
+	for _, g := range groups {
+		v.rows = append(v.rows, *g)
+	}
+	v.previous = current
+	v.elapsed = now.Sub(v.last)
+	v.last = now
+	v.sort()
+	return nil
+}
+
+// handleKey changes the sort order for a key press and reports whether it
+// did
+func (v *topView) handleKey(key byte) bool {
+	sortBy, ok := sortKeyPresses[key]
+	if !ok || sortBy == v.sortBy {
+		return false
+	}
+	v.sortBy = sortBy
+	v.sort()
+	return true
+}
+
+func (v *topView) sort() {
+	value := func(r *topRow) uint64 {
+		switch v.sortBy {
+		case "sw":
+			return r.switches()
+		case "vol":
+			return r.voluntary
+		case "invol":
+			return r.involuntary
+		}
+		return uint64(r.oncpu)
+	}
+	sort.Slice(v.rows, func(i, j int) bool {
+		a, b := value(&v.rows[i]), value(&v.rows[j])
+		if a != b {
+			return a > b
+		}
+		return v.rows[i].tgid < v.rows[j].tgid
+	})
+}
+
+// rate returns n per second over the last interval
+func (v *topView) rate(n uint64) float64 {
+	if v.elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / v.elapsed.Seconds()
+}
+
+// render clears the screen and prints the table, like top
+func (v *topView) render(w io.Writer) {
+	var total topRow
+	for _, r := range v.rows {
+		total.add(r)
+	}
+
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprintf(w, "%s  context switches: %.0f/s (%.0f voluntary, %.0f involuntary), %d active processes\n",
+		time.Now().Format("15:04:05"), v.rate(total.switches()), v.rate(total.voluntary), v.rate(total.involuntary), total.procs)
+	fmt.Fprintf(w, "Sorted by %s (c: cpu, s: switches, v: voluntary, i: involuntary, q: quit)\n\n", v.sortBy)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	var header []string
+	switch v.groupBy {
+	case "tgid":
+		header = []string{"PID", "COMM", "POD"}
+	case "comm":
+		header = []string{"COMM", "PROCS"}
+	case "pod":
+		header = []string{"POD", "PROCS"}
+	}
+	header = append(header, "SW/S", "VOL/S", "INVOL/S", "CPU%", "TOTAL SW")
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	rows := v.rows
+	if v.limit > 0 && len(rows) > v.limit {
+		rows = rows[:v.limit]
+	}
+	for _, r := range rows {
+		var cols []string
+		switch v.groupBy {
+		case "tgid":
+			cols = []string{strconv.Itoa(int(r.tgid)), r.comm, r.pod}
+		case "comm":
+			cols = []string{r.comm, strconv.Itoa(r.procs)}
+		case "pod":
+			cols = []string{r.pod, strconv.Itoa(r.procs)}
+		}
+		cpu := 0.0
+		if v.elapsed > 0 {
+			cpu = 100 * r.oncpu.Seconds() / v.elapsed.Seconds()
+		}
+		cols = append(cols,
+			fmt.Sprintf("%.0f", v.rate(r.switches())),
+			fmt.Sprintf("%.0f", v.rate(r.voluntary)),
+			fmt.Sprintf("%.0f", v.rate(r.involuntary)),
+			fmt.Sprintf("%.1f", cpu),
+			strconv.FormatUint(r.total, 10))
+		fmt.Fprintln(tw, strings.Join(cols, "\t"))
+	}
+	tw.Flush()
+}
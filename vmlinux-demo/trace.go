@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"podresolver/decode"
+	"podresolver/eventreader"
+)
+
+// SwitchEvent matches struct switch_event in sched_switch.c
+type SwitchEvent struct {
+	Ts           uint64
+	PrevCgroupID uint64
+	CPU          uint32
+	PrevPid      uint32
+	PrevTgid     uint32
+	NextPid      uint32
+	NextTgid     uint32
+	PrevState    uint32
+	Preempt      uint32
+	PrevComm     [16]byte
+	NextComm     [16]byte
+}
+
+var switchDecoder = decode.MustDecoder[SwitchEvent]()
+
+// traceEvent is an event of the Chrome Trace Event format, which the
+// Perfetto UI and chrome://tracing open. Times are in microseconds.
+type traceEvent struct {
+	Name string         `json:"name"`
+	Ph   string         `json:"ph"`
+	Ts   float64        `json:"ts"`
+	Dur  float64        `json:"dur,omitempty"`
+	Pid  int            `json:"pid"`
+	Tid  int            `json:"tid"`
+	Args map[string]any `json:"args,omitempty"`
+}
+
+// running is the task a CPU switched to, until its next switch
+type running struct {
+	since uint64
+	pid   uint32
+	tgid  uint32
+	comm  string
+}
+
+// traceWriter turns switches into one track per CPU, with a slice for each
+// time a task ran on it. Slices are written as soon as they end, so a
+// recording of any length takes little memory.
+type traceWriter struct {
+	w    *bufio.Writer
+	enc  *json.Encoder
+	pods *podIndex
+
+	// start is the time of the first switch, which the trace starts at
+	start  uint64
+	cpus   map[uint32]*running
+	events int
+	// invalid counts records too short to be a switch
+	invalid int
+}
+
+func newTraceWriter(w io.Writer, pods *podIndex) (*traceWriter, error) {
+	t := &traceWriter{w: bufio.NewWriter(w), pods: pods, cpus: map[uint32]*running{}}
+	t.enc = json.NewEncoder(t.w)
+	if _, err := t.w.WriteString("{\"displayTimeUnit\":\"ns\",\"traceEvents\":[\n"); err != nil {
+		return nil, err
+	}
+	// All CPUs are threads of one process named "CPUs"
+	return t, t.write(traceEvent{Name: "process_name", Ph: "M", Args: map[string]any{"name": "CPUs"}})
+}
+
+func (t *traceWriter) write(e traceEvent) error {
+	if t.events > 0 {
+		if _, err := t.w.WriteString(","); err != nil {
+			return err
+		}
+	}
+	t.events++
+	return t.enc.Encode(e)
+}
+
+// micros converts a kernel timestamp to microseconds into the trace
+func (t *traceWriter) micros(ts uint64) float64 {
+	return float64(ts-t.start) / 1e3
+}
+
+// handle ends the slice of the task that was running on the CPU of the
+// switch and starts one for the task switched to.
+func (t *traceWriter) handle(rec eventreader.Record) error {
+	var e SwitchEvent
+	if err := switchDecoder.Decode(rec.RawSample, &e); err != nil {
+		t.invalid++
+		return nil
+	}
+	if t.start == 0 {
+		t.start = e.Ts
+	}
+	// Switches from different CPUs can arrive slightly out of order
+	if e.Ts < t.start {
+		return nil
+	}
+
+	cpu, ok := t.cpus[e.CPU]
+	if !ok {
+		cpu = &running{}
+		t.cpus[e.CPU] = cpu
+		name := traceEvent{Name: "thread_name", Ph: "M", Tid: int(e.CPU), Args: map[string]any{"name": fmt.Sprintf("CPU %d", e.CPU)}}
+		order := traceEvent{Name: "thread_sort_index", Ph: "M", Tid: int(e.CPU), Args: map[string]any{"sort_index": e.CPU}}
+		if err := t.write(name); err != nil {
+			return err
+		}
+		if err := t.write(order); err != nil {
+			return err
+		}
+	}
+
+	// The idle task isn't drawn, so idle time shows as gaps. The task
+	// running when recording started has no known start.
+	if cpu.since != 0 && cpu.pid != 0 && e.Ts >= cpu.since {
+		reason := "blocked"
+		if e.Preempt != 0 || e.PrevState == 0 {
+			reason = "preempted"
+		}
+		err := t.write(traceEvent{
+			Name: cpu.comm,
+			Ph:   "X",
+			Ts:   t.micros(cpu.since),
+			Dur:  float64(e.Ts-cpu.since) / 1e3,
+			Tid:  int(e.CPU),
+			Args: map[string]any{
+				"pid":  cpu.pid,
+				"tgid": cpu.tgid,
+				"pod":  t.pods.lookup(e.PrevCgroupID),
+				"then": reason,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cpu.since = e.Ts
+	cpu.pid = e.NextPid
+	cpu.tgid = e.NextTgid
+	cpu.comm = string(bytes.TrimRight(e.NextComm[:], "\x00"))
+	return nil
+}
+
+// Close ends the trace. Tasks still running are left out, as their slices
+// have no end yet.
+func (t *traceWriter) Close() error {
+	if _, err := t.w.WriteString("]}\n"); err != nil {
+		return err
+	}
+	return t.w.Flush()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"podresolver/eventreader"
+)
+
+// switchRecord returns a switch as sched_switch.c sends it, with the tail
+// padding of struct switch_event.
+func switchRecord(t *testing.T, ts uint64, cpu uint32, prev, next string, prevPid, nextPid uint32, cgroup uint64, state, preempt uint32) eventreader.Record {
+	t.Helper()
+	e := SwitchEvent{
+		Ts:           ts,
+		PrevCgroupID: cgroup,
+		CPU:          cpu,
+		PrevPid:      prevPid,
+		PrevTgid:     prevPid,
+		NextPid:      nextPid,
+		NextTgid:     nextPid,
+		PrevState:    state,
+		Preempt:      preempt,
+	}
+	copy(e.PrevComm[:], prev)
+	copy(e.NextComm[:], next)
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.NativeEndian, e); err != nil {
+		t.Fatal(err)
+	}
+	b.Write(make([]byte, 4))
+	return eventreader.Record{CPU: int(cpu), RawSample: b.Bytes()}
+}
+
+func TestTraceWriter(t *testing.T) {
+	var out bytes.Buffer
+	pods := &podIndex{byCgroup: map[uint64]string{42: "default/web-7d4b9c-x2x9q"}}
+	trace, err := newTraceWriter(&out, pods)
+	if err != nil {
+		t.Fatalf("newTraceWriter: %v", err)
+	}
+
+	const blocked = 1 // TASK_INTERRUPTIBLE
+	records := []eventreader.Record{
+		// kworker was running when recording started, so it gets no slice
+		switchRecord(t, 1_000_000, 0, "kworker/0:1", "nginx", 5, 100, 0, blocked, 0),
+		switchRecord(t, 1_500_000, 1, "swapper/1", "postgres", 0, 200, 0, 0, 0),
+		switchRecord(t, 3_000_000, 0, "nginx", "swapper/0", 100, 0, 42, blocked, 0),
+		// CPU 0 was idle for 1ms, which is left as a gap
+		switchRecord(t, 4_000_000, 0, "swapper/0", "nginx", 0, 100, 0, 0, 0),
+		switchRecord(t, 4_500_000, 1, "postgres", "swapper/1", 200, 0, 7, 0, 1),
+		// Arrived late from another CPU, from before the trace started
+		switchRecord(t, 900_000, 1, "swapper/1", "sshd", 0, 300, 0, 0, 0),
+		{CPU: 0, RawSample: make([]byte, 16)},
+	}
+	for _, rec := range records {
+		if err := trace.handle(rec); err != nil {
+			t.Fatalf("handle: %v", err)
+		}
+	}
+	// nginx is still running on CPU 0 and has no slice
+	if err := trace.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if trace.invalid != 1 {
+		t.Errorf("%d invalid records, want 1", trace.invalid)
+	}
+
+	var got struct {
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+		TraceEvents     []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("trace isn't valid JSON: %v\n%s", err, out.String())
+	}
+
+	want := []traceEvent{
+		{Name: "process_name", Ph: "M", Args: map[string]any{"name": "CPUs"}},
+		{Name: "thread_name", Ph: "M", Tid: 0, Args: map[string]any{"name": "CPU 0"}},
+		{Name: "thread_sort_index", Ph: "M", Tid: 0, Args: map[string]any{"sort_index": 0.0}},
+		{Name: "thread_name", Ph: "M", Tid: 1, Args: map[string]any{"name": "CPU 1"}},
+		{Name: "thread_sort_index", Ph: "M", Tid: 1, Args: map[string]any{"sort_index": 1.0}},
+		{
+			Name: "nginx", Ph: "X", Ts: 0, Dur: 2000, Tid: 0,
+			Args: map[string]any{"pid": 100.0, "tgid": 100.0, "pod": "default/web-7d4b9c-x2x9q", "then": "blocked"},
+		},
+		{
+			Name: "postgres", Ph: "X", Ts: 500, Dur: 3000, Tid: 1,
+			Args: map[string]any{"pid": 200.0, "tgid": 200.0, "pod": "-", "then": "preempted"},
+		},
+	}
+	if got.DisplayTimeUnit != "ns" {
+		t.Errorf("displayTimeUnit = %q", got.DisplayTimeUnit)
+	}
+	if !reflect.DeepEqual(got.TraceEvents, want) {
+		t.Errorf("traceEvents =\n%+v\nwant\n%+v", got.TraceEvents, want)
+	}
+}